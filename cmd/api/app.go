@@ -2,6 +2,7 @@ package main
 
 import (
 	"backend/internal/auth"
+	appMiddleware "backend/internal/middleware"
 	"backend/internal/services"
 
 	"github.com/sirupsen/logrus"
@@ -9,7 +10,17 @@ import (
 
 type application struct {
 	authenticator auth.Authenticator
+	apiKeys       auth.APIKeyManagerInterface
+	loginLimiter  *auth.LoginLimiter
+	oidc          *auth.OIDCAuthenticator
+	postLoginURL  string
 	logger        *logrus.Logger
 	urlManager    services.URLManagerInterface
 	taskQueue     services.TaskQueueInterface
+	batchManager  services.BatchManagerInterface
+	crawlManager  services.CrawlManagerInterface
+	snapshots     services.SnapshotStoreInterface
+	reanalyzer    services.ReanalyzerInterface
+	rateLimiter   *appMiddleware.RateLimiter
+	urlQuota      *services.DailyQuota
 }
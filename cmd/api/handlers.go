@@ -1,12 +1,17 @@
 package main
 
 import (
+	"backend/internal/auth"
 	"backend/internal/services"
 	"encoding/json"
 	"errors"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 func (app *application) Home(w http.ResponseWriter, _ *http.Request) {
@@ -23,6 +28,15 @@ func (app *application) Home(w http.ResponseWriter, _ *http.Request) {
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
+func (app *application) jwks(w http.ResponseWriter, _ *http.Request) {
+	headers := http.Header{}
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	if err := app.writeJSON(w, http.StatusOK, app.authenticator.PublicKeys(), headers); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+	}
+}
+
 func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 
 	var payload struct {
@@ -40,7 +54,8 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	app.logger.Infof("Received authentication request - user: %s, pass: %s", payload.User, payload.Pass)
+	ip := clientIP(r)
+	app.logger.Infof("Received authentication request - user: %s, ip: %s", payload.User, ip)
 
 	if payload.User == "" || payload.Pass == "" {
 		err := app.errorJSON(w, errors.New("username and password are required"), http.StatusBadRequest)
@@ -50,13 +65,26 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if allowed, wait := app.loginLimiter.Allow(payload.User, ip); !allowed {
+		app.logger.Warnf("Authentication throttled - user: %s, ip: %s, retry after: %s", payload.User, ip, wait)
+		headers := http.Header{}
+		headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		err := app.writeJSON(w, http.StatusTooManyRequests, JSONResponse{Error: true, Message: "too many failed login attempts, try again later"}, headers)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
 	if !app.authenticator.ValidateUserCredentials(payload.User, payload.Pass) {
+		app.loginLimiter.RecordFailure(payload.User, ip)
 		err := app.errorJSON(w, errors.New(http.StatusText(http.StatusUnauthorized)), http.StatusUnauthorized)
 		if err != nil {
 			app.logger.WithError(err).Error("error writing JSON response")
 		}
 		return
 	}
+	app.loginLimiter.RecordSuccess(payload.User, ip)
 
 	tokenString, err := app.authenticator.GenerateToken(payload.User)
 	if err != nil {
@@ -86,6 +114,103 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (app *application) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := app.oidc.StartLogin()
+	if err != nil {
+		app.logger.WithError(err).Error("error starting OIDC login")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	// binds the callback to the browser that started the login
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidcState",
+		Value:    state,
+		Path:     "/oidc",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (app *application) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if idpErr := query.Get("error"); idpErr != "" {
+		app.logger.Warnf("OIDC login rejected by identity provider: %s", idpErr)
+		err := app.errorJSON(w, errors.New(http.StatusText(http.StatusUnauthorized)), http.StatusUnauthorized)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie("oidcState")
+	if err != nil || state == "" || cookie.Value != state {
+		err = app.errorJSON(w, auth.ErrOIDCInvalidState, http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	identity, err := app.oidc.FinishLogin(r.Context(), state, query.Get("code"))
+	if err != nil {
+		app.logger.WithError(err).Warn("OIDC login failed")
+		err = app.errorJSON(w, errors.New(http.StatusText(http.StatusUnauthorized)), http.StatusUnauthorized)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	app.logger.Infof("OIDC login - user: %s, roles: %v", identity.User, identity.Roles)
+
+	tokenString, err := app.oidc.IssueToken(identity)
+	if err != nil {
+		app.logger.WithError(err).Error("error generating token")
+		err := app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:    "oidcState",
+		Value:   "",
+		Path:    "/oidc",
+		Expires: time.Unix(0, 0),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "jwtToken",
+		Value:    tokenString,
+		Expires:  time.Now().Add(24 * time.Hour),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	if app.postLoginURL != "" {
+		http.Redirect(w, r, app.postLoginURL, http.StatusFound)
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]string{"token": tokenString}); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
 func (app *application) logout(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "jwtToken",
@@ -107,7 +232,10 @@ func (app *application) logout(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) addURLs(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		URLs []string `json:"urls"`
+		URLs     []urlEntry             `json:"urls"`
+		Priority int                    `json:"priority"`
+		Timeouts timeoutsPayload        `json:"timeouts"`
+		Profile  *services.FetchProfile `json:"profile"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&payload)
@@ -120,11 +248,52 @@ func (app *application) addURLs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validatePriority(payload.Priority); err != nil {
+		err = app.errorJSON(w, err, http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	timeouts, err := parseTimeouts(payload.Timeouts)
+	if err == nil {
+		err = payload.Profile.Validate()
+	}
+	for _, entry := range payload.URLs {
+		if err == nil {
+			err = entry.Profile.Validate()
+		}
+	}
+	if err != nil {
+		err = app.errorJSON(w, err, http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	user := requestUser(r)
+	quota := app.urlQuota.Reserve(user, len(payload.URLs))
+	if !quota.Allowed {
+		app.logger.Warnf("Daily URL quota exceeded - user: %s, requested: %d", user, len(payload.URLs))
+		if err := app.quotaExceededJSON(w, quota); err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
 	var failedURLs []string
+	var urlIDs []int
 
-	for _, url := range payload.URLs {
-		urlInfo := app.urlManager.AddURL(url)
+	for _, entry := range payload.URLs {
+		url, profile := entry.URL, entry.Profile
+		if profile == nil {
+			profile = payload.Profile
+		}
+		urlInfo := app.urlManager.AddURL(url, services.URLOptions{Owner: user, Priority: payload.Priority, Timeouts: timeouts, Profile: profile})
 		app.logger.Infof("Adding URL: %s", url)
+		urlIDs = append(urlIDs, urlInfo.ID)
 
 		_, err := app.taskQueue.AddTask(urlInfo)
 		if err != nil {
@@ -133,10 +302,16 @@ func (app *application) addURLs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	app.urlQuota.Release(user, len(failedURLs))
+
 	response := map[string]interface{}{
 		"message": "URLs processed",
 		"failed":  failedURLs,
 	}
+	if len(urlIDs) > 0 {
+		batch := app.batchManager.CreateBatch(user, urlIDs)
+		response["batch_id"] = batch.ID
+	}
 
 	if err := app.writeJSON(w, http.StatusOK, response); err != nil {
 		app.logger.WithError(err).Error("error writing JSON response")
@@ -175,7 +350,7 @@ func (app *application) getURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, urlInfo); err != nil {
+	if err := app.writeJSON(w, http.StatusOK, app.withQueuePositions(urlInfo)[0]); err != nil {
 		app.logger.Println("error writing JSON response:", err)
 		err = app.errorJSON(w, err, http.StatusInternalServerError)
 		if err != nil {
@@ -185,7 +360,7 @@ func (app *application) getURL(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) getAllURLs(w http.ResponseWriter, r *http.Request) {
-	urls := app.urlManager.GetAllURLs()
+	urls := app.withQueuePositions(app.urlManager.GetAllURLs()...)
 
 	if err := app.writeJSON(w, http.StatusOK, urls); err != nil {
 		app.logger.WithError(err).Error("error writing JSON response")
@@ -198,7 +373,8 @@ func (app *application) getAllURLs(w http.ResponseWriter, r *http.Request) {
 
 func (app *application) startComputation(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
-		ID int `json:"id"`
+		ID       int  `json:"id"`
+		Priority *int `json:"priority"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&payload)
@@ -211,6 +387,16 @@ func (app *application) startComputation(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if payload.Priority != nil {
+		if err := validatePriority(*payload.Priority); err != nil {
+			err = app.errorJSON(w, err, http.StatusBadRequest)
+			if err != nil {
+				app.logger.WithError(err).Error("error writing JSON response")
+			}
+			return
+		}
+	}
+
 	urlInfo := app.urlManager.GetURLInfo(payload.ID)
 	if urlInfo == nil {
 		app.logger.WithError(err).Error("URL not found")
@@ -239,17 +425,30 @@ func (app *application) startComputation(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	user := requestUser(r)
+	if quota := app.urlQuota.Reserve(user, 1); !quota.Allowed {
+		if err := app.quotaExceededJSON(w, quota); err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
 	// If the status of the task is already Completed, reset the task state
 	if currentState == services.Completed {
 		app.logger.Infof("Resetting task ID: %d to Pending state", payload.ID)
 		app.urlManager.UpdateURLState(payload.ID, services.Pending)
 	}
 
+	if payload.Priority != nil {
+		app.urlManager.UpdateURLPriority(payload.ID, *payload.Priority)
+	}
+
 	// Enqueue the task and return a response immediately
 	go func() {
 		_, err := app.taskQueue.AddTask(urlInfo)
 		if err != nil {
 			app.logger.WithError(err).Error("task already in progress")
+			app.urlQuota.Release(user, 1)
 		}
 	}()
 
@@ -288,7 +487,7 @@ func (app *application) stopComputation(w http.ResponseWriter, r *http.Request)
 	}
 
 	currentState := app.urlManager.GetURLState(payload.ID)
-	if currentState == services.Completed || currentState == services.Stopped || currentState == services.Failed {
+	if currentState.Terminal() {
 		response := map[string]interface{}{
 			"id":      urlInfo.ID,
 			"state":   currentState,
@@ -329,3 +528,732 @@ func (app *application) stopComputation(w http.ResponseWriter, r *http.Request)
 		}
 	}
 }
+
+func (app *application) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if payload.Name == "" {
+		err := app.errorJSON(w, errors.New("key name is required"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	principal := auth.PrincipalFromContext(r.Context())
+	key, rawKey, err := app.apiKeys.CreateKey(principal.User, payload.Name, payload.Scopes)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, auth.ErrInvalidScope) {
+			status = http.StatusBadRequest
+		}
+		err = app.errorJSON(w, err, status)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	app.logger.Infof("Created API key - id: %d, user: %s", key.ID, key.User)
+
+	response := map[string]interface{}{
+		"key":     rawKey,
+		"api_key": key,
+	}
+
+	if err := app.writeJSON(w, http.StatusCreated, response); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFromContext(r.Context())
+	keys := app.apiKeys.ListKeys(principal.User)
+
+	if err := app.writeJSON(w, http.StatusOK, keys); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID int `json:"id"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	principal := auth.PrincipalFromContext(r.Context())
+	if err := app.apiKeys.RevokeKey(principal.User, payload.ID); err != nil {
+		err = app.errorJSON(w, err, http.StatusNotFound)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	app.logger.Infof("Revoked API key - id: %d, user: %s", payload.ID, principal.User)
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]interface{}{"id": payload.ID, "message": "API key revoked"}); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) queueStatus(w http.ResponseWriter, r *http.Request) {
+	if err := app.writeJSON(w, http.StatusOK, app.taskQueue.Status()); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) pauseQueue(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		CancelInFlight bool `json:"cancel_in_flight"`
+	}
+
+	// the body is optional
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil && !errors.Is(err, io.EOF) {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	app.taskQueue.Pause(payload.CancelInFlight)
+	app.logger.WithFields(logrus.Fields{
+		"audit":            true,
+		"event":            "queue_paused",
+		"user":             requestUser(r),
+		"cancel_in_flight": payload.CancelInFlight,
+	}).Warn("Task queue paused")
+
+	if err := app.writeJSON(w, http.StatusOK, app.taskQueue.Status()); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) resumeQueue(w http.ResponseWriter, r *http.Request) {
+	app.taskQueue.Resume()
+	app.logger.WithFields(logrus.Fields{
+		"audit": true,
+		"event": "queue_resumed",
+		"user":  requestUser(r),
+	}).Warn("Task queue resumed")
+
+	if err := app.writeJSON(w, http.StatusOK, app.taskQueue.Status()); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) resizeWorkers(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Workers   *int `json:"workers"`
+		Autoscale *struct {
+			MinWorkers     int    `json:"min_workers"`
+			MaxWorkers     int    `json:"max_workers"`
+			QueuePerWorker int    `json:"queue_per_worker"`
+			TargetWait     string `json:"target_wait"`
+			Interval       string `json:"interval"`
+		} `json:"autoscale"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	switch {
+	case (payload.Workers == nil) == (payload.Autoscale == nil):
+		err = errors.New("either workers or autoscale is required")
+	case payload.Workers != nil:
+		err = app.taskQueue.SetWorkerCount(*payload.Workers)
+	default:
+		// unset settings keep their current value
+		config := services.DefaultAutoscaleConfig()
+		if current := app.taskQueue.Status().Autoscale; current != nil {
+			config = *current
+		}
+		config.MinWorkers = payload.Autoscale.MinWorkers
+		config.MaxWorkers = payload.Autoscale.MaxWorkers
+		if payload.Autoscale.QueuePerWorker != 0 {
+			config.QueuePerWorker = payload.Autoscale.QueuePerWorker
+		}
+		if err = parseDurationSetting(payload.Autoscale.TargetWait, &config.TargetWait); err == nil {
+			err = parseDurationSetting(payload.Autoscale.Interval, &config.Interval)
+		}
+		if err == nil {
+			err = app.taskQueue.SetAutoscaling(config)
+		}
+	}
+	if err != nil {
+		err = app.errorJSON(w, err, http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	status := app.taskQueue.Status()
+	app.logger.WithFields(logrus.Fields{
+		"audit":     true,
+		"event":     "workers_resized",
+		"user":      requestUser(r),
+		"workers":   status.Workers,
+		"autoscale": status.Autoscale != nil,
+	}).Warn("Worker pool resized")
+
+	if err := app.writeJSON(w, http.StatusOK, status); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) getBatch(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readIDParam(w, r, "batch")
+	if !ok {
+		return
+	}
+
+	batch := app.batchManager.GetBatch(id)
+	if batch == nil || !canManage(r, batch.Owner) {
+		err := app.errorJSON(w, errors.New("batch not found"), http.StatusNotFound)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, batch); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+// getAllBatches lists the batches of the caller, or of every user for admins.
+func (app *application) getAllBatches(w http.ResponseWriter, r *http.Request) {
+	batches := make([]*services.BatchInfo, 0)
+	for _, batch := range app.batchManager.GetAllBatches() {
+		if canManage(r, batch.Owner) {
+			batches = append(batches, batch)
+		}
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, batches); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+// startBatch queues again every URL of the batch that is not pending or
+// processing.
+func (app *application) startBatch(w http.ResponseWriter, r *http.Request) {
+	app.requeueBatch(w, r, services.URLState.Terminal)
+}
+
+// retryBatch queues again the URLs of the batch that failed or timed out.
+func (app *application) retryBatch(w http.ResponseWriter, r *http.Request) {
+	app.requeueBatch(w, r, func(state services.URLState) bool {
+		return state == services.Failed || state == services.TimedOut
+	})
+}
+
+func (app *application) requeueBatch(w http.ResponseWriter, r *http.Request, selectState func(services.URLState) bool) {
+	batch, ok := app.batchFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var selected []*services.URLInfo
+	for _, id := range batch.URLIDs {
+		if urlInfo := app.urlManager.GetURLInfo(id); urlInfo != nil && selectState(app.urlManager.GetURLState(id)) {
+			selected = append(selected, urlInfo)
+		}
+	}
+
+	user := requestUser(r)
+	if quota := app.urlQuota.Reserve(user, len(selected)); !quota.Allowed {
+		if err := app.quotaExceededJSON(w, quota); err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	affected := 0
+	for _, urlInfo := range selected {
+		if _, err := app.taskQueue.AddTask(urlInfo); err != nil {
+			app.logger.WithError(err).Errorf("error adding URL to task queue: %s", urlInfo.URL)
+			continue
+		}
+		affected++
+	}
+	app.urlQuota.Release(user, len(selected)-affected)
+
+	app.logger.Infof("Requeued batch - id: %d, urls: %d", batch.ID, affected)
+	app.writeBatchResponse(w, batch.ID, affected)
+}
+
+// stopBatch stops every URL of the batch that is pending or processing.
+func (app *application) stopBatch(w http.ResponseWriter, r *http.Request) {
+	batch, ok := app.batchFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	affected := 0
+	for _, id := range batch.URLIDs {
+		if app.urlManager.GetURLState(id).Terminal() {
+			continue
+		}
+		if _, err := app.taskQueue.StopTask(id); err != nil {
+			app.logger.WithError(err).Errorf("Task could not be stopped - id: %d", id)
+			continue
+		}
+		affected++
+	}
+
+	app.logger.Infof("Stopped batch - id: %d, urls: %d", batch.ID, affected)
+	app.writeBatchResponse(w, batch.ID, affected)
+}
+
+// batchFromRequest decodes {"id": ...} and looks up the batch, answering the
+// request itself when that fails or the batch belongs to another user.
+func (app *application) batchFromRequest(w http.ResponseWriter, r *http.Request) (*services.BatchInfo, bool) {
+	var payload struct {
+		ID int `json:"id"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return nil, false
+	}
+
+	batch := app.batchManager.GetBatch(payload.ID)
+	if batch == nil {
+		err = app.errorJSON(w, errors.New("batch not found"), http.StatusNotFound)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return nil, false
+	}
+
+	if !canManage(r, batch.Owner) {
+		err = app.errorJSON(w, errors.New("batch belongs to another user"), http.StatusForbidden)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return nil, false
+	}
+	return batch, true
+}
+
+func (app *application) writeBatchResponse(w http.ResponseWriter, id int, affected int) {
+	response := map[string]interface{}{
+		"affected": affected,
+		"batch":    app.batchManager.GetBatch(id),
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, response); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+// startCrawl enqueues a seed URL and the same-site pages discovered from it.
+func (app *application) startCrawl(w http.ResponseWriter, r *http.Request) {
+	defaults := services.DefaultCrawlOptions()
+	var payload struct {
+		URL      string                 `json:"url"`
+		MaxDepth *int                   `json:"max_depth"`
+		MaxPages *int                   `json:"max_pages"`
+		Include  []string               `json:"include"`
+		Exclude  []string               `json:"exclude"`
+		Priority int                    `json:"priority"`
+		Timeouts timeoutsPayload        `json:"timeouts"`
+		Profile  *services.FetchProfile `json:"profile"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	crawlOpts := services.CrawlOptions{
+		MaxDepth: defaults.MaxDepth,
+		MaxPages: defaults.MaxPages,
+		Include:  payload.Include,
+		Exclude:  payload.Exclude,
+	}
+	if payload.MaxDepth != nil {
+		crawlOpts.MaxDepth = *payload.MaxDepth
+	}
+	if payload.MaxPages != nil {
+		crawlOpts.MaxPages = *payload.MaxPages
+	}
+
+	timeouts, err := parseTimeouts(payload.Timeouts)
+	if err == nil {
+		err = validatePriority(payload.Priority)
+	}
+	if err == nil {
+		err = crawlOpts.Validate()
+	}
+	if err == nil {
+		err = payload.Profile.Validate()
+	}
+	if err != nil {
+		err = app.errorJSON(w, err, http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	user := requestUser(r)
+	if quota := app.urlQuota.Reserve(user, 1); !quota.Allowed {
+		app.logger.Warnf("Daily URL quota exceeded - user: %s, requested: crawl", user)
+		if err := app.quotaExceededJSON(w, quota); err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	crawl, err := app.crawlManager.StartCrawl(payload.URL, crawlOpts, services.URLOptions{Owner: user, Priority: payload.Priority, Timeouts: timeouts, Profile: payload.Profile})
+	if err != nil {
+		app.urlQuota.Release(user, 1)
+		err = app.errorJSON(w, err, http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+	app.logger.Infof("Started crawl - id: %d, seed: %s, max depth: %d, max pages: %d", crawl.ID, crawl.SeedURL, crawlOpts.MaxDepth, crawlOpts.MaxPages)
+
+	if err := app.writeJSON(w, http.StatusOK, crawl); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+// getAllCrawls lists the crawls of the caller, or of every user for admins.
+func (app *application) getAllCrawls(w http.ResponseWriter, r *http.Request) {
+	crawls := make([]*services.CrawlInfo, 0)
+	for _, crawl := range app.crawlManager.GetAllCrawls() {
+		if canManage(r, crawl.Owner) {
+			crawls = append(crawls, crawl)
+		}
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, crawls); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) getCrawl(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readIDParam(w, r, "crawl")
+	if !ok {
+		return
+	}
+
+	crawl := app.crawlManager.GetCrawl(id)
+	if crawl == nil || !canManage(r, crawl.Owner) {
+		err := app.errorJSON(w, errors.New("crawl not found"), http.StatusNotFound)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, crawl); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+func (app *application) getCrawlGraph(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readIDParam(w, r, "crawl")
+	if !ok {
+		return
+	}
+
+	var graph *services.CrawlGraph
+	if crawl := app.crawlManager.GetCrawl(id); crawl != nil && canManage(r, crawl.Owner) {
+		graph = app.crawlManager.GetCrawlGraph(id)
+	}
+	if graph == nil {
+		err := app.errorJSON(w, errors.New("crawl not found"), http.StatusNotFound)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, graph); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+// snapshotResponse is a snapshot with its body, and the other snapshots
+// kept for the same URL.
+type snapshotResponse struct {
+	*services.Snapshot
+	Body      string               `json:"body"`
+	Snapshots []*services.Snapshot `json:"snapshots"`
+}
+
+func (app *application) getURLSnapshot(w http.ResponseWriter, r *http.Request) {
+	id, ok := app.readIDParam(w, r, "url")
+	if !ok {
+		return
+	}
+
+	// snapshots of other users' URLs may hold pages fetched with their
+	// cookies or credentials
+	urlInfo := app.urlManager.GetURLInfo(id)
+	if urlInfo == nil || !canManage(r, urlInfo.Owner) {
+		err := app.errorJSON(w, errors.New("URL not found"), http.StatusNotFound)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	snapshot, err := app.snapshots.Get(urlInfo, r.URL.Query().Get("snapshot"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrSnapshotNotFound) {
+			status = http.StatusNotFound
+		} else {
+			app.logger.WithError(err).Errorf("could not read snapshot of URL %d", id)
+		}
+		err = app.errorJSON(w, err, status)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if raw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); raw {
+		app.writeRawSnapshot(w, snapshot)
+		return
+	}
+
+	snapshots, err := app.snapshots.List(urlInfo)
+	if err != nil {
+		app.logger.WithError(err).Errorf("could not list snapshots of URL %d", id)
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	response := snapshotResponse{Snapshot: snapshot, Body: string(snapshot.Body), Snapshots: snapshots}
+	if err := app.writeJSON(w, http.StatusOK, response); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+// writeRawSnapshot writes the body of snapshot as it was fetched. The page is
+// not ours, so browsers download it instead of rendering it on our origin.
+func (app *application) writeRawSnapshot(w http.ResponseWriter, snapshot *services.Snapshot) {
+	contentType := snapshot.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/html"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot-`+snapshot.ID+`.html"`)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(snapshot.Body); err != nil {
+		app.logger.WithError(err).Error("error writing snapshot")
+	}
+}
+
+// reanalyzeURL analyzes a URL again from one of its snapshots, the newest
+// unless the payload names one, and returns the URL with its new results.
+func (app *application) reanalyzeURL(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID       int    `json:"id"`
+		Snapshot string `json:"snapshot"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if urlInfo := app.urlManager.GetURLInfo(payload.ID); urlInfo == nil || !canManage(r, urlInfo.Owner) {
+		err = app.errorJSON(w, services.ErrURLNotFound, http.StatusNotFound)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if _, err := app.reanalyzer.Reanalyze(r.Context(), payload.ID, payload.Snapshot); err != nil {
+		var analysisErr *services.AnalysisError
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrURLNotFound), errors.Is(err, services.ErrSnapshotNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, services.ErrURLBusy), errors.Is(err, services.ErrURLNotCompleted):
+			status = http.StatusConflict
+		case errors.As(err, &analysisErr):
+			status = http.StatusUnprocessableEntity
+		default:
+			app.logger.WithError(err).Errorf("could not reanalyze URL %d", payload.ID)
+		}
+		err = app.errorJSON(w, err, status)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, app.urlManager.GetURLInfo(payload.ID)); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
+
+// reanalyzeURLs analyzes the URLs of the payload again from their newest
+// snapshots, every completed URL of the caller when it lists none. URLs of
+// other users are reported as not found.
+func (app *application) reanalyzeURLs(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		IDs []int `json:"ids"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		app.logger.WithError(err).Error("error decoding JSON request body")
+		err = app.errorJSON(w, errors.New("invalid request payload"), http.StatusBadRequest)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return
+	}
+
+	results := app.reanalyzer.ReanalyzeMany(r.Context(), payload.IDs, func(urlInfo *services.URLInfo) bool {
+		return canManage(r, urlInfo.Owner)
+	})
+	reanalyzed := 0
+	for _, result := range results {
+		if result.Error == "" {
+			reanalyzed++
+		}
+	}
+	app.logger.Infof("Reanalyzed URLs - requested: %d, reanalyzed: %d", len(results), reanalyzed)
+
+	response := map[string]interface{}{
+		"reanalyzed": reanalyzed,
+		"results":    results,
+	}
+	if err := app.writeJSON(w, http.StatusOK, response); err != nil {
+		app.logger.WithError(err).Error("error writing JSON response")
+		err = app.errorJSON(w, err, http.StatusInternalServerError)
+		if err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+	}
+}
@@ -1,33 +1,46 @@
 package main
 
 import (
+	"backend/internal/auth"
 	"backend/internal/services"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
-	"github.com/go-chi/jwtauth"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/sirupsen/logrus"
 )
 
 type MockAuthenticator struct {
 	ValidateCredentialsFunc func(user, pass string) bool
-	GenerateTokenFunc       func(user string) (string, error)
-	TokenAuthInstance       *jwtauth.JWTAuth
+	GenerateTokenFunc       func(user string, roles ...string) (string, error)
+	VerifyTokenFunc         func(tokenString string) (jwt.Token, error)
 }
 
 func (m *MockAuthenticator) ValidateUserCredentials(user, pass string) bool {
 	return m.ValidateCredentialsFunc(user, pass)
 }
 
-func (m *MockAuthenticator) GenerateToken(user string) (string, error) {
-	return m.GenerateTokenFunc(user)
+func (m *MockAuthenticator) GenerateToken(user string, roles ...string) (string, error) {
+	return m.GenerateTokenFunc(user, roles...)
 }
 
-func (m *MockAuthenticator) TokenAuth() *jwtauth.JWTAuth {
-	return m.TokenAuthInstance
+func (m *MockAuthenticator) VerifyToken(tokenString string) (jwt.Token, error) {
+	return m.VerifyTokenFunc(tokenString)
+}
+
+func (m *MockAuthenticator) PublicKeys() jwk.Set {
+	return jwk.NewSet()
 }
 
 func TestAuthenticateValidCredentials(t *testing.T) {
@@ -35,7 +48,7 @@ func TestAuthenticateValidCredentials(t *testing.T) {
 		ValidateCredentialsFunc: func(user, pass string) bool {
 			return user == "admin" && pass == "password"
 		},
-		GenerateTokenFunc: func(user string) (string, error) {
+		GenerateTokenFunc: func(user string, roles ...string) (string, error) {
 			return "mockToken", nil
 		},
 	}
@@ -45,6 +58,7 @@ func TestAuthenticateValidCredentials(t *testing.T) {
 
 	app := &application{
 		authenticator: authenticator,
+		loginLimiter:  auth.NewLoginLimiter(auth.DefaultLoginLimiterConfig()),
 		logger:        logger,
 	}
 
@@ -79,7 +93,7 @@ func TestAuthenticateInvalidCredentials(t *testing.T) {
 		ValidateCredentialsFunc: func(user, pass string) bool {
 			return user == "admin" && pass == "password"
 		},
-		GenerateTokenFunc: func(user string) (string, error) {
+		GenerateTokenFunc: func(user string, roles ...string) (string, error) {
 			return "mockToken", nil
 		},
 	}
@@ -89,6 +103,7 @@ func TestAuthenticateInvalidCredentials(t *testing.T) {
 
 	app := &application{
 		authenticator: authenticator,
+		loginLimiter:  auth.NewLoginLimiter(auth.DefaultLoginLimiterConfig()),
 		logger:        logger,
 	}
 
@@ -170,6 +185,41 @@ func TestStartComputation(t *testing.T) {
 	}
 }
 
+func TestStartComputationReleasesQuota(t *testing.T) {
+	app := &application{
+		taskQueue: &services.MockTaskQueue{
+			AddTaskFunc: func(urlInfo *services.URLInfo) (*services.Task, error) {
+				return nil, errors.New("task already in progress")
+			},
+		},
+		urlManager: &services.MockURLManager{
+			GetURLInfoFunc: func(id int) *services.URLInfo {
+				return &services.URLInfo{ID: id, URL: "http://example.com", State: services.Stopped}
+			},
+			GetURLStateFunc: func(id int) services.URLState {
+				return services.Stopped
+			},
+		},
+		urlQuota: services.NewDailyQuota(1),
+		logger:   logrus.New(),
+	}
+
+	rr := httptest.NewRecorder()
+	app.startComputation(rr, httptest.NewRequest(http.MethodPost, "/api/start", bytes.NewBufferString(`{"id": 1}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// the task is queued in the background, so the quota comes back later
+	deadline := time.Now().Add(time.Second)
+	for !app.urlQuota.Reserve("", 1).Allowed {
+		if time.Now().After(deadline) {
+			t.Fatal("quota was not released after the task could not be queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func TestAddURLsInvalidJSON(t *testing.T) {
 	mockTaskQueue := &services.MockTaskQueue{}
 	mockURLManager := &services.MockURLManager{}
@@ -202,6 +252,42 @@ func TestAddURLsInvalidJSON(t *testing.T) {
 	}
 }
 
+func TestAddURLsInvalidOptions(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{`{"urls": ["http://example.com"], "priority": 11}`, `{"error":true,"message":"priority must be between 0 and 10"}`},
+		{`{"urls": ["http://example.com"], "timeouts": {"fetch": "soon"}}`, `{"error":true,"message":"invalid fetch timeout: \"soon\""}`},
+		{`{"urls": ["http://example.com"], "timeouts": {"total": "1h"}}`, `{"error":true,"message":"total timeout must be between 0 and 10m0s"}`},
+	}
+
+	for _, tt := range tests {
+		app := &application{
+			taskQueue:  &services.MockTaskQueue{},
+			urlManager: &services.MockURLManager{},
+			logger:     logrus.New(),
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/api/urls", bytes.NewBufferString(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.addURLs)
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+		if rr.Body.String() != tt.expected {
+			t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), tt.expected)
+		}
+	}
+}
+
 func TestGetURLMissingID(t *testing.T) {
 	mockURLManager := &services.MockURLManager{}
 
@@ -229,3 +315,814 @@ func TestGetURLMissingID(t *testing.T) {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
 }
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	apiKeys := auth.NewAPIKeyManager()
+	_, readKey, err := apiKeys.CreateKey("admin@example.com", "reader", []string{auth.ScopeURLsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockURLManager := &services.MockURLManager{
+		GetAllURLsFunc: func() []*services.URLInfo {
+			return []*services.URLInfo{}
+		},
+	}
+
+	authenticator := auth.NewJWTAuthenticator("test-secret")
+	token, err := authenticator.GenerateToken("admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		authenticator: authenticator,
+		apiKeys:       apiKeys,
+		urlManager:    mockURLManager,
+		taskQueue:     &services.MockTaskQueue{},
+		logger:        logrus.New(),
+	}
+	handler := app.routes()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		value  string
+		want   int
+	}{
+		{"x-api-key header", http.MethodGet, "/api/urls", "X-API-Key", readKey, http.StatusOK},
+		{"authorization header", http.MethodGet, "/api/urls", "Authorization", "ApiKey " + readKey, http.StatusOK},
+		{"unknown key", http.MethodGet, "/api/urls", "X-API-Key", "upk_unknown", http.StatusUnauthorized},
+		{"missing scope", http.MethodPost, "/api/urls", "X-API-Key", readKey, http.StatusForbidden},
+		{"keys require session", http.MethodGet, "/api/keys", "X-API-Key", readKey, http.StatusForbidden},
+		{"bearer token", http.MethodGet, "/api/urls", "Authorization", "Bearer " + token, http.StatusOK},
+		{"no credentials", http.MethodGet, "/api/urls", "", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(`{"urls": []}`))
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestAuthenticateThrottlesRepeatedFailures(t *testing.T) {
+	app := &application{
+		authenticator: auth.NewJWTAuthenticator("test-secret"),
+		loginLimiter:  auth.NewLoginLimiter(auth.DefaultLoginLimiterConfig()),
+		logger:        logrus.New(),
+	}
+
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/authenticate", bytes.NewBufferString(`{"user":"admin@example.com","pass":"wrong"}`))
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(app.authenticate).ServeHTTP(rr, req)
+	}
+
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header to be set")
+	}
+}
+
+func TestAdminQueueEndpoints(t *testing.T) {
+	authenticator := auth.NewJWTAuthenticator("test-secret")
+	adminToken, err := authenticator.GenerateToken("admin@example.com", auth.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := authenticator.GenerateToken("user@example.com", "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pausedWith *bool
+	status := services.QueueStatus{Workers: 2}
+	mockTaskQueue := &services.MockTaskQueue{
+		PauseFunc: func(cancelInFlight bool) {
+			pausedWith = &cancelInFlight
+			status.Paused = true
+		},
+		ResumeFunc: func() { status.Paused = false },
+		StatusFunc: func() services.QueueStatus { return status },
+	}
+
+	app := &application{
+		authenticator: authenticator,
+		apiKeys:       auth.NewAPIKeyManager(),
+		taskQueue:     mockTaskQueue,
+		logger:        logrus.New(),
+	}
+	handler := app.routes()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+		paused bool
+	}{
+		{"status requires admin", http.MethodGet, "/api/admin/queue", userToken, "", http.StatusForbidden, false},
+		{"pause requires admin", http.MethodPost, "/api/admin/queue/pause", userToken, "", http.StatusForbidden, false},
+		{"status", http.MethodGet, "/api/admin/queue", adminToken, "", http.StatusOK, false},
+		{"pause", http.MethodPost, "/api/admin/queue/pause", adminToken, `{"cancel_in_flight": true}`, http.StatusOK, true},
+		{"resume", http.MethodPost, "/api/admin/queue/resume", adminToken, "", http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.want)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		var got services.QueueStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Paused != tt.paused || got.Workers != 2 {
+			t.Errorf("%s: unexpected status: %+v", tt.name, got)
+		}
+	}
+
+	if pausedWith == nil || !*pausedWith {
+		t.Errorf("queue was not paused with cancel_in_flight")
+	}
+}
+
+func TestOIDCLoginDoesNotGrantLocalRoles(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpKey, err := jwk.New(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = idpKey.Set(jwk.KeyIDKey, "idp-key-1")
+
+	var idp *httptest.Server
+	var nonce string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		publicKey, _ := jwk.PublicKeyOf(idpKey)
+		set := jwk.NewSet()
+		set.Add(publicKey)
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		// the name of the local admin account, without any mapped group
+		token := jwt.New()
+		_ = token.Set("iss", idp.URL)
+		_ = token.Set("aud", "urls-processor")
+		_ = token.Set("email", "admin@example.com")
+		_ = token.Set("groups", []string{"everyone"})
+		_ = token.Set("exp", time.Now().Add(time.Hour).Unix())
+		_ = token.Set("nonce", nonce)
+		signed, _ := jwt.Sign(token, jwa.RS256, idpKey)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": string(signed), "token_type": "Bearer"})
+	})
+	idp = httptest.NewServer(mux)
+	defer idp.Close()
+
+	local := auth.NewJWTAuthenticator("test-secret")
+	oidc, err := auth.NewOIDCAuthenticator(context.Background(), auth.OIDCConfig{
+		IssuerURL:   idp.URL,
+		ClientID:    "urls-processor",
+		RedirectURL: "http://localhost:8080/oidc/callback",
+		RoleMap:     map[string]string{"platform-admins": auth.RoleAdmin},
+	}, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{
+		authenticator: oidc,
+		oidc:          oidc,
+		apiKeys:       auth.NewAPIKeyManager(),
+		taskQueue:     &services.MockTaskQueue{},
+		logger:        logrus.New(),
+	}
+	handler := app.routes()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	nonce = location.Query().Get("nonce")
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=valid-code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: "oidcState", Value: state})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &login); err != nil || login.Token == "" {
+		t.Fatalf("OIDC login failed: %v %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/admin/queue", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("OIDC user without mapped roles reached the admin API: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestResizeWorkers(t *testing.T) {
+	var workers int
+	var autoscale *services.AutoscaleConfig
+	mockTaskQueue := &services.MockTaskQueue{
+		SetWorkerCountFunc: func(n int) error {
+			workers = n
+			return nil
+		},
+		SetAutoscalingFunc: func(config services.AutoscaleConfig) error {
+			if err := config.Validate(); err != nil {
+				return err
+			}
+			autoscale = &config
+			return nil
+		},
+		StatusFunc: func() services.QueueStatus { return services.QueueStatus{Workers: workers} },
+	}
+
+	app := &application{
+		taskQueue: mockTaskQueue,
+		logger:    logrus.New(),
+	}
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"workers": 8}`, http.StatusOK},
+		{`{"autoscale": {"min_workers": 2, "max_workers": 10, "target_wait": "1m"}}`, http.StatusOK},
+		{`{"autoscale": {"min_workers": 2, "max_workers": 10, "interval": "soon"}}`, http.StatusBadRequest},
+		{`{"autoscale": {"min_workers": 5, "max_workers": 2}}`, http.StatusBadRequest},
+		{`{}`, http.StatusBadRequest},
+		{`{"workers": 2, "autoscale": {"min_workers": 1, "max_workers": 2}}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/workers", bytes.NewBufferString(tt.body))
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.resizeWorkers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.body, rr.Code, tt.want)
+		}
+	}
+
+	if workers != 8 {
+		t.Errorf("worker count not set: got %d", workers)
+	}
+	if autoscale == nil || autoscale.TargetWait != time.Minute || autoscale.QueuePerWorker != services.DefaultAutoscaleConfig().QueuePerWorker {
+		t.Errorf("unexpected autoscale config: %+v", autoscale)
+	}
+}
+
+func TestRetryBatch(t *testing.T) {
+	states := map[int]services.URLState{
+		1: services.Completed,
+		2: services.Failed,
+		3: services.TimedOut,
+		4: services.Processing,
+	}
+	mockURLManager := &services.MockURLManager{
+		GetURLInfoFunc: func(id int) *services.URLInfo {
+			return &services.URLInfo{ID: id, URL: "http://example.com", State: states[id]}
+		},
+		GetURLStateFunc: func(id int) services.URLState {
+			return states[id]
+		},
+	}
+
+	var queued []int
+	mockTaskQueue := &services.MockTaskQueue{
+		AddTaskFunc: func(urlInfo *services.URLInfo) (*services.Task, error) {
+			queued = append(queued, urlInfo.ID)
+			return &services.Task{ID: urlInfo.ID}, nil
+		},
+	}
+	mockBatchManager := &services.MockBatchManager{
+		GetBatchFunc: func(id int) *services.BatchInfo {
+			if id != 7 {
+				return nil
+			}
+			return &services.BatchInfo{Batch: services.Batch{ID: 7, URLIDs: []int{1, 2, 3, 4}}}
+		},
+	}
+
+	app := &application{
+		urlManager:   mockURLManager,
+		taskQueue:    mockTaskQueue,
+		batchManager: mockBatchManager,
+		logger:       logrus.New(),
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/batch/retry", bytes.NewBufferString(`{"id": 8}`))
+	app.retryBatch(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown batch: handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/batch/retry", bytes.NewBufferString(`{"id": 7}`))
+	app.retryBatch(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var response struct {
+		Affected int                 `json:"affected"`
+		Batch    *services.BatchInfo `json:"batch"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Affected != 2 || response.Batch == nil || response.Batch.ID != 7 {
+		t.Errorf("unexpected response: %s", rr.Body.String())
+	}
+	if len(queued) != 2 || queued[0] != 2 || queued[1] != 3 {
+		t.Errorf("expected the failed and timed out URLs to be queued, got %v", queued)
+	}
+}
+
+func TestBatchActionsRequireOwner(t *testing.T) {
+	var stopped []int
+	app := &application{
+		urlManager: &services.MockURLManager{
+			GetURLStateFunc: func(id int) services.URLState {
+				return services.Processing
+			},
+		},
+		taskQueue: &services.MockTaskQueue{
+			StopTaskFunc: func(id int) (*services.Task, error) {
+				stopped = append(stopped, id)
+				return &services.Task{ID: id}, nil
+			},
+		},
+		batchManager: &services.MockBatchManager{
+			GetBatchFunc: func(id int) *services.BatchInfo {
+				return &services.BatchInfo{Batch: services.Batch{ID: id, Owner: "alice", URLIDs: []int{1}}}
+			},
+		},
+		logger: logrus.New(),
+	}
+
+	tests := []struct {
+		principal *auth.Principal
+		want      int
+	}{
+		{&auth.Principal{User: "bob"}, http.StatusForbidden},
+		{&auth.Principal{User: "alice"}, http.StatusOK},
+		{&auth.Principal{User: "root", Roles: []string{auth.RoleAdmin}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/batch/stop", bytes.NewBufferString(`{"id": 7}`))
+		req = req.WithContext(auth.NewContext(req.Context(), tt.principal))
+		rr := httptest.NewRecorder()
+		app.stopBatch(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.principal.User, rr.Code, tt.want)
+		}
+	}
+	if len(stopped) != 2 {
+		t.Errorf("expected only the owner and the admin to stop the batch, got %v", stopped)
+	}
+}
+
+func TestBatchReadsRequireOwner(t *testing.T) {
+	app := &application{
+		batchManager: &services.MockBatchManager{
+			GetBatchFunc: func(id int) *services.BatchInfo {
+				return &services.BatchInfo{Batch: services.Batch{ID: id, Owner: "alice"}}
+			},
+			GetAllBatchesFunc: func() []*services.BatchInfo {
+				return []*services.BatchInfo{
+					{Batch: services.Batch{ID: 1, Owner: "alice"}},
+					{Batch: services.Batch{ID: 2, Owner: "bob"}},
+				}
+			},
+		},
+		logger: logrus.New(),
+	}
+
+	tests := []struct {
+		principal *auth.Principal
+		want      int
+		listed    int
+	}{
+		{&auth.Principal{User: "bob"}, http.StatusNotFound, 1},
+		{&auth.Principal{User: "alice"}, http.StatusOK, 1},
+		{&auth.Principal{User: "root", Roles: []string{auth.RoleAdmin}}, http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/batch?id=7", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), tt.principal))
+		rr := httptest.NewRecorder()
+		app.getBatch(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.principal.User, rr.Code, tt.want)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/api/batches", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), tt.principal))
+		rr = httptest.NewRecorder()
+		app.getAllBatches(rr, req)
+		var batches []services.BatchInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &batches); err != nil {
+			t.Fatal(err)
+		}
+		if len(batches) != tt.listed {
+			t.Errorf("%s: expected %d batches, got %s", tt.principal.User, tt.listed, rr.Body.String())
+		}
+	}
+}
+
+func TestStartCrawl(t *testing.T) {
+	var started services.CrawlOptions
+	mockCrawlManager := &services.MockCrawlManager{
+		StartCrawlFunc: func(seedURL string, crawlOpts services.CrawlOptions, urlOpts services.URLOptions) (*services.CrawlInfo, error) {
+			started = crawlOpts
+			return &services.CrawlInfo{Crawl: services.Crawl{ID: 1, SeedURL: seedURL, Options: crawlOpts}}, nil
+		},
+	}
+	app := &application{
+		crawlManager: mockCrawlManager,
+		logger:       logrus.New(),
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"invalid depth", `{"url": "http://example.com", "max_depth": 99}`, http.StatusBadRequest},
+		{"invalid pattern", `{"url": "http://example.com", "include": ["("]}`, http.StatusBadRequest},
+		{"defaults", `{"url": "http://example.com", "exclude": ["^/private/"]}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/crawls", bytes.NewBufferString(tt.body))
+		app.startCrawl(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.want)
+		}
+	}
+
+	defaults := services.DefaultCrawlOptions()
+	if started.MaxDepth != defaults.MaxDepth || started.MaxPages != defaults.MaxPages || len(started.Exclude) != 1 {
+		t.Errorf("unexpected crawl options: %+v", started)
+	}
+}
+
+func TestCrawlReadsRequireOwner(t *testing.T) {
+	app := &application{
+		crawlManager: &services.MockCrawlManager{
+			GetCrawlFunc: func(id int) *services.CrawlInfo {
+				return &services.CrawlInfo{Crawl: services.Crawl{ID: id, Owner: "alice"}}
+			},
+			GetCrawlGraphFunc: func(id int) *services.CrawlGraph {
+				return &services.CrawlGraph{Pages: []services.CrawlPage{{URL: "http://example.com/"}}}
+			},
+			GetAllCrawlsFunc: func() []*services.CrawlInfo {
+				return []*services.CrawlInfo{
+					{Crawl: services.Crawl{ID: 1, Owner: "alice"}},
+					{Crawl: services.Crawl{ID: 2, Owner: "bob"}},
+				}
+			},
+		},
+		logger: logrus.New(),
+	}
+
+	tests := []struct {
+		principal *auth.Principal
+		want      int
+		listed    int
+	}{
+		{&auth.Principal{User: "bob"}, http.StatusNotFound, 1},
+		{&auth.Principal{User: "alice"}, http.StatusOK, 1},
+		{&auth.Principal{User: "root", Roles: []string{auth.RoleAdmin}}, http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		for path, handler := range map[string]http.HandlerFunc{"/api/crawl": app.getCrawl, "/api/crawl/graph": app.getCrawlGraph} {
+			req := httptest.NewRequest(http.MethodGet, path+"?id=7", nil)
+			req = req.WithContext(auth.NewContext(req.Context(), tt.principal))
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("%s %s: handler returned wrong status code: got %v want %v", tt.principal.User, path, rr.Code, tt.want)
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/api/crawls", nil)
+		req = req.WithContext(auth.NewContext(req.Context(), tt.principal))
+		rr := httptest.NewRecorder()
+		app.getAllCrawls(rr, req)
+		var crawls []services.CrawlInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &crawls); err != nil {
+			t.Fatal(err)
+		}
+		if len(crawls) != tt.listed {
+			t.Errorf("%s: expected %d crawls, got %s", tt.principal.User, tt.listed, rr.Body.String())
+		}
+	}
+}
+
+func TestAddURLsProfiles(t *testing.T) {
+	profiles := make(map[string]*services.FetchProfile)
+	mockURLManager := &services.MockURLManager{
+		AddURLFunc: func(url string, opts services.URLOptions) *services.URLInfo {
+			profiles[url] = opts.Profile
+			return &services.URLInfo{ID: len(profiles), URL: url, Profile: opts.Profile}
+		},
+	}
+	app := &application{
+		urlManager: mockURLManager,
+		taskQueue:  &services.MockTaskQueue{},
+		batchManager: &services.MockBatchManager{
+			CreateBatchFunc: func(owner string, urlIDs []int) *services.BatchInfo {
+				return &services.BatchInfo{Batch: services.Batch{ID: 1, URLIDs: urlIDs}}
+			},
+		},
+		logger: logrus.New(),
+	}
+
+	body := `{
+		"urls": ["http://example.com/bot", {"url": "http://example.com/browser", "profile": {"user_agent": "Mozilla/5.0"}}],
+		"profile": {"user_agent": "URLsProcessor/1.0", "headers": {"X-Env": "staging"}}
+	}`
+	rr := httptest.NewRecorder()
+	app.addURLs(rr, httptest.NewRequest(http.MethodPost, "/api/urls", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if p := profiles["http://example.com/bot"]; p == nil || p.UserAgent != "URLsProcessor/1.0" || p.Headers["X-Env"] != "staging" {
+		t.Errorf("expected the request profile for a plain URL, got %+v", p)
+	}
+	if p := profiles["http://example.com/browser"]; p == nil || p.UserAgent != "Mozilla/5.0" {
+		t.Errorf("expected the URL's own profile, got %+v", p)
+	}
+
+	rr = httptest.NewRecorder()
+	body = `{"urls": ["http://example.com"], "profile": {"proxy": "ftp://proxy"}}`
+	app.addURLs(rr, httptest.NewRequest(http.MethodPost, "/api/urls", bytes.NewBufferString(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid profile: handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGetURLSnapshot(t *testing.T) {
+	snapshot := &services.Snapshot{
+		ID:     "00000000000000000001",
+		URLID:  1,
+		URL:    "http://example.com/",
+		Header: http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:   []byte("<p>hi</p>"),
+	}
+	app := &application{
+		urlManager: &services.MockURLManager{
+			GetURLInfoFunc: func(id int) *services.URLInfo {
+				if id != 1 && id != 2 {
+					return nil
+				}
+				return &services.URLInfo{ID: id}
+			},
+		},
+		snapshots: &services.MockSnapshotStore{
+			GetFunc: func(urlInfo *services.URLInfo, id string) (*services.Snapshot, error) {
+				if urlInfo.ID != 1 {
+					return nil, services.ErrSnapshotNotFound
+				}
+				return snapshot, nil
+			},
+			ListFunc: func(urlInfo *services.URLInfo) ([]*services.Snapshot, error) {
+				return []*services.Snapshot{snapshot}, nil
+			},
+		},
+		logger: logrus.New(),
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusBadRequest},
+		{"id=3", http.StatusNotFound},
+		{"id=2", http.StatusNotFound},
+		{"id=1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		app.getURLSnapshot(rr, httptest.NewRequest(http.MethodGet, "/api/url/snapshot?"+tt.query, nil))
+		if rr.Code != tt.want {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", tt.query, rr.Code, tt.want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	app.getURLSnapshot(rr, httptest.NewRequest(http.MethodGet, "/api/url/snapshot?id=1", nil))
+	var response struct {
+		ID        string               `json:"id"`
+		Body      string               `json:"body"`
+		Headers   http.Header          `json:"headers"`
+		Snapshots []*services.Snapshot `json:"snapshots"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.ID != snapshot.ID || response.Body != "<p>hi</p>" || response.Headers.Get("Content-Type") == "" || len(response.Snapshots) != 1 {
+		t.Errorf("unexpected snapshot response: %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	app.getURLSnapshot(rr, httptest.NewRequest(http.MethodGet, "/api/url/snapshot?id=1&raw=true", nil))
+	if rr.Body.String() != "<p>hi</p>" || rr.Header().Get("Content-Type") != "text/html; charset=utf-8" || rr.Header().Get("Content-Security-Policy") != "sandbox" {
+		t.Errorf("unexpected raw snapshot: %v %q", rr.Header(), rr.Body.String())
+	}
+
+	// snapshots are only served to the owner of the URL and to admins
+	app.urlManager = &services.MockURLManager{
+		GetURLInfoFunc: func(id int) *services.URLInfo {
+			return &services.URLInfo{ID: id, Owner: "alice"}
+		},
+	}
+	principals := []struct {
+		principal *auth.Principal
+		want      int
+	}{
+		{&auth.Principal{User: "alice"}, http.StatusOK},
+		{&auth.Principal{User: "bob"}, http.StatusNotFound},
+		{&auth.Principal{User: "carol", Roles: []string{auth.RoleAdmin}}, http.StatusOK},
+		{nil, http.StatusNotFound},
+	}
+	for _, tt := range principals {
+		req := httptest.NewRequest(http.MethodGet, "/api/url/snapshot?id=1&raw=true", nil)
+		if tt.principal != nil {
+			req = req.WithContext(auth.NewContext(req.Context(), tt.principal))
+		}
+		rr := httptest.NewRecorder()
+		app.getURLSnapshot(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%+v: handler returned wrong status code: got %v want %v", tt.principal, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestReanalyzeURL(t *testing.T) {
+	urlManager := &services.MockURLManager{
+		GetURLInfoFunc: func(id int) *services.URLInfo {
+			return &services.URLInfo{ID: id, State: services.Completed, ProcessedData: &services.DataInfo{SnapshotID: "00000000000000000001"}}
+		},
+	}
+	app := &application{
+		urlManager: urlManager,
+		reanalyzer: &services.MockReanalyzer{
+			ReanalyzeFunc: func(ctx context.Context, id int, snapshotID string) (*services.DataInfo, error) {
+				switch id {
+				case 1:
+					return &services.DataInfo{SnapshotID: "00000000000000000001"}, nil
+				case 2:
+					return nil, services.ErrURLBusy
+				case 3:
+					return nil, services.ErrSnapshotNotFound
+				case 5:
+					return nil, services.ErrURLNotCompleted
+				}
+				return nil, &services.AnalysisError{Reason: services.ReasonParseError, Err: errors.New("bad")}
+			},
+		},
+		logger: logrus.New(),
+	}
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"id": 1, "snapshot": "00000000000000000001"}`, http.StatusOK},
+		{`{"id": 2}`, http.StatusConflict},
+		{`{"id": 3}`, http.StatusNotFound},
+		{`{"id": 4}`, http.StatusUnprocessableEntity},
+		{`{"id": 5}`, http.StatusConflict},
+		{`{"id": "1"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		app.reanalyzeURL(rr, httptest.NewRequest(http.MethodPost, "/api/url/reanalyze", bytes.NewBufferString(tt.body)))
+		if rr.Code != tt.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.body, rr.Code, tt.want)
+		}
+	}
+
+	// the URLs of other users are not found
+	app.urlManager = &services.MockURLManager{
+		GetURLInfoFunc: func(id int) *services.URLInfo {
+			return &services.URLInfo{ID: id, Owner: "bob", State: services.Completed}
+		},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/url/reanalyze", bytes.NewBufferString(`{"id": 1}`))
+	req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{User: "alice"}))
+	rr := httptest.NewRecorder()
+	app.reanalyzeURL(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code for another user's URL: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	app.urlManager = urlManager
+
+	rr = httptest.NewRecorder()
+	app.reanalyzeURL(rr, httptest.NewRequest(http.MethodPost, "/api/url/reanalyze", bytes.NewBufferString(`{"id": 1}`)))
+	var response services.URLInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.ID != 1 || response.ProcessedData == nil || response.ProcessedData.SnapshotID != "00000000000000000001" {
+		t.Errorf("unexpected reanalyze response: %s", rr.Body.String())
+	}
+}
+
+func TestReanalyzeURLs(t *testing.T) {
+	var requested []int
+	var allowed func(urlInfo *services.URLInfo) bool
+	app := &application{
+		reanalyzer: &services.MockReanalyzer{
+			ReanalyzeManyFunc: func(ctx context.Context, ids []int, allowedFunc func(urlInfo *services.URLInfo) bool) []services.ReanalysisResult {
+				requested, allowed = ids, allowedFunc
+				return []services.ReanalysisResult{
+					{ID: 1, SnapshotID: "00000000000000000001"},
+					{ID: 2, Error: services.ErrURLBusy.Error()},
+				}
+			},
+		},
+		logger: logrus.New(),
+	}
+
+	rr := httptest.NewRecorder()
+	app.reanalyzeURLs(rr, httptest.NewRequest(http.MethodPost, "/api/reanalyze", bytes.NewBufferString(`{"ids": [1, 2]}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var response struct {
+		Reanalyzed int                         `json:"reanalyzed"`
+		Results    []services.ReanalysisResult `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 2 || response.Reanalyzed != 1 || len(response.Results) != 2 || response.Results[1].Error == "" {
+		t.Errorf("unexpected reanalyze response: %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	app.reanalyzeURLs(rr, httptest.NewRequest(http.MethodPost, "/api/reanalyze", bytes.NewBufferString(`{}`)))
+	if rr.Code != http.StatusOK || requested != nil {
+		t.Errorf("an empty payload should reanalyze every URL, got %v %v", rr.Code, requested)
+	}
+
+	// the URLs of other users are refused
+	req := httptest.NewRequest(http.MethodPost, "/api/reanalyze", bytes.NewBufferString(`{"ids": [1, 2]}`))
+	req = req.WithContext(auth.NewContext(req.Context(), &auth.Principal{User: "alice"}))
+	app.reanalyzeURLs(httptest.NewRecorder(), req)
+	if !allowed(&services.URLInfo{Owner: "alice"}) || allowed(&services.URLInfo{Owner: "bob"}) {
+		t.Error("only the URLs of the caller should be reanalyzed")
+	}
+}
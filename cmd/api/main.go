@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"strconv"
+	"syscall"
 	"time"
 
 	"backend/internal/auth"
+	appMiddleware "backend/internal/middleware"
 	"backend/internal/services"
 	"backend/internal/utils"
 
@@ -18,9 +22,19 @@ func main() {
 	// load environment vars
 	utils.LoadEnvFiles()
 
-	jwtSecret := utils.GetEnv("JWT_SECRET", "default-secret")
-	if jwtSecret == "" {
-		logrus.Fatal("JWT_SECRET environment variable is required but not set")
+	var jwtAuthenticator *auth.JWTAuthenticator
+	if keysDir := utils.GetEnv("JWT_KEYS_DIR", ""); keysDir != "" {
+		var err error
+		jwtAuthenticator, err = auth.NewJWTAuthenticatorFromKeys(keysDir, utils.GetEnv("JWT_SIGNING_KEY_ID", ""))
+		if err != nil {
+			logrus.Fatalf("Could not load JWT keys: %v", err)
+		}
+	} else {
+		jwtSecret := utils.GetEnv("JWT_SECRET", "")
+		if jwtSecret == "" {
+			logrus.Fatal("JWT_KEYS_DIR or JWT_SECRET environment variable is required but not set")
+		}
+		jwtAuthenticator = auth.NewJWTAuthenticator(jwtSecret)
 	}
 
 	allowedOrigin := utils.GetEnv("ALLOWED_ORIGIN", "")
@@ -34,28 +48,292 @@ func main() {
 		logrus.Fatalf("Invalid port number: %v", portStr)
 	}
 
+	maxTasksPerUser, err := strconv.Atoi(utils.GetEnv("MAX_TASKS_PER_USER", "0"))
+	if err != nil || maxTasksPerUser < 0 {
+		logrus.Fatalf("Invalid max tasks per user: %v", maxTasksPerUser)
+	}
+
+	rateLimitRPS, err := strconv.ParseFloat(utils.GetEnv("RATE_LIMIT_RPS", "10"), 64)
+	if err != nil || rateLimitRPS <= 0 {
+		logrus.Fatalf("Invalid rate limit: %v", rateLimitRPS)
+	}
+
+	rateLimitBurst, err := strconv.Atoi(utils.GetEnv("RATE_LIMIT_BURST", "20"))
+	if err != nil || rateLimitBurst < 1 {
+		logrus.Fatalf("Invalid rate limit burst: %v", rateLimitBurst)
+	}
+
+	dailyURLQuota, err := strconv.Atoi(utils.GetEnv("DAILY_URL_QUOTA", "1000"))
+	if err != nil || dailyURLQuota < 0 {
+		logrus.Fatalf("Invalid daily URL quota: %v", dailyURLQuota)
+	}
+
+	retryPolicy := services.DefaultRetryPolicy()
+	retryPolicy.MaxAttempts, err = strconv.Atoi(utils.GetEnv("RETRY_MAX_ATTEMPTS", strconv.Itoa(retryPolicy.MaxAttempts)))
+	if err != nil || retryPolicy.MaxAttempts < 1 {
+		logrus.Fatalf("Invalid retry max attempts: %v", retryPolicy.MaxAttempts)
+	}
+
+	retryPolicy.BaseDelay, err = time.ParseDuration(utils.GetEnv("RETRY_BASE_DELAY", retryPolicy.BaseDelay.String()))
+	if err != nil || retryPolicy.BaseDelay < 0 {
+		logrus.Fatalf("Invalid retry base delay: %v", retryPolicy.BaseDelay)
+	}
+
+	retryPolicy.MaxDelay, err = time.ParseDuration(utils.GetEnv("RETRY_MAX_DELAY", retryPolicy.MaxDelay.String()))
+	if err != nil || retryPolicy.MaxDelay < retryPolicy.BaseDelay {
+		logrus.Fatalf("Invalid retry max delay: %v", retryPolicy.MaxDelay)
+	}
+
+	timeouts := services.Timeouts{}
+	for _, setting := range []struct {
+		env   string
+		value string
+		dst   *time.Duration
+	}{
+		{"TASK_TIMEOUT", "2m", &timeouts.Total},
+		{"FETCH_TIMEOUT", "30s", &timeouts.Fetch},
+		{"PARSE_TIMEOUT", "10s", &timeouts.Parse},
+		{"LINK_CHECK_TIMEOUT", "1m", &timeouts.LinkChecks},
+	} {
+		*setting.dst, err = time.ParseDuration(utils.GetEnv(setting.env, setting.value))
+		if err != nil {
+			logrus.Fatalf("Invalid %s: %v", setting.env, err)
+		}
+	}
+	if err := timeouts.Validate(); err != nil {
+		logrus.Fatalf("Invalid timeouts: %v", err)
+	}
+
 	workersStrt := utils.GetEnv("WORKER_COUNT", "-1")
 	workers, err := strconv.Atoi(workersStrt)
-	if err != nil || workers < 1 || workers > 100 {
+	if err != nil || workers < 1 || workers > services.MaxWorkerCount {
 		logrus.Fatalf("Invalid worker count: %v", workers)
 	}
 
-	authenticator := auth.NewJWTAuthenticator(jwtSecret)
+	taskQueueOptions := []services.TaskQueueOption{
+		services.WithMaxTasksPerUser(maxTasksPerUser),
+		services.WithRetryPolicy(retryPolicy),
+		services.WithTimeouts(timeouts),
+	}
+
+	autoscale := services.DefaultAutoscaleConfig()
+	autoscale.MinWorkers, err = strconv.Atoi(utils.GetEnv("AUTOSCALE_MIN_WORKERS", "0"))
+	if err != nil || autoscale.MinWorkers < 0 {
+		logrus.Fatalf("Invalid autoscale min workers: %v", utils.GetEnv("AUTOSCALE_MIN_WORKERS", "0"))
+	}
+	autoscale.MaxWorkers, err = strconv.Atoi(utils.GetEnv("AUTOSCALE_MAX_WORKERS", "0"))
+	if err != nil || autoscale.MaxWorkers < 0 {
+		logrus.Fatalf("Invalid autoscale max workers: %v", utils.GetEnv("AUTOSCALE_MAX_WORKERS", "0"))
+	}
+	if autoscale.MinWorkers > autoscale.MaxWorkers {
+		logrus.Fatalf("Invalid autoscaling: min workers %d exceed max workers %d", autoscale.MinWorkers, autoscale.MaxWorkers)
+	}
+	if autoscale.MaxWorkers > 0 {
+		autoscale.QueuePerWorker, err = strconv.Atoi(utils.GetEnv("AUTOSCALE_QUEUE_PER_WORKER", strconv.Itoa(autoscale.QueuePerWorker)))
+		if err != nil {
+			logrus.Fatalf("Invalid autoscale queue per worker: %v", err)
+		}
+		autoscale.TargetWait, err = time.ParseDuration(utils.GetEnv("AUTOSCALE_TARGET_WAIT", autoscale.TargetWait.String()))
+		if err != nil {
+			logrus.Fatalf("Invalid autoscale target wait: %v", err)
+		}
+		autoscale.Interval, err = time.ParseDuration(utils.GetEnv("AUTOSCALE_INTERVAL", autoscale.Interval.String()))
+		if err != nil {
+			logrus.Fatalf("Invalid autoscale interval: %v", err)
+		}
+		if err := autoscale.Validate(); err != nil {
+			logrus.Fatalf("Invalid autoscaling: %v", err)
+		}
+		taskQueueOptions = append(taskQueueOptions, services.WithAutoscaling(autoscale))
+	}
+
+	maxBodySize, err := strconv.ParseInt(utils.GetEnv("MAX_BODY_SIZE", strconv.Itoa(services.DefaultMaxBodySize)), 10, 64)
+	if err != nil || maxBodySize < 1 {
+		logrus.Fatalf("Invalid max body size: %v", maxBodySize)
+	}
+
+	maxRedirects, err := strconv.Atoi(utils.GetEnv("MAX_REDIRECTS", strconv.Itoa(services.DefaultMaxRedirects)))
+	if err != nil || maxRedirects < 0 {
+		logrus.Fatalf("Invalid max redirects: %v", maxRedirects)
+	}
+
+	userAgent := utils.GetEnv("USER_AGENT", "URLsProcessor/1.0")
+
+	robotsEnabled, err := strconv.ParseBool(utils.GetEnv("ROBOTS_TXT", "true"))
+	if err != nil {
+		logrus.Fatalf("Invalid ROBOTS_TXT: %v", err)
+	}
+
+	robotsCacheTTL, err := time.ParseDuration(utils.GetEnv("ROBOTS_CACHE_TTL", "24h"))
+	if err != nil || robotsCacheTTL <= 0 {
+		logrus.Fatalf("Invalid robots cache TTL: %v", robotsCacheTTL)
+	}
+
+	var hostLimits services.HostLimits
+	hostLimits.MaxConcurrent, err = strconv.Atoi(utils.GetEnv("HOST_MAX_CONCURRENCY", "2"))
+	if err != nil || hostLimits.MaxConcurrent < 0 {
+		logrus.Fatalf("Invalid host max concurrency: %v", hostLimits.MaxConcurrent)
+	}
+
+	hostRPS, err := strconv.ParseFloat(utils.GetEnv("HOST_REQUESTS_PER_SECOND", "5"), 64)
+	if err != nil || hostRPS < 0 {
+		logrus.Fatalf("Invalid host requests per second: %v", hostRPS)
+	}
+	if hostRPS > 0 {
+		hostLimits.Interval = time.Duration(float64(time.Second) / hostRPS)
+	}
+
+	ssrfProtection, err := strconv.ParseBool(utils.GetEnv("SSRF_PROTECTION", "true"))
+	if err != nil {
+		logrus.Fatalf("Invalid SSRF_PROTECTION: %v", err)
+	}
+
+	var networkPolicy *services.NetworkPolicy
+	if ssrfProtection {
+		networkPolicy, err = services.NewNetworkPolicy(
+			strings.Split(utils.GetEnv("FETCH_ALLOW", ""), ","),
+			strings.Split(utils.GetEnv("FETCH_DENY", ""), ","),
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid network policy: %v", err)
+		}
+	}
+
+	var authenticator auth.Authenticator = jwtAuthenticator
+	apiKeys := auth.NewAPIKeyManager()
+
+	var oidcAuthenticator *auth.OIDCAuthenticator
+	if issuer := utils.GetEnv("OIDC_ISSUER", ""); issuer != "" {
+		oidcAuthenticator, err = auth.NewOIDCAuthenticator(context.Background(), auth.OIDCConfig{
+			IssuerURL:    issuer,
+			ClientID:     utils.GetEnv("OIDC_CLIENT_ID", ""),
+			ClientSecret: utils.GetEnv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:  utils.GetEnv("OIDC_REDIRECT_URL", ""),
+			UserClaim:    utils.GetEnv("OIDC_USER_CLAIM", "email"),
+			RolesClaim:   utils.GetEnv("OIDC_ROLES_CLAIM", "groups"),
+			RoleMap:      parseRoleMap(utils.GetEnv("OIDC_ROLE_MAP", "")),
+		}, jwtAuthenticator)
+		if err != nil {
+			logrus.Fatalf("Could not configure OIDC: %v", err)
+		}
+		authenticator = oidcAuthenticator
+	}
 
 	logger := logrus.New()
 	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(utils.RedactHook{})
+
+	loginLimiterConfig := auth.DefaultLoginLimiterConfig()
+	loginLimiterConfig.OnLockout = func(kind, key string, until time.Time) {
+		logger.WithFields(logrus.Fields{
+			"audit":        true,
+			"event":        "login_lockout",
+			"kind":         kind,
+			"key":          key,
+			"locked_until": until,
+		}).Warn("Login locked out after repeated failures")
+	}
 	urlManager := services.NewURLManager()
-	client := &http.Client{Timeout: 10 * time.Second}
-	pageAnalyzer := services.NewPageAnalyzer(client, logger)
-	taskQueue := services.NewTaskQueue(workers, urlManager, pageAnalyzer, logger)
+	batchManager := services.NewBatchManager(urlManager)
+	urlManager.OnStateChange(batchManager.HandleStateChange)
+	batchManager.OnComplete(func(batch services.BatchInfo) {
+		logger.WithFields(logrus.Fields{
+			"event":    "batch_completed",
+			"batch_id": batch.ID,
+			"owner":    batch.Owner,
+			"counts":   batch.Progress.Counts,
+		}).Info("Batch completed")
+	})
+	hostLimiter := services.NewHostLimiter(hostLimits)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// proxies are only used when a fetch profile sets one, not taken from
+	// the environment where the network policy would not see the targets
+	transport.Proxy = nil
+	if networkPolicy != nil {
+		transport.DialContext = networkPolicy.DialContext
+	}
+	// timeouts are applied per task and phase by the page analyzer
+	client := &http.Client{Transport: services.LimitTransport(transport, hostLimiter)}
+	analyzerOptions := []services.PageAnalyzerOption{
+		services.WithUserAgent(userAgent),
+		services.WithMaxBodySize(maxBodySize),
+		services.WithMaxRedirects(maxRedirects),
+	}
+	if networkPolicy != nil {
+		analyzerOptions = append(analyzerOptions, services.WithNetworkPolicy(networkPolicy))
+	}
+	if path := utils.GetEnv("TRACKER_DOMAINS_FILE", ""); path != "" {
+		trackers, err := services.LoadTrackerList(path)
+		if err != nil {
+			logrus.Fatalf("Could not load tracker domains: %v", err)
+		}
+		analyzerOptions = append(analyzerOptions, services.WithTrackers(trackers))
+	}
+	var snapshotStore services.SnapshotStoreInterface
+	if snapshotDir := utils.GetEnv("SNAPSHOT_DIR", ""); snapshotDir != "" {
+		var retention services.SnapshotRetention
+		retention.MaxPerURL, err = strconv.Atoi(utils.GetEnv("SNAPSHOT_MAX_PER_URL", "5"))
+		if err != nil || retention.MaxPerURL < 0 {
+			logrus.Fatalf("Invalid snapshots per URL: %v", retention.MaxPerURL)
+		}
+		retention.MaxAge, err = time.ParseDuration(utils.GetEnv("SNAPSHOT_MAX_AGE", "720h"))
+		if err != nil || retention.MaxAge < 0 {
+			logrus.Fatalf("Invalid snapshot max age: %v", retention.MaxAge)
+		}
+		store, err := services.NewFileSnapshotStore(snapshotDir, retention)
+		if err != nil {
+			logrus.Fatalf("Could not open snapshot store: %v", err)
+		}
+		go func() {
+			for {
+				if err := store.Prune(); err != nil {
+					logger.WithError(err).Error("could not prune snapshots")
+				}
+				time.Sleep(snapshotPruneInterval)
+			}
+		}()
+		snapshotStore = store
+		analyzerOptions = append(analyzerOptions, services.WithSnapshots(store))
+	}
+	if robotsEnabled {
+		robots := services.NewRobotsCache(client, userAgent, robotsCacheTTL, hostLimiter)
+		analyzerOptions = append(analyzerOptions, services.WithRobots(robots))
+	}
+	pageAnalyzer := services.NewPageAnalyzer(client, logger, analyzerOptions...)
+	taskQueue := services.NewTaskQueue(workers, urlManager, pageAnalyzer, logger, taskQueueOptions...)
+	urlQuota := services.NewDailyQuota(dailyURLQuota)
+	crawlManager := services.NewCrawlManager(urlManager, taskQueue, urlQuota)
+	urlManager.OnStateChange(crawlManager.HandleStateChange)
+	var reanalyzer services.ReanalyzerInterface
+	if snapshotStore != nil {
+		reanalyzer = services.NewReanalyzer(urlManager, snapshotStore, pageAnalyzer, logger)
+	}
 
 	app := &application{
 		authenticator: authenticator,
+		apiKeys:       apiKeys,
+		loginLimiter:  auth.NewLoginLimiter(loginLimiterConfig),
+		oidc:          oidcAuthenticator,
+		postLoginURL:  utils.GetEnv("OIDC_POST_LOGIN_URL", ""),
 		logger:        logger,
 		urlManager:    urlManager,
 		taskQueue:     taskQueue,
+		batchManager:  batchManager,
+		crawlManager:  crawlManager,
+		snapshots:     snapshotStore,
+		reanalyzer:    reanalyzer,
+		rateLimiter:   appMiddleware.NewRateLimiter(rateLimitRPS, rateLimitBurst),
+		urlQuota:      urlQuota,
 	}
 
+	go utils.OnSignal(syscall.SIGHUP, func() {
+		if err := jwtAuthenticator.ReloadKeys(); err != nil {
+			logger.WithError(err).Error("could not reload JWT keys, keeping the current ones")
+			return
+		}
+		logger.Info("JWT keys reloaded")
+	})
+
 	logger.Println("Starting application on port", port)
 	logger.Infof("Workers count: %d", workers)
 
@@ -74,3 +352,19 @@ func main() {
 	utils.GracefulShutdown(srv, logger)
 
 }
+
+// snapshotPruneInterval is how often snapshots beyond the retention are
+// deleted.
+const snapshotPruneInterval = time.Hour
+
+// parseRoleMap parses "idp-group=role,other-group=role" into a map.
+func parseRoleMap(value string) map[string]string {
+	roleMap := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		idpRole, role, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && idpRole != "" && role != "" {
+			roleMap[idpRole] = role
+		}
+	}
+	return roleMap
+}
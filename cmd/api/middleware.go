@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/internal/auth"
+
+	"github.com/go-chi/jwtauth"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// authenticateRequest accepts either an API key (X-API-Key or
+// "Authorization: ApiKey <key>") or a JWT (Bearer header or cookie) and
+// stores the resulting auth.Principal in the request context.
+func (app *application) authenticateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var principal *auth.Principal
+
+		if rawKey := apiKeyFromRequest(r); rawKey != "" {
+			key, err := app.apiKeys.ValidateKey(rawKey)
+			if err != nil {
+				app.logger.WithError(err).Warn("API key rejected")
+				err = app.errorJSON(w, errors.New(http.StatusText(http.StatusUnauthorized)), http.StatusUnauthorized)
+				if err != nil {
+					app.logger.WithError(err).Error("error writing JSON response")
+				}
+				return
+			}
+			principal = &auth.Principal{User: key.User, APIKeyID: key.ID, Scopes: key.Scopes}
+		} else {
+			tokenString := jwtauth.TokenFromHeader(r)
+			if tokenString == "" {
+				tokenString = jwtauth.TokenFromCookie(r)
+			}
+			token, err := app.authenticator.VerifyToken(tokenString)
+			if err != nil || token == nil {
+				err = app.errorJSON(w, errors.New(http.StatusText(http.StatusUnauthorized)), http.StatusUnauthorized)
+				if err != nil {
+					app.logger.WithError(err).Error("error writing JSON response")
+				}
+				return
+			}
+			user, _ := token.Get("user")
+			userStr, _ := user.(string)
+			principal = &auth.Principal{User: userStr, Scopes: auth.AllScopes, Roles: rolesFromToken(token)}
+			r = r.WithContext(jwtauth.NewContext(r.Context(), token, nil))
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+	})
+}
+
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := auth.PrincipalFromContext(r.Context())
+			if principal == nil || !principal.HasScope(scope) {
+				err := app.errorJSON(w, errors.New("missing scope "+scope), http.StatusForbidden)
+				if err != nil {
+					app.logger.WithError(err).Error("error writing JSON response")
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (app *application) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := auth.PrincipalFromContext(r.Context())
+			if principal == nil || !principal.HasRole(role) {
+				err := app.errorJSON(w, errors.New("missing role "+role), http.StatusForbidden)
+				if err != nil {
+					app.logger.WithError(err).Error("error writing JSON response")
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession rejects API key callers, e.g. so that a key cannot mint
+// further keys.
+func (app *application) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := auth.PrincipalFromContext(r.Context())
+		if principal == nil || principal.IsAPIKey() {
+			err := app.errorJSON(w, errors.New("this endpoint requires a user session"), http.StatusForbidden)
+			if err != nil {
+				app.logger.WithError(err).Error("error writing JSON response")
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitKey gives every API key its own bucket, separate from the
+// sessions of the user it belongs to.
+func rateLimitKey(r *http.Request) string {
+	principal := auth.PrincipalFromContext(r.Context())
+	if principal == nil {
+		return "ip:" + clientIP(r)
+	}
+	if principal.IsAPIKey() {
+		return "key:" + strconv.Itoa(principal.APIKeyID)
+	}
+	return "user:" + principal.User
+}
+
+// requestUser returns the user on whose behalf the request is made.
+func requestUser(r *http.Request) string {
+	if principal := auth.PrincipalFromContext(r.Context()); principal != nil {
+		return principal.User
+	}
+	return ""
+}
+
+// canManage reports whether the caller may act on something owner
+// submitted: their own submissions, or anyone's for admins.
+func canManage(r *http.Request, owner string) bool {
+	principal := auth.PrincipalFromContext(r.Context())
+	if principal == nil {
+		return owner == ""
+	}
+	return principal.User == owner || principal.HasRole(auth.RoleAdmin)
+}
+
+func rolesFromToken(token jwt.Token) []string {
+	value, _ := token.Get("roles")
+	items, _ := value.([]interface{})
+	roles := make([]string, 0, len(items))
+	for _, item := range items {
+		if role, ok := item.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "ApiKey ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
@@ -3,11 +3,11 @@ package main
 import (
 	"net/http"
 
+	"backend/internal/auth"
 	appMiddleware "backend/internal/middleware"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/jwtauth"
 )
 
 func (app *application) routes() http.Handler {
@@ -17,19 +17,60 @@ func (app *application) routes() http.Handler {
 	mux.Use(appMiddleware.EnableCORS)
 
 	mux.Get("/", app.Home)
+	mux.Get("/.well-known/jwks.json", app.jwks)
 
 	mux.Post("/authenticate", app.authenticate)
 	mux.Get("/logout", app.logout)
 
+	if app.oidc != nil {
+		mux.Get("/oidc/login", app.oidcLogin)
+		mux.Get("/oidc/callback", app.oidcCallback)
+	}
+
 	mux.Route("/api", func(mux chi.Router) {
-		mux.Use(jwtauth.Verifier(app.authenticator.TokenAuth()))
-		mux.Use(jwtauth.Authenticator)
-
-		mux.Post("/urls", app.addURLs)
-		mux.Get("/urls", app.getAllURLs)
-		mux.Get("/url", app.getURL)
-		mux.Post("/start", app.startComputation)
-		mux.Post("/stop", app.stopComputation)
+		mux.Use(app.authenticateRequest)
+		if app.rateLimiter != nil {
+			mux.Use(appMiddleware.RateLimit(app.rateLimiter, rateLimitKey))
+		}
+
+		mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/urls", app.addURLs)
+		mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/urls", app.getAllURLs)
+		mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/url", app.getURL)
+		if app.snapshots != nil {
+			mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/url/snapshot", app.getURLSnapshot)
+			mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/url/reanalyze", app.reanalyzeURL)
+			mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/reanalyze", app.reanalyzeURLs)
+		}
+		mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/start", app.startComputation)
+		mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/stop", app.stopComputation)
+
+		mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/batches", app.getAllBatches)
+		mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/batch", app.getBatch)
+		mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/batch/start", app.startBatch)
+		mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/batch/stop", app.stopBatch)
+		mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/batch/retry", app.retryBatch)
+
+		mux.With(app.requireScope(auth.ScopeURLsWrite)).Post("/crawls", app.startCrawl)
+		mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/crawls", app.getAllCrawls)
+		mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/crawl", app.getCrawl)
+		mux.With(app.requireScope(auth.ScopeURLsRead)).Get("/crawl/graph", app.getCrawlGraph)
+
+		mux.Route("/keys", func(mux chi.Router) {
+			mux.Use(app.requireSession)
+
+			mux.Post("/", app.createAPIKey)
+			mux.Get("/", app.listAPIKeys)
+			mux.Post("/revoke", app.revokeAPIKey)
+		})
+
+		mux.Route("/admin", func(mux chi.Router) {
+			mux.Use(app.requireRole(auth.RoleAdmin))
+
+			mux.Get("/queue", app.queueStatus)
+			mux.Post("/queue/pause", app.pauseQueue)
+			mux.Post("/queue/resume", app.resumeQueue)
+			mux.Post("/workers", app.resizeWorkers)
+		})
 	})
 
 	return (mux)
@@ -2,7 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
+
+	"backend/internal/services"
 )
 
 type JSONResponse struct {
@@ -45,3 +52,134 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 
 	return app.writeJSON(w, statusCode, payload)
 }
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// quotaExceededJSON answers a request that would go over the daily URL quota.
+func (app *application) quotaExceededJSON(w http.ResponseWriter, quota services.QuotaResult) error {
+	headers := http.Header{}
+	headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(quota.ResetAt).Seconds()))))
+	headers.Set("X-Quota-Limit", strconv.Itoa(quota.Limit))
+	headers.Set("X-Quota-Remaining", strconv.Itoa(quota.Remaining))
+	headers.Set("X-Quota-Reset", strconv.FormatInt(quota.ResetAt.Unix(), 10))
+
+	payload := JSONResponse{
+		Error:   true,
+		Message: fmt.Sprintf("daily quota of %d URLs exceeded, %d remaining", quota.Limit, quota.Remaining),
+	}
+	return app.writeJSON(w, http.StatusTooManyRequests, payload, headers)
+}
+
+func validatePriority(priority int) error {
+	if priority < services.MinPriority || priority > services.MaxPriority {
+		return fmt.Errorf("priority must be between %d and %d", services.MinPriority, services.MaxPriority)
+	}
+	return nil
+}
+
+// withQueuePositions returns copies of urls where the pending ones carry
+// their current queue position and estimated start time.
+func (app *application) withQueuePositions(urls ...*services.URLInfo) []*services.URLInfo {
+	positions := app.taskQueue.QueuePositions()
+
+	result := make([]*services.URLInfo, 0, len(urls))
+	for _, urlInfo := range urls {
+		info := *urlInfo
+		if pos, ok := positions[info.ID]; ok && info.State == services.Pending {
+			info.QueuePosition = pos.Position
+			info.EstimatedStart = pos.EstimatedStart
+		}
+		result = append(result, &info)
+	}
+	return result
+}
+
+// urlEntry is an element of the urls of POST /api/urls: either a URL, or
+// {"url": ..., "profile": {...}} for a URL with its own fetch profile.
+type urlEntry struct {
+	URL     string                 `json:"url"`
+	Profile *services.FetchProfile `json:"profile"`
+}
+
+func (e *urlEntry) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &e.URL); err == nil {
+		return nil
+	}
+	type entry urlEntry
+	return json.Unmarshal(data, (*entry)(e))
+}
+
+// timeoutsPayload carries per-request timeouts as Go durations, e.g. "30s".
+type timeoutsPayload struct {
+	Total      string `json:"total"`
+	Fetch      string `json:"fetch"`
+	Parse      string `json:"parse"`
+	LinkChecks string `json:"link_checks"`
+}
+
+func parseTimeouts(payload timeoutsPayload) (services.Timeouts, error) {
+	var timeouts services.Timeouts
+	fields := []struct {
+		phase string
+		value string
+		dst   *time.Duration
+	}{
+		{services.PhaseTotal, payload.Total, &timeouts.Total},
+		{services.PhaseFetch, payload.Fetch, &timeouts.Fetch},
+		{services.PhaseParse, payload.Parse, &timeouts.Parse},
+		{services.PhaseLinkChecks, payload.LinkChecks, &timeouts.LinkChecks},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field.value)
+		if err != nil {
+			return timeouts, fmt.Errorf("invalid %s timeout: %q", field.phase, field.value)
+		}
+		*field.dst = d
+	}
+	return timeouts, timeouts.Validate()
+}
+
+// parseDurationSetting sets *dst from value, e.g. "30s", unless value is
+// empty.
+func parseDurationSetting(value string, dst *time.Duration) error {
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %q", value)
+	}
+	*dst = d
+	return nil
+}
+
+// readIDParam reads the integer ?id= query parameter of a request for the
+// given kind of resource, answering the request itself when it is missing or
+// invalid.
+func (app *application) readIDParam(w http.ResponseWriter, r *http.Request, kind string) (int, bool) {
+	idStr := r.URL.Query().Get("id")
+	if idStr == "" {
+		if err := app.errorJSON(w, fmt.Errorf("missing %s id parameter", kind), http.StatusBadRequest); err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		if err := app.errorJSON(w, fmt.Errorf("invalid %s id parameter", kind), http.StatusBadRequest); err != nil {
+			app.logger.WithError(err).Error("error writing JSON response")
+		}
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiKeyPrefix = "upk_"
+
+var (
+	ErrAPIKeyInvalid  = errors.New("invalid api key")
+	ErrAPIKeyRevoked  = errors.New("api key revoked")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidScope   = errors.New("invalid scope")
+)
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	User       string     `json:"user"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	hash       string
+}
+
+type APIKeyManagerInterface interface {
+	CreateKey(user, name string, scopes []string) (*APIKey, string, error)
+	ListKeys(user string) []*APIKey
+	RevokeKey(user string, id int) error
+	ValidateKey(rawKey string) (*APIKey, error)
+}
+
+// APIKeyManager keeps API keys in memory. Only the SHA-256 hash of a key is
+// stored; the raw key is returned once, at creation time.
+type APIKeyManager struct {
+	mu        sync.RWMutex
+	keys      map[int]*APIKey
+	byHash    map[string]*APIKey
+	idCounter int
+}
+
+func NewAPIKeyManager() *APIKeyManager {
+	return &APIKeyManager{
+		keys:   make(map[int]*APIKey),
+		byHash: make(map[string]*APIKey),
+	}
+}
+
+func (m *APIKeyManager) CreateKey(user, name string, scopes []string) (*APIKey, string, error) {
+	if len(scopes) == 0 {
+		scopes = AllScopes
+	}
+	for _, scope := range scopes {
+		if !IsValidScope(scope) {
+			return nil, "", ErrInvalidScope
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	rawKey := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.idCounter++
+	key := &APIKey{
+		ID:        m.idCounter,
+		User:      user,
+		Name:      name,
+		Prefix:    rawKey[:len(apiKeyPrefix)+8],
+		Scopes:    append([]string(nil), scopes...),
+		CreatedAt: time.Now(),
+		hash:      hashAPIKey(rawKey),
+	}
+	m.keys[key.ID] = key
+	m.byHash[key.hash] = key
+
+	return key.copy(), rawKey, nil
+}
+
+func (m *APIKeyManager) ListKeys(user string) []*APIKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]*APIKey, 0)
+	for id := 1; id <= m.idCounter; id++ {
+		if key, exists := m.keys[id]; exists && key.User == user {
+			keys = append(keys, key.copy())
+		}
+	}
+	return keys
+}
+
+func (m *APIKeyManager) RevokeKey(user string, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, exists := m.keys[id]
+	if !exists || key.User != user {
+		return ErrAPIKeyNotFound
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+	}
+	return nil
+}
+
+func (m *APIKeyManager) ValidateKey(rawKey string) (*APIKey, error) {
+	if !strings.HasPrefix(rawKey, apiKeyPrefix) {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, exists := m.byHash[hashAPIKey(rawKey)]
+	if !exists {
+		return nil, ErrAPIKeyInvalid
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrAPIKeyRevoked
+	}
+	now := time.Now()
+	key.LastUsedAt = &now
+	return key.copy(), nil
+}
+
+func (k *APIKey) copy() *APIKey {
+	c := *k
+	c.Scopes = append([]string(nil), k.Scopes...)
+	return &c
+}
+
+func hashAPIKey(rawKey string) string {
+	sum := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAndValidateAPIKey(t *testing.T) {
+	manager := NewAPIKeyManager()
+
+	key, rawKey, err := manager.CreateKey("admin@example.com", "ci", nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(rawKey, apiKeyPrefix))
+	assert.True(t, strings.HasPrefix(rawKey, key.Prefix))
+	assert.NotContains(t, key.hash, rawKey)
+	assert.Equal(t, AllScopes, key.Scopes)
+
+	validated, err := manager.ValidateKey(rawKey)
+	assert.NoError(t, err)
+	assert.Equal(t, key.ID, validated.ID)
+	assert.Equal(t, "admin@example.com", validated.User)
+	assert.NotNil(t, validated.LastUsedAt)
+
+	_, err = manager.ValidateKey(rawKey + "x")
+	assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+}
+
+func TestCreateAPIKeyInvalidScope(t *testing.T) {
+	manager := NewAPIKeyManager()
+
+	_, _, err := manager.CreateKey("admin@example.com", "ci", []string{"urls:delete"})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	manager := NewAPIKeyManager()
+
+	key, rawKey, err := manager.CreateKey("admin@example.com", "ci", []string{ScopeURLsRead})
+	assert.NoError(t, err)
+
+	err = manager.RevokeKey("someone@example.com", key.ID)
+	assert.ErrorIs(t, err, ErrAPIKeyNotFound)
+
+	err = manager.RevokeKey("admin@example.com", key.ID)
+	assert.NoError(t, err)
+
+	_, err = manager.ValidateKey(rawKey)
+	assert.ErrorIs(t, err, ErrAPIKeyRevoked)
+
+	keys := manager.ListKeys("admin@example.com")
+	assert.Len(t, keys, 1)
+	assert.NotNil(t, keys[0].RevokedAt)
+	assert.Empty(t, manager.ListKeys("someone@example.com"))
+}
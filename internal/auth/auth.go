@@ -1,40 +1,187 @@
 package auth
 
 import (
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/go-chi/jwtauth"
-	"github.com/golang-jwt/jwt/v4"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
 )
 
 type Authenticator interface {
 	ValidateUserCredentials(user, pass string) bool
-	GenerateToken(user string) (string, error)
-	TokenAuth() *jwtauth.JWTAuth
+	GenerateToken(user string, roles ...string) (string, error)
+	VerifyToken(tokenString string) (jwt.Token, error)
+	PublicKeys() jwk.Set
 }
 
+// JWTAuthenticator signs tokens either with a shared HS256 secret or with
+// RS256/EdDSA keys loaded from a directory. In the latter case every token
+// carries the "kid" of its signing key and all keys of the directory are
+// accepted for verification, so keys can be rotated without invalidating
+// tokens that are already out there.
 type JWTAuthenticator struct {
-	tokenAuth *jwtauth.JWTAuth
+	mu         sync.RWMutex
+	keysDir    string
+	signingKID string
+	signer     *jwtKey
+	verifiers  map[string]*jwtKey
+}
+
+var localUserRoles = map[string][]string{
+	"admin@example.com": {RoleAdmin},
 }
 
 func NewJWTAuthenticator(secret string) *JWTAuthenticator {
+	key := newSecretKey(secret)
 	return &JWTAuthenticator{
-		tokenAuth: jwtauth.New("HS256", []byte(secret), nil),
+		signer:    key,
+		verifiers: map[string]*jwtKey{"": key},
+	}
+}
+
+// NewJWTAuthenticatorFromKeys loads the PEM keys of keysDir and signs new
+// tokens with signingKID, unless the directory names another key in its
+// signing_kid file. signingKID may be empty if the directory holds a single
+// private key.
+func NewJWTAuthenticatorFromKeys(keysDir, signingKID string) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{keysDir: keysDir, signingKID: signingKID}
+	if err := a.ReloadKeys(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ReloadKeys re-reads the keys directory, including its signing_kid file.
+// Adding a new key, switching the signing key ID and removing a retired key
+// only require a reload; the current keys are kept when it fails.
+func (a *JWTAuthenticator) ReloadKeys() error {
+	if a.keysDir == "" {
+		return nil
+	}
+
+	keys, err := loadKeys(a.keysDir)
+	if err != nil {
+		return err
+	}
+	signingKID, err := readSigningKID(a.keysDir, a.signingKID)
+	if err != nil {
+		return err
+	}
+
+	var signer *jwtKey
+	if signingKID != "" {
+		signer = keys[signingKID]
+		if signer == nil || signer.signKey == nil {
+			return fmt.Errorf("%w: no private key with ID %q", ErrNoSigningKey, signingKID)
+		}
+	} else {
+		for _, key := range keys {
+			if key.signKey != nil {
+				if signer != nil {
+					return ErrNoSigningKey
+				}
+				signer = key
+			}
+		}
+	}
+	if signer == nil || signer.signKey == nil {
+		return ErrNoSigningKey
 	}
+
+	a.mu.Lock()
+	a.signer = signer
+	a.verifiers = keys
+	a.mu.Unlock()
+	return nil
 }
 
 func (a *JWTAuthenticator) ValidateUserCredentials(user, pass string) bool {
 	return user == "admin@example.com" && pass == "password"
 }
 
-func (a *JWTAuthenticator) GenerateToken(user string) (string, error) {
-	_, tokenString, err := a.tokenAuth.Encode(jwt.MapClaims{
-		"user": user,
-		"exp":  time.Now().Add(time.Hour * 72).Unix(), // 72 hours expiration
-	})
-	return tokenString, err
+// GenerateToken issues a token for user. When no roles are given the roles
+// of the local user account are used.
+func (a *JWTAuthenticator) GenerateToken(user string, roles ...string) (string, error) {
+	if len(roles) == 0 {
+		roles = localUserRoles[user]
+	}
+	return a.issueToken(user, roles)
+}
+
+// issueToken issues a token for user carrying exactly roles.
+func (a *JWTAuthenticator) issueToken(user string, roles []string) (string, error) {
+	token := jwt.New()
+	_ = token.Set("user", user)
+	_ = token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour*72).Unix()) // 72 hours expiration
+	if len(roles) > 0 {
+		_ = token.Set("roles", roles)
+	}
+
+	a.mu.RLock()
+	signer := a.signer
+	a.mu.RUnlock()
+
+	signed, err := jwt.Sign(token, signer.alg, signer.signKey)
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+// VerifyToken checks the signature with the key named by the token's "kid"
+// header, refusing tokens whose "alg" differs from the key's algorithm, and
+// validates the time based claims.
+func (a *JWTAuthenticator) VerifyToken(tokenString string) (jwt.Token, error) {
+	msg, err := jws.ParseString(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Signatures()) != 1 {
+		return nil, ErrUnknownKeyID
+	}
+	headers := msg.Signatures()[0].ProtectedHeaders()
+
+	a.mu.RLock()
+	key, exists := a.verifiers[headers.KeyID()]
+	a.mu.RUnlock()
+	if !exists {
+		return nil, ErrUnknownKeyID
+	}
+	if headers.Algorithm() != key.alg {
+		return nil, ErrAlgMismatch
+	}
+
+	token, err := jwt.ParseString(tokenString, jwt.WithVerify(key.alg, key.verifyKey))
+	if err != nil {
+		return nil, err
+	}
+	if err := jwt.Validate(token); err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
-func (a *JWTAuthenticator) TokenAuth() *jwtauth.JWTAuth {
-	return a.tokenAuth
+// PublicKeys returns the verification keys in JWKS form. It is empty when a
+// shared secret is used.
+func (a *JWTAuthenticator) PublicKeys() jwk.Set {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	kids := make([]string, 0, len(a.verifiers))
+	for kid, key := range a.verifiers {
+		if key.public != nil {
+			kids = append(kids, kid)
+		}
+	}
+	sort.Strings(kids)
+
+	set := jwk.NewSet()
+	for _, kid := range kids {
+		set.Add(a.verifiers[kid].public)
+	}
+	return set
 }
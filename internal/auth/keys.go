@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+var (
+	ErrUnknownKeyID   = errors.New("token signed with unknown key")
+	ErrAlgMismatch    = errors.New("token algorithm does not match key")
+	ErrNoSigningKey   = errors.New("no private key available for signing")
+	errUnsupportedKey = errors.New("unsupported key type, expected RSA or Ed25519")
+)
+
+type jwtKey struct {
+	id        string
+	alg       jwa.SignatureAlgorithm
+	signKey   interface{}
+	verifyKey interface{}
+	public    jwk.Key
+}
+
+func newSecretKey(secret string) *jwtKey {
+	return &jwtKey{
+		alg:       jwa.HS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+// signingKIDFile names the file of a keys directory holding the ID of the
+// key that signs new tokens.
+const signingKIDFile = "signing_kid"
+
+// readSigningKID returns the key ID of the signing_kid file of dir, or
+// fallback when there is none.
+func readSigningKID(dir, fallback string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, signingKIDFile))
+	if os.IsNotExist(err) {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if kid := strings.TrimSpace(string(data)); kid != "" {
+		return kid, nil
+	}
+	return fallback, nil
+}
+
+// loadKeys reads every *.pem file of dir. The file name without the
+// extension (and without a ".pub" suffix) is used as key ID, so "2024-06.pem"
+// and "2024-06.pub.pem" describe the same key. Public-only keys are kept for
+// verification, which lets tokens signed by a retired key stay valid until
+// they expire.
+func loadKeys(dir string) (map[string]*jwtKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keys := make(map[string]*jwtKey)
+	for _, path := range paths {
+		kid := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".pem"), ".pub")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePEMKey(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if existing, ok := keys[kid]; ok && existing.signKey != nil {
+			continue
+		}
+		keys[kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", dir)
+	}
+	return keys, nil
+}
+
+func parsePEMKey(kid string, data []byte) (*jwtKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var raw interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		raw, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		raw, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		raw, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		raw, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{id: kid}
+	var publicRaw interface{}
+	switch k := raw.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.alg = jwa.RS256
+		key.verifyKey = &k.PublicKey
+		publicRaw = &k.PublicKey
+		key.signKey, err = jwk.New(k)
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.alg = jwa.RS256
+		key.verifyKey = k
+		publicRaw = k
+	case ed25519.PrivateKey:
+		key.alg = jwa.EdDSA
+		key.verifyKey = k.Public()
+		publicRaw = k.Public()
+		key.signKey, err = jwk.New(k)
+	case ed25519.PublicKey:
+		key.alg = jwa.EdDSA
+		key.verifyKey = k
+		publicRaw = k
+	default:
+		return nil, errUnsupportedKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if signKey, ok := key.signKey.(jwk.Key); ok {
+		if err := signKey.Set(jwk.KeyIDKey, kid); err != nil {
+			return nil, err
+		}
+	}
+
+	key.public, err = jwk.New(publicRaw)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]interface{}{
+		jwk.KeyIDKey:     kid,
+		jwk.AlgorithmKey: key.alg.String(),
+		jwk.KeyUsageKey:  string(jwk.ForSignature),
+	} {
+		if err := key.public.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+func writeRSAKey(t *testing.T, dir, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, kid+".pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return key
+}
+
+func writeEd25519Key(t *testing.T, dir, kid string) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, kid+".pem"), "PRIVATE KEY", der)
+	return key
+}
+
+func TestJWTAuthenticatorEdDSA(t *testing.T) {
+	dir := t.TempDir()
+	writeEd25519Key(t, dir, "ed-1")
+
+	a, err := NewJWTAuthenticatorFromKeys(dir, "")
+	require.NoError(t, err)
+
+	tokenString, err := a.GenerateToken("admin@example.com")
+	require.NoError(t, err)
+
+	token, err := a.VerifyToken(tokenString)
+	require.NoError(t, err)
+	user, _ := token.Get("user")
+	assert.Equal(t, "admin@example.com", user)
+}
+
+func TestJWTAuthenticatorKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := writeRSAKey(t, dir, "2024-01")
+
+	a, err := NewJWTAuthenticatorFromKeys(dir, "2024-01")
+	require.NoError(t, err)
+	oldToken, err := a.GenerateToken("admin@example.com")
+	require.NoError(t, err)
+
+	// introduce a new signing key and keep only the public half of the old one
+	writeRSAKey(t, dir, "2024-06")
+	require.NoError(t, os.Remove(filepath.Join(dir, "2024-01.pem")))
+	publicDER, err := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "2024-01.pub.pem"), "PUBLIC KEY", publicDER)
+
+	// the signing key is switched without a restart
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "signing_kid"), []byte("2024-06\n"), 0o600))
+	require.NoError(t, a.ReloadKeys())
+
+	newToken, err := a.GenerateToken("admin@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06", tokenKID(t, newToken))
+
+	_, err = a.VerifyToken(oldToken)
+	assert.NoError(t, err, "tokens of the retired key stay valid")
+	_, err = a.VerifyToken(newToken)
+	assert.NoError(t, err)
+
+	set := a.PublicKeys()
+	assert.Equal(t, 2, set.Len())
+	out, err := json.Marshal(set)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"kid":"2024-01"`)
+	assert.Contains(t, string(out), `"kid":"2024-06"`)
+	assert.NotContains(t, string(out), `"d":`, "private key material must not be published")
+
+	// removing the retired key invalidates its tokens
+	require.NoError(t, os.Remove(filepath.Join(dir, "2024-01.pub.pem")))
+	require.NoError(t, a.ReloadKeys())
+	_, err = a.VerifyToken(oldToken)
+	assert.ErrorIs(t, err, ErrUnknownKeyID)
+}
+
+func tokenKID(t *testing.T, tokenString string) string {
+	t.Helper()
+	msg, err := jws.Parse([]byte(tokenString))
+	require.NoError(t, err)
+	return msg.Signatures()[0].ProtectedHeaders().KeyID()
+}
+
+func TestJWTAuthenticatorSigningKIDFile(t *testing.T) {
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "2024-01")
+	writeRSAKey(t, dir, "2024-06")
+	kidFile := filepath.Join(dir, "signing_kid")
+	require.NoError(t, os.WriteFile(kidFile, []byte("2024-06"), 0o600))
+
+	// the file takes precedence over the configured key ID
+	a, err := NewJWTAuthenticatorFromKeys(dir, "2024-01")
+	require.NoError(t, err)
+	token, err := a.GenerateToken("admin@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06", tokenKID(t, token))
+
+	// an unknown key ID fails the reload and keeps the current signer
+	require.NoError(t, os.WriteFile(kidFile, []byte("2025-01"), 0o600))
+	assert.ErrorIs(t, a.ReloadKeys(), ErrNoSigningKey)
+	token, err = a.GenerateToken("admin@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-06", tokenKID(t, token))
+
+	// without the file, the configured key ID applies again
+	require.NoError(t, os.Remove(kidFile))
+	require.NoError(t, a.ReloadKeys())
+	token, err = a.GenerateToken("admin@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01", tokenKID(t, token))
+}
+
+func TestJWTAuthenticatorRejectsAlgorithmConfusion(t *testing.T) {
+	dir := t.TempDir()
+	key := writeRSAKey(t, dir, "rsa-1")
+
+	a, err := NewJWTAuthenticatorFromKeys(dir, "")
+	require.NoError(t, err)
+
+	// HS256 token keyed with the published RSA public key
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	forged := jwt.New()
+	_ = forged.Set("user", "attacker")
+	signingKey, err := jwk.New(publicDER)
+	require.NoError(t, err)
+	require.NoError(t, signingKey.Set(jwk.KeyIDKey, "rsa-1"))
+	signed, err := jwt.Sign(forged, jwa.HS256, signingKey)
+	require.NoError(t, err)
+
+	_, err = a.VerifyToken(string(signed))
+	assert.ErrorIs(t, err, ErrAlgMismatch)
+}
+
+func TestJWTAuthenticatorRequiresSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "a")
+	writeEd25519Key(t, dir, "b")
+
+	_, err := NewJWTAuthenticatorFromKeys(dir, "")
+	assert.ErrorIs(t, err, ErrNoSigningKey)
+
+	_, err = NewJWTAuthenticatorFromKeys(dir, "b")
+	assert.NoError(t, err)
+}
+
+func TestJWTAuthenticatorSecretHasNoPublicKeys(t *testing.T) {
+	a := NewJWTAuthenticator("test-secret")
+
+	tokenString, err := a.GenerateToken("admin@example.com")
+	require.NoError(t, err)
+	token, err := a.VerifyToken(tokenString)
+	require.NoError(t, err)
+	roles, _ := token.Get("roles")
+	assert.Equal(t, []interface{}{RoleAdmin}, roles)
+
+	assert.Equal(t, 0, a.PublicKeys().Len())
+}
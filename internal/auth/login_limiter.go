@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptPolicy describes how failed logins for one key (a username or a
+// client IP) are throttled. After FreeAttempts failures every further attempt
+// has to wait BaseDelay, doubled per failure and capped at MaxDelay. After
+// LockoutAfter failures the key is locked for LockoutDuration. Failures are
+// forgotten after ResetAfter without a new failure.
+type AttemptPolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration
+}
+
+type LoginLimiterConfig struct {
+	PerUser AttemptPolicy
+	PerIP   AttemptPolicy
+	// OnLockout is called, outside of the limiter lock, every time a user or
+	// an IP gets locked out. kind is "user" or "ip".
+	OnLockout func(kind, key string, until time.Time)
+}
+
+func DefaultLoginLimiterConfig() LoginLimiterConfig {
+	return LoginLimiterConfig{
+		PerUser: AttemptPolicy{
+			FreeAttempts:    3,
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Minute,
+			LockoutAfter:    10,
+			LockoutDuration: 15 * time.Minute,
+			ResetAfter:      time.Hour,
+		},
+		PerIP: AttemptPolicy{
+			FreeAttempts:    10,
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Minute,
+			LockoutAfter:    50,
+			LockoutDuration: 30 * time.Minute,
+			ResetAfter:      time.Hour,
+		},
+	}
+}
+
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+	// inFlight counts the attempts allowed but not recorded yet
+	inFlight int
+}
+
+type LoginLimiter struct {
+	mu       sync.Mutex
+	config   LoginLimiterConfig
+	attempts map[string]*loginAttempts
+	now      func() time.Time
+}
+
+func NewLoginLimiter(config LoginLimiterConfig) *LoginLimiter {
+	return &LoginLimiter{
+		config:   config,
+		attempts: make(map[string]*loginAttempts),
+		now:      time.Now,
+	}
+}
+
+// Allow reports whether a login attempt for user from ip may be evaluated.
+// If not, it returns how long the caller has to wait. An allowed attempt is
+// counted as in flight until RecordFailure or RecordSuccess settles it; once
+// the free attempts of a key are used up, only one attempt at a time may be
+// in flight, so parallel requests cannot all pass before the first failure is
+// recorded.
+func (l *LoginLimiter) Allow(user, ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	keys := []struct {
+		key    string
+		policy AttemptPolicy
+	}{
+		{userKey(user), l.config.PerUser},
+		{ipKey(ip), l.config.PerIP},
+	}
+	var wait time.Duration
+	for _, k := range keys {
+		entry := l.entry(k.key, now, false)
+		if entry == nil {
+			continue
+		}
+		var d time.Duration
+		switch {
+		case entry.blockedUntil.After(now):
+			d = entry.blockedUntil.Sub(now)
+		case entry.inFlight > 0 && entry.failures+entry.inFlight >= k.policy.FreeAttempts:
+			d = k.policy.BaseDelay
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, k := range keys {
+		l.entry(k.key, now, true).inFlight++
+	}
+	return true, 0
+}
+
+func (l *LoginLimiter) RecordFailure(user, ip string) {
+	type lockout struct {
+		kind, key string
+		until     time.Time
+	}
+	var lockouts []lockout
+
+	l.mu.Lock()
+	now := l.now()
+	for _, k := range []struct {
+		kind, key, value string
+		policy           AttemptPolicy
+	}{
+		{"user", userKey(user), user, l.config.PerUser},
+		{"ip", ipKey(ip), ip, l.config.PerIP},
+	} {
+		entry := l.entry(k.key, now, true)
+		entry.settle()
+		entry.failures++
+		entry.lastFailure = now
+
+		switch {
+		case k.policy.LockoutAfter > 0 && entry.failures >= k.policy.LockoutAfter:
+			if !entry.locked {
+				entry.locked = true
+				entry.blockedUntil = now.Add(k.policy.LockoutDuration)
+				lockouts = append(lockouts, lockout{k.kind, k.value, entry.blockedUntil})
+			}
+		case entry.failures > k.policy.FreeAttempts:
+			delay := k.policy.BaseDelay << uint(entry.failures-k.policy.FreeAttempts-1)
+			if delay > k.policy.MaxDelay || delay <= 0 {
+				delay = k.policy.MaxDelay
+			}
+			entry.blockedUntil = now.Add(delay)
+		}
+	}
+	l.mu.Unlock()
+
+	if l.config.OnLockout != nil {
+		for _, lo := range lockouts {
+			l.config.OnLockout(lo.kind, lo.key, lo.until)
+		}
+	}
+}
+
+// RecordSuccess clears the failures of user. The IP keeps its history so a
+// single valid account cannot be used to reset an IP that is guessing
+// passwords for other accounts.
+func (l *LoginLimiter) RecordSuccess(user, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, userKey(user))
+	if entry, exists := l.attempts[ipKey(ip)]; exists {
+		entry.settle()
+	}
+}
+
+// settle ends an attempt counted as in flight by Allow.
+func (a *loginAttempts) settle() {
+	if a.inFlight > 0 {
+		a.inFlight--
+	}
+}
+
+// entry returns the attempts of key, dropping them first if the lockout is
+// over or the failures are old enough to be forgotten.
+func (l *LoginLimiter) entry(key string, now time.Time, create bool) *loginAttempts {
+	entry, exists := l.attempts[key]
+	if exists {
+		policy := l.config.PerUser
+		if strings.HasPrefix(key, "ip:") {
+			policy = l.config.PerIP
+		}
+		expired := entry.locked && !entry.blockedUntil.After(now)
+		stale := !entry.locked && entry.inFlight == 0 && policy.ResetAfter > 0 && now.Sub(entry.lastFailure) > policy.ResetAfter
+		if expired || stale {
+			delete(l.attempts, key)
+			exists = false
+		}
+	}
+	if !exists {
+		if !create {
+			return nil
+		}
+		entry = &loginAttempts{}
+		l.attempts[key] = entry
+		l.prune(now)
+	}
+	return entry
+}
+
+// prune drops forgotten entries once the map grows large, so an attacker
+// rotating usernames or IPs cannot grow it without bound.
+func (l *LoginLimiter) prune(now time.Time) {
+	if len(l.attempts) < 10000 {
+		return
+	}
+	for key, entry := range l.attempts {
+		if entry.inFlight == 0 && !entry.blockedUntil.After(now) && now.Sub(entry.lastFailure) > time.Minute {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+func userKey(user string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(user))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLoginLimiter(now *time.Time, lockouts *[]string) *LoginLimiter {
+	config := DefaultLoginLimiterConfig()
+	config.OnLockout = func(kind, key string, until time.Time) {
+		*lockouts = append(*lockouts, kind+":"+key)
+	}
+	limiter := NewLoginLimiter(config)
+	limiter.now = func() time.Time { return *now }
+	return limiter
+}
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	now := time.Now()
+	var lockouts []string
+	limiter := newTestLoginLimiter(&now, &lockouts)
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.Allow("admin@example.com", "10.0.0.1")
+		assert.True(t, allowed)
+		limiter.RecordFailure("admin@example.com", "10.0.0.1")
+	}
+
+	// the free attempts are used up: 1s, then 2s, then 4s
+	allowed, _ := limiter.Allow("admin@example.com", "10.0.0.1")
+	assert.True(t, allowed)
+	limiter.RecordFailure("admin@example.com", "10.0.0.1")
+	allowed, wait := limiter.Allow("admin@example.com", "10.0.0.1")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	now = now.Add(time.Second)
+	limiter.RecordFailure("ADMIN@example.com", "10.0.0.2")
+	_, wait = limiter.Allow("admin@example.com", "10.0.0.3")
+	assert.Equal(t, 2*time.Second, wait, "backoff is per username across IPs")
+
+	allowed, _ = limiter.Allow("someone@example.com", "10.0.0.1")
+	assert.True(t, allowed, "other users are not affected")
+	assert.Empty(t, lockouts)
+}
+
+func TestLoginLimiterLockout(t *testing.T) {
+	now := time.Now()
+	var lockouts []string
+	limiter := newTestLoginLimiter(&now, &lockouts)
+
+	for i := 0; i < 10; i++ {
+		limiter.RecordFailure("admin@example.com", "10.0.0.1")
+	}
+	assert.Equal(t, []string{"user:admin@example.com"}, lockouts)
+
+	allowed, wait := limiter.Allow("admin@example.com", "10.0.0.9")
+	assert.False(t, allowed)
+	assert.Equal(t, 15*time.Minute, wait)
+
+	now = now.Add(15 * time.Minute)
+	allowed, _ = limiter.Allow("admin@example.com", "10.0.0.9")
+	assert.True(t, allowed, "lockout expires")
+}
+
+func TestLoginLimiterPerIP(t *testing.T) {
+	now := time.Now()
+	var lockouts []string
+	limiter := newTestLoginLimiter(&now, &lockouts)
+
+	// one failure per username, all from the same IP
+	for i := 0; i < 50; i++ {
+		limiter.RecordFailure("user"+string(rune('a'+i%26))+string(rune('a'+i/26)), "10.0.0.1")
+	}
+	assert.Equal(t, []string{"ip:10.0.0.1"}, lockouts)
+
+	allowed, _ := limiter.Allow("new-user@example.com", "10.0.0.1")
+	assert.False(t, allowed)
+
+	limiter.RecordSuccess("new-user@example.com", "10.0.0.1")
+	allowed, _ = limiter.Allow("new-user@example.com", "10.0.0.1")
+	assert.False(t, allowed, "a successful login does not reset the IP")
+}
+
+func TestLoginLimiterConcurrentAttempts(t *testing.T) {
+	now := time.Now()
+	var lockouts []string
+	limiter := newTestLoginLimiter(&now, &lockouts)
+
+	// a burst of parallel attempts only gets the free attempts through
+	// before their failures are recorded
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if ok, _ := limiter.Allow("admin@example.com", "10.0.0.1"); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.EqualValues(t, 3, allowed.Load())
+
+	for i := 0; i < 3; i++ {
+		limiter.RecordFailure("admin@example.com", "10.0.0.1")
+	}
+
+	// past the free attempts, one attempt at a time is evaluated
+	ok, _ := limiter.Allow("admin@example.com", "10.0.0.2")
+	assert.True(t, ok)
+	ok, wait := limiter.Allow("admin@example.com", "10.0.0.3")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+	limiter.RecordFailure("admin@example.com", "10.0.0.2")
+	_, wait = limiter.Allow("admin@example.com", "10.0.0.3")
+	assert.Equal(t, time.Second, wait, "the recorded failure starts the backoff")
+}
@@ -0,0 +1,383 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+const (
+	oidcLoginTTL          = 10 * time.Minute
+	oidcJWKSRefreshPeriod = time.Minute
+)
+
+var (
+	ErrOIDCInvalidState = errors.New("invalid or expired login state")
+	ErrOIDCInvalidToken = errors.New("invalid id token")
+	ErrOIDCMissingUser  = errors.New("id token has no user claim")
+)
+
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// UserClaim is the ID token claim used as the local user name.
+	UserClaim string
+	// RolesClaim is the ID token claim holding the IdP groups or roles.
+	RolesClaim string
+	// RoleMap maps IdP roles to local roles; unmapped IdP roles are dropped.
+	RoleMap    map[string]string
+	HTTPClient *http.Client
+}
+
+type Identity struct {
+	User  string
+	Roles []string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPendingLogin struct {
+	verifier  string
+	nonce     string
+	expiresAt time.Time
+}
+
+// OIDCAuthenticator signs users in through an OpenID Connect provider using
+// the authorization code flow with PKCE. Once the IdP identity is mapped to
+// a local user it issues the same local JWTs as JWTAuthenticator, so the rest
+// of the API is unaware of how the user logged in.
+type OIDCAuthenticator struct {
+	config    OIDCConfig
+	local     *JWTAuthenticator
+	client    *http.Client
+	discovery oidcDiscovery
+
+	mu          sync.Mutex
+	pending     map[string]oidcPendingLogin
+	keySet      jwk.Set
+	keysFetched time.Time
+}
+
+func NewOIDCAuthenticator(ctx context.Context, config OIDCConfig, local *JWTAuthenticator) (*OIDCAuthenticator, error) {
+	if config.IssuerURL == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("oidc issuer, client id and redirect url are required")
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if config.UserClaim == "" {
+		config.UserClaim = "email"
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "groups"
+	}
+
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	a := &OIDCAuthenticator{
+		config:  config,
+		local:   local,
+		client:  client,
+		pending: make(map[string]oidcPendingLogin),
+	}
+
+	if err := a.discover(ctx); err != nil {
+		return nil, err
+	}
+	if err := a.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// ValidateUserCredentials always fails: local passwords are disabled when
+// users sign in through the identity provider.
+func (a *OIDCAuthenticator) ValidateUserCredentials(user, pass string) bool {
+	return false
+}
+
+func (a *OIDCAuthenticator) GenerateToken(user string, roles ...string) (string, error) {
+	return a.local.GenerateToken(user, roles...)
+}
+
+// IssueToken issues a local token for identity carrying only the roles
+// mapped from the IdP, never those of a local user account with the same
+// name.
+func (a *OIDCAuthenticator) IssueToken(identity *Identity) (string, error) {
+	return a.local.issueToken(identity.User, identity.Roles)
+}
+
+func (a *OIDCAuthenticator) VerifyToken(tokenString string) (jwt.Token, error) {
+	return a.local.VerifyToken(tokenString)
+}
+
+func (a *OIDCAuthenticator) PublicKeys() jwk.Set {
+	return a.local.PublicKeys()
+}
+
+// StartLogin returns the IdP authorization URL together with the state the
+// callback has to present to FinishLogin.
+func (a *OIDCAuthenticator) StartLogin() (string, string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	a.mu.Lock()
+	now := time.Now()
+	for s, login := range a.pending {
+		if now.After(login.expiresAt) {
+			delete(a.pending, s)
+		}
+	}
+	a.pending[state] = oidcPendingLogin{verifier: verifier, nonce: nonce, expiresAt: now.Add(oidcLoginTTL)}
+	a.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.config.ClientID},
+		"redirect_uri":          {a.config.RedirectURL},
+		"scope":                 {strings.Join(a.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	authURL := a.discovery.AuthorizationEndpoint
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + params.Encode()
+	} else {
+		authURL += "?" + params.Encode()
+	}
+	return authURL, state, nil
+}
+
+// FinishLogin exchanges the authorization code, validates the returned ID
+// token and maps its claims to a local identity.
+func (a *OIDCAuthenticator) FinishLogin(ctx context.Context, state, code string) (*Identity, error) {
+	a.mu.Lock()
+	login, exists := a.pending[state]
+	delete(a.pending, state)
+	a.mu.Unlock()
+
+	if !exists || time.Now().After(login.expiresAt) {
+		return nil, ErrOIDCInvalidState
+	}
+
+	rawIDToken, err := a.exchange(ctx, code, login.verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := a.verifyIDToken(ctx, rawIDToken, login.nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.mapIdentity(token)
+}
+
+func (a *OIDCAuthenticator) discover(ctx context.Context) error {
+	wellKnown := strings.TrimSuffix(a.config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc discovery: unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&a.discovery); err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+	if a.discovery.Issuer != a.config.IssuerURL {
+		return fmt.Errorf("oidc discovery: issuer mismatch, got %q", a.discovery.Issuer)
+	}
+	if a.discovery.AuthorizationEndpoint == "" || a.discovery.TokenEndpoint == "" || a.discovery.JWKSURI == "" {
+		return errors.New("oidc discovery: incomplete provider metadata")
+	}
+	return nil
+}
+
+func (a *OIDCAuthenticator) refreshKeys(ctx context.Context) error {
+	set, err := jwk.Fetch(ctx, a.discovery.JWKSURI, jwk.WithHTTPClient(a.client))
+	if err != nil {
+		return fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	a.mu.Lock()
+	a.keySet = set
+	a.keysFetched = time.Now()
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *OIDCAuthenticator) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.config.RedirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {a.config.ClientID},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.config.ClientID), url.QueryEscape(a.config.ClientSecret))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var payload struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token exchange: %s %s", payload.Error, payload.ErrorDescription)
+	}
+	if payload.IDToken == "" {
+		return "", errors.New("oidc token exchange: no id_token in response")
+	}
+	return payload.IDToken, nil
+}
+
+func (a *OIDCAuthenticator) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (jwt.Token, error) {
+	a.mu.Lock()
+	set := a.keySet
+	canRefresh := time.Since(a.keysFetched) > oidcJWKSRefreshPeriod
+	a.mu.Unlock()
+
+	token, err := jwt.ParseString(rawIDToken, jwt.WithKeySet(set))
+	if err != nil && canRefresh {
+		// The IdP may have rotated its signing keys since the last fetch.
+		if refreshErr := a.refreshKeys(ctx); refreshErr == nil {
+			a.mu.Lock()
+			set = a.keySet
+			a.mu.Unlock()
+			token, err = jwt.ParseString(rawIDToken, jwt.WithKeySet(set))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCInvalidToken, err)
+	}
+
+	if token.Issuer() != a.config.IssuerURL {
+		return nil, fmt.Errorf("%w: issuer mismatch", ErrOIDCInvalidToken)
+	}
+	if token.Expiration().IsZero() {
+		return nil, fmt.Errorf("%w: missing exp", ErrOIDCInvalidToken)
+	}
+	if err := jwt.Validate(token, jwt.WithAudience(a.config.ClientID), jwt.WithAcceptableSkew(30*time.Second)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCInvalidToken, err)
+	}
+	if tokenNonce, _ := token.Get("nonce"); tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOIDCInvalidToken)
+	}
+
+	return token, nil
+}
+
+func (a *OIDCAuthenticator) mapIdentity(token jwt.Token) (*Identity, error) {
+	if verified, ok := token.Get("email_verified"); ok && a.config.UserClaim == "email" && verified == false {
+		return nil, fmt.Errorf("%w: email not verified", ErrOIDCInvalidToken)
+	}
+
+	user, _ := token.Get(a.config.UserClaim)
+	userStr, _ := user.(string)
+	if userStr == "" {
+		return nil, ErrOIDCMissingUser
+	}
+
+	identity := &Identity{User: userStr}
+	seen := make(map[string]bool)
+	for _, idpRole := range stringsClaim(token, a.config.RolesClaim) {
+		if role, ok := a.config.RoleMap[idpRole]; ok && !seen[role] {
+			seen[role] = true
+			identity.Roles = append(identity.Roles, role)
+		}
+	}
+	return identity, nil
+}
+
+func stringsClaim(token jwt.Token, name string) []string {
+	value, ok := token.Get(name)
+	if !ok {
+		return nil
+	}
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
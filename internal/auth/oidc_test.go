@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockIdP struct {
+	server    *httptest.Server
+	key       jwk.Key
+	claims    map[string]interface{}
+	challenge string
+	nonce     string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwk.New(rsaKey)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(jwk.KeyIDKey, "idp-key-1"))
+
+	idp := &mockIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		publicKey, _ := jwk.PublicKeyOf(idp.key)
+		set := jwk.NewSet()
+		set.Add(publicKey)
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "valid-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		token := jwt.New()
+		for k, v := range idp.claims {
+			_ = token.Set(k, v)
+		}
+		_ = token.Set("nonce", idp.nonce)
+		signed, err := jwt.Sign(token, jwa.RS256, idp.key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": string(signed), "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	idp.claims = map[string]interface{}{
+		"iss":    idp.server.URL,
+		"aud":    "urls-processor",
+		"sub":    "user-123",
+		"email":  "jane@example.com",
+		"groups": []string{"platform-admins", "everyone"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+	return idp
+}
+
+// authorize plays the part of the browser visiting the authorization URL.
+func (idp *mockIdP) authorize(t *testing.T, authURL string) {
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+	idp.challenge = u.Query().Get("code_challenge")
+	idp.nonce = u.Query().Get("nonce")
+}
+
+func newTestOIDCAuthenticator(t *testing.T, idp *mockIdP) *OIDCAuthenticator {
+	a, err := NewOIDCAuthenticator(context.Background(), OIDCConfig{
+		IssuerURL:   idp.server.URL,
+		ClientID:    "urls-processor",
+		RedirectURL: "http://localhost:8080/oidc/callback",
+		RoleMap:     map[string]string{"platform-admins": RoleAdmin},
+	}, NewJWTAuthenticator("test-secret"))
+	require.NoError(t, err)
+	return a
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	a := newTestOIDCAuthenticator(t, idp)
+
+	authURL, state, err := a.StartLogin()
+	require.NoError(t, err)
+	idp.authorize(t, authURL)
+
+	identity, err := a.FinishLogin(context.Background(), state, "valid-code")
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", identity.User)
+	assert.Equal(t, []string{RoleAdmin}, identity.Roles)
+
+	// a state can only be used once
+	_, err = a.FinishLogin(context.Background(), state, "valid-code")
+	assert.ErrorIs(t, err, ErrOIDCInvalidState)
+}
+
+func TestOIDCLoginRejectsInvalidTokens(t *testing.T) {
+	idp := newMockIdP(t)
+	a := newTestOIDCAuthenticator(t, idp)
+
+	tests := []struct {
+		name  string
+		claim string
+		value interface{}
+	}{
+		{"wrong audience", "aud", "another-client"},
+		{"wrong issuer", "iss", "https://evil.example.com"},
+		{"expired", "exp", time.Now().Add(-time.Hour).Unix()},
+		{"unverified email", "email_verified", false},
+	}
+
+	for _, tt := range tests {
+		original := idp.claims[tt.claim]
+		idp.claims[tt.claim] = tt.value
+
+		authURL, state, err := a.StartLogin()
+		require.NoError(t, err)
+		idp.authorize(t, authURL)
+
+		_, err = a.FinishLogin(context.Background(), state, "valid-code")
+		assert.ErrorIs(t, err, ErrOIDCInvalidToken, tt.name)
+
+		if original == nil {
+			delete(idp.claims, tt.claim)
+		} else {
+			idp.claims[tt.claim] = original
+		}
+	}
+}
+
+func TestOIDCLoginWrongVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	a := newTestOIDCAuthenticator(t, idp)
+
+	authURL, state, err := a.StartLogin()
+	require.NoError(t, err)
+	idp.authorize(t, authURL)
+	idp.challenge = "tampered"
+
+	_, err = a.FinishLogin(context.Background(), state, "valid-code")
+	assert.Error(t, err)
+}
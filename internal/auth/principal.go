@@ -0,0 +1,63 @@
+package auth
+
+import "context"
+
+const (
+	ScopeURLsRead  = "urls:read"
+	ScopeURLsWrite = "urls:write"
+)
+
+const RoleAdmin = "admin"
+
+var AllScopes = []string{ScopeURLsRead, ScopeURLsWrite}
+
+// Principal is the authenticated caller of an /api request, either a user
+// session (JWT) or an API key acting on behalf of a user.
+type Principal struct {
+	User     string
+	APIKeyID int
+	Scopes   []string
+	Roles    []string
+}
+
+func (p *Principal) IsAPIKey() bool {
+	return p.APIKeyID != 0
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalCtxKey struct{}
+
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalCtxKey{}).(*Principal)
+	return p
+}
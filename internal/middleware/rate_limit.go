@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token bucket limiter keyed by caller. Every key starts
+// with burst tokens and regains rate tokens per second.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (rl *RateLimiter) Take(key string) RateLimitResult {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(rl.burst), last: now}
+		rl.buckets[key] = b
+		rl.prune(now)
+	}
+
+	b.tokens = math.Min(float64(rl.burst), b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	result := RateLimitResult{Limit: rl.burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = rl.durationFor(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = rl.durationFor(float64(rl.burst) - b.tokens)
+	return result
+}
+
+func (rl *RateLimiter) durationFor(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.rate * float64(time.Second))
+}
+
+// prune drops buckets that have been idle long enough to be full again.
+func (rl *RateLimiter) prune(now time.Time) {
+	if len(rl.buckets) < 10000 {
+		return
+	}
+	full := rl.durationFor(float64(rl.burst))
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > full {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// RateLimit rejects requests with 429 once the caller identified by keyFn
+// has used up its bucket. Every response carries X-RateLimit-* headers.
+func RateLimit(rl *RateLimiter, keyFn func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result := rl.Take(keyFn(r))
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"error":   true,
+					"message": "rate limit exceeded",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	now := time.Now()
+	rl := NewRateLimiter(1, 2)
+	rl.now = func() time.Time { return now }
+
+	assert.True(t, rl.Take("user:a").Allowed)
+	assert.True(t, rl.Take("user:a").Allowed)
+
+	result := rl.Take("user:a")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, time.Second, result.RetryAfter)
+
+	assert.True(t, rl.Take("user:b").Allowed, "buckets are per key")
+
+	now = now.Add(time.Second)
+	assert.True(t, rl.Take("user:a").Allowed, "tokens are refilled over time")
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	rl := NewRateLimiter(0.5, 1)
+	handler := RateLimit(rl, func(r *http.Request) string { return "user:a" })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/urls", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/urls", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error":true,"message":"rate limit exceeded"}`, rr.Body.String())
+}
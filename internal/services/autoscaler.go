@@ -0,0 +1,129 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxWorkerCount bounds the size of the worker pool.
+const MaxWorkerCount = 100
+
+// AutoscaleConfig lets the task queue size its worker pool between
+// MinWorkers and MaxWorkers. Every Interval the pool grows by one worker when
+// more than QueuePerWorker tasks per worker are waiting or tasks wait longer
+// than TargetWait for a worker, and shrinks by one when nothing is waiting
+// and some workers are idle.
+type AutoscaleConfig struct {
+	MinWorkers     int           `json:"min_workers"`
+	MaxWorkers     int           `json:"max_workers"`
+	QueuePerWorker int           `json:"queue_per_worker"`
+	TargetWait     time.Duration `json:"-"`
+	Interval       time.Duration `json:"-"`
+}
+
+func DefaultAutoscaleConfig() AutoscaleConfig {
+	return AutoscaleConfig{
+		QueuePerWorker: 2,
+		TargetWait:     30 * time.Second,
+		Interval:       5 * time.Second,
+	}
+}
+
+func (c AutoscaleConfig) Validate() error {
+	if c.MinWorkers < 1 || c.MaxWorkers > MaxWorkerCount || c.MinWorkers > c.MaxWorkers {
+		return fmt.Errorf("autoscaling needs 1 <= min workers <= max workers <= %d", MaxWorkerCount)
+	}
+	if c.QueuePerWorker < 1 || c.Interval <= 0 {
+		return fmt.Errorf("autoscaling needs a positive queue per worker and interval")
+	}
+	return nil
+}
+
+// desiredWorkers returns the pool size for the next interval.
+func (c AutoscaleConfig) desiredWorkers(current, queueDepth, busy int, avgWait time.Duration) int {
+	desired := current
+	switch {
+	case queueDepth > current*c.QueuePerWorker,
+		queueDepth > 0 && c.TargetWait > 0 && avgWait > c.TargetWait:
+		desired++
+	case queueDepth == 0 && busy < current:
+		desired--
+	}
+
+	return c.clamp(desired)
+}
+
+func (c AutoscaleConfig) clamp(workers int) int {
+	if workers < c.MinWorkers {
+		return c.MinWorkers
+	}
+	if workers > c.MaxWorkers {
+		return c.MaxWorkers
+	}
+	return workers
+}
+
+// WithAutoscaling starts the task queue with an autoscaled worker pool.
+func WithAutoscaling(config AutoscaleConfig) TaskQueueOption {
+	return func(tq *TaskQueue) {
+		tq.autoscale = &config
+		tq.workerCount = config.clamp(tq.workerCount)
+	}
+}
+
+// SetAutoscaling turns autoscaling on, or changes its configuration.
+func (tq *TaskQueue) SetAutoscaling(config AutoscaleConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.autoscale = &config
+	tq.resize(config.clamp(tq.workerCount))
+	tq.startAutoscaler()
+	return nil
+}
+
+// startAutoscaler starts the loop adjusting the pool, unless it runs already.
+// The loop ends when autoscaling is turned off.
+func (tq *TaskQueue) startAutoscaler() {
+	if tq.scalerActive {
+		return
+	}
+	tq.scalerActive = true
+
+	go func() {
+		for {
+			tq.mu.Lock()
+			if tq.autoscale == nil {
+				tq.scalerActive = false
+				tq.mu.Unlock()
+				return
+			}
+			interval := tq.autoscale.Interval
+			tq.mu.Unlock()
+
+			time.Sleep(interval)
+			tq.autoscaleStep()
+		}
+	}()
+}
+
+func (tq *TaskQueue) autoscaleStep() {
+	status := tq.Status()
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	if tq.autoscale == nil || tq.paused {
+		return
+	}
+	// The wait average only moves when a task is dequeued, so forget it once
+	// the queue drains; otherwise one slow burst keeps scaling up later ones.
+	if status.QueueDepth == 0 {
+		tq.avgWait = 0
+	}
+	tq.resize(tq.autoscale.desiredWorkers(tq.workerCount, status.QueueDepth, status.ActiveWorkers, tq.avgWait))
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDesiredWorkers(t *testing.T) {
+	config := AutoscaleConfig{MinWorkers: 2, MaxWorkers: 5, QueuePerWorker: 2, TargetWait: 10 * time.Second}
+
+	tests := []struct {
+		name                 string
+		current, depth, busy int
+		wait                 time.Duration
+		want                 int
+	}{
+		{"deep queue", 3, 7, 3, time.Second, 4},
+		{"slow start", 3, 1, 3, time.Minute, 4},
+		{"at max", 5, 50, 5, time.Minute, 5},
+		{"steady", 3, 2, 3, time.Second, 3},
+		{"idle workers", 3, 0, 1, 0, 2},
+		{"at min", 2, 0, 0, 0, 2},
+		{"below min", 1, 0, 0, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, config.desiredWorkers(tt.current, tt.depth, tt.busy, tt.wait))
+		})
+	}
+}
+
+func TestAutoscaleConfigValidate(t *testing.T) {
+	valid := AutoscaleConfig{MinWorkers: 1, MaxWorkers: 10, QueuePerWorker: 2, Interval: time.Second}
+	assert.NoError(t, valid.Validate())
+
+	invalid := valid
+	invalid.MinWorkers = 11
+	assert.Error(t, invalid.Validate())
+
+	invalid = valid
+	invalid.MaxWorkers = MaxWorkerCount + 1
+	assert.Error(t, invalid.Validate())
+
+	invalid = valid
+	invalid.Interval = 0
+	assert.Error(t, invalid.Validate())
+}
+
+func TestAutoscaleStepResetsWaitWhenDrained(t *testing.T) {
+	config := AutoscaleConfig{MinWorkers: 1, MaxWorkers: 5, QueuePerWorker: 2, TargetWait: time.Second, Interval: time.Hour}
+	tq := NewTaskQueue(1, &MockURLManager{}, &MockPageAnalyzer{}, logrus.New(), WithAutoscaling(config))
+
+	tq.mu.Lock()
+	tq.avgWait = time.Minute
+	tq.mu.Unlock()
+
+	tq.autoscaleStep()
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	assert.Zero(t, tq.avgWait)
+	assert.Equal(t, 1, tq.workerCount)
+}
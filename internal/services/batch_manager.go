@@ -0,0 +1,160 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// Batch groups the URLs submitted together. CompletedAt is set once every URL
+// of the batch reached a terminal state, and cleared if one is restarted.
+type Batch struct {
+	ID          int        `json:"id"`
+	Owner       string     `json:"owner,omitempty"`
+	URLIDs      []int      `json:"url_ids"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// BatchProgress counts the URLs of a batch by state. Finished counts the URLs
+// in a terminal state.
+type BatchProgress struct {
+	Total    int              `json:"total"`
+	Finished int              `json:"finished"`
+	Counts   map[URLState]int `json:"counts"`
+}
+
+type BatchInfo struct {
+	Batch
+	Progress BatchProgress `json:"progress"`
+}
+
+type BatchManagerInterface interface {
+	CreateBatch(owner string, urlIDs []int) *BatchInfo
+	GetBatch(id int) *BatchInfo
+	GetAllBatches() []*BatchInfo
+}
+
+type BatchManager struct {
+	mu         sync.Mutex
+	batches    map[int]*Batch
+	urlBatch   map[int]int
+	idCounter  int
+	urlManager URLManagerInterface
+	onComplete []func(batch BatchInfo)
+}
+
+// NewBatchManager tracks batches of URLs managed by urlManager. Call
+// HandleStateChange on every URL state change, see URLManager.OnStateChange.
+func NewBatchManager(urlManager URLManagerInterface) *BatchManager {
+	return &BatchManager{
+		batches:    make(map[int]*Batch),
+		urlBatch:   make(map[int]int),
+		urlManager: urlManager,
+	}
+}
+
+// OnComplete registers fn to be called when every URL of a batch reached a
+// terminal state.
+func (bm *BatchManager) OnComplete(fn func(batch BatchInfo)) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.onComplete = append(bm.onComplete, fn)
+}
+
+func (bm *BatchManager) CreateBatch(owner string, urlIDs []int) *BatchInfo {
+	bm.mu.Lock()
+	bm.idCounter++
+	batch := &Batch{
+		ID:        bm.idCounter,
+		Owner:     owner,
+		URLIDs:    append([]int(nil), urlIDs...),
+		CreatedAt: time.Now(),
+	}
+	bm.batches[batch.ID] = batch
+	for _, id := range urlIDs {
+		bm.urlBatch[id] = batch.ID
+	}
+	bm.mu.Unlock()
+
+	// URLs may have finished before the batch existed
+	bm.checkCompletion(batch.ID)
+	return bm.GetBatch(batch.ID)
+}
+
+func (bm *BatchManager) GetBatch(id int) *BatchInfo {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	batch, exists := bm.batches[id]
+	if !exists {
+		return nil
+	}
+	return bm.info(batch)
+}
+
+func (bm *BatchManager) GetAllBatches() []*BatchInfo {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	batches := make([]*BatchInfo, 0, len(bm.batches))
+	for _, batch := range bm.batches {
+		batches = append(batches, bm.info(batch))
+	}
+	return batches
+}
+
+// HandleStateChange updates the completion of the batch the URL belongs to.
+func (bm *BatchManager) HandleStateChange(urlID int, state URLState) {
+	bm.mu.Lock()
+	batchID, exists := bm.urlBatch[urlID]
+	bm.mu.Unlock()
+
+	if exists {
+		bm.checkCompletion(batchID)
+	}
+}
+
+func (bm *BatchManager) checkCompletion(id int) {
+	bm.mu.Lock()
+	batch := bm.batches[id]
+	info := bm.info(batch)
+
+	if info.Progress.Finished < info.Progress.Total {
+		batch.CompletedAt = nil
+		bm.mu.Unlock()
+		return
+	}
+	if batch.CompletedAt != nil {
+		bm.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	batch.CompletedAt = &now
+	info.CompletedAt = &now
+	listeners := bm.onComplete
+	bm.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(*info)
+	}
+}
+
+// info copies batch and computes its progress. bm.mu must be held.
+func (bm *BatchManager) info(batch *Batch) *BatchInfo {
+	info := &BatchInfo{
+		Batch: *batch,
+		Progress: BatchProgress{
+			Total:  len(batch.URLIDs),
+			Counts: make(map[URLState]int),
+		},
+	}
+	for _, id := range batch.URLIDs {
+		state := bm.urlManager.GetURLState(id)
+		info.Progress.Counts[state]++
+		if state.Terminal() {
+			info.Progress.Finished++
+		}
+	}
+	return info
+}
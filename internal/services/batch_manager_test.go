@@ -0,0 +1,80 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestBatchProgressAndCompletion(t *testing.T) {
+	manager := NewURLManager()
+	batches := NewBatchManager(manager)
+	manager.OnStateChange(batches.HandleStateChange)
+
+	var completed []BatchInfo
+	batches.OnComplete(func(batch BatchInfo) {
+		completed = append(completed, batch)
+	})
+
+	first := manager.AddURL("http://example.com/1", URLOptions{Owner: "alice"})
+	second := manager.AddURL("http://example.com/2", URLOptions{Owner: "alice"})
+	batch := batches.CreateBatch("alice", []int{first.ID, second.ID})
+
+	if batch.Progress.Total != 2 || batch.Progress.Counts[Pending] != 2 || batch.Progress.Finished != 0 {
+		t.Fatalf("unexpected progress for a new batch: %+v", batch.Progress)
+	}
+
+	manager.UpdateProcessedData(first.ID, &DataInfo{})
+	manager.UpdateURLState(first.ID, Completed)
+	if len(completed) != 0 {
+		t.Fatal("batch completed before all of its URLs finished")
+	}
+
+	manager.MarkFailed(second.ID, &FailureInfo{Reason: ReasonHTTPStatus})
+	if len(completed) != 1 {
+		t.Fatalf("expected one completion event, got %d", len(completed))
+	}
+	if got := completed[0].Progress; got.Finished != 2 || got.Counts[Completed] != 1 || got.Counts[Failed] != 1 {
+		t.Errorf("unexpected progress in completion event: %+v", got)
+	}
+
+	// further terminal updates do not complete the batch again
+	manager.UpdateURLState(second.ID, Stopped)
+	if len(completed) != 1 {
+		t.Errorf("expected the completion event to fire once, got %d", len(completed))
+	}
+
+	// restarting a URL reopens the batch
+	manager.UpdateURLState(second.ID, Pending)
+	if info := batches.GetBatch(batch.ID); info.CompletedAt != nil {
+		t.Error("expected CompletedAt to be cleared when a URL is restarted")
+	}
+
+	manager.UpdateURLState(second.ID, Completed)
+	if len(completed) != 2 {
+		t.Errorf("expected the reopened batch to complete again, got %d events", len(completed))
+	}
+}
+
+func TestBatchOfFinishedURLs(t *testing.T) {
+	manager := NewURLManager()
+	batches := NewBatchManager(manager)
+
+	urlInfo := manager.AddURL("http://example.com", URLOptions{})
+	manager.UpdateURLState(urlInfo.ID, Stopped)
+
+	completed := 0
+	batches.OnComplete(func(batch BatchInfo) {
+		completed++
+	})
+
+	batch := batches.CreateBatch("", []int{urlInfo.ID})
+	if batch.CompletedAt == nil || completed != 1 {
+		t.Errorf("expected a batch of finished URLs to complete on creation, got %+v", batch)
+	}
+
+	if batches.GetBatch(batch.ID+1) != nil {
+		t.Error("expected unknown batch to be nil")
+	}
+	if got := len(batches.GetAllBatches()); got != 1 {
+		t.Errorf("expected 1 batch, got %d", got)
+	}
+}
@@ -0,0 +1,319 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// maxContentText is how much of the readable text is kept in
+	// ContentInfo; the other figures cover the whole text.
+	maxContentText = 64 << 10
+	// wordsPerMinute is the reading speed reading times are based on.
+	wordsPerMinute = 200
+	// minDetectionWords is how many words language detection needs.
+	minDetectionWords = 10
+)
+
+// ContentInfo describes the readable text of a page: the text of its main
+// content, or of its body without navigation, scripts and the like. Hash is
+// the SHA-256 of the text, the same for pages whose markup changed but whose
+// text did not. Language is the declared language of the page, or the one
+// detected from its text when none is declared; languages are ISO 639-1
+// codes.
+type ContentInfo struct {
+	Text               string `json:"text"`
+	TextTruncated      bool   `json:"text_truncated"`
+	WordCount          int    `json:"word_count"`
+	ReadingTimeMinutes int    `json:"reading_time_minutes"`
+	Language           string `json:"language"`
+	DeclaredLanguage   string `json:"declared_language"`
+	DetectedLanguage   string `json:"detected_language"`
+	Hash               string `json:"hash"`
+}
+
+// boilerplate are the elements whose text is not part of the readable text.
+var boilerplate = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true,
+	"nav": true, "header": true, "footer": true, "aside": true, "form": true,
+	"button": true, "select": true, "svg": true, "iframe": true, "object": true,
+}
+
+// blockElements end the paragraph of text before them.
+var blockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "main": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+	"table": true, "tr": true, "td": true, "th": true, "blockquote": true,
+	"pre": true, "br": true, "hr": true, "figure": true, "figcaption": true,
+}
+
+// extractContent extracts the readable text of doc and describes it.
+func extractContent(doc *html.Node) *ContentInfo {
+	info := &ContentInfo{}
+	root := doc
+	if main := findMainContent(doc); main != nil {
+		root = main
+	}
+	if htmlNode := findElement(doc, func(n *html.Node) bool { return n.Data == "html" }); htmlNode != nil {
+		info.DeclaredLanguage = normalizeLanguage(attrValue(htmlNode, "lang"))
+	}
+
+	text := readableText(root)
+	info.Hash = contentHash(text)
+	info.WordCount = countWords(text)
+	info.ReadingTimeMinutes = (info.WordCount + wordsPerMinute - 1) / wordsPerMinute
+	info.DetectedLanguage = detectLanguage(text)
+	info.Language = info.DeclaredLanguage
+	if info.Language == "" {
+		info.Language = info.DetectedLanguage
+	}
+
+	if len(text) > maxContentText {
+		cut := maxContentText
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text, info.TextTruncated = text[:cut], true
+	}
+	info.Text = text
+	return info
+}
+
+// findMainContent returns the <main> element of doc or the element with the
+// main role, or else its only <article>.
+func findMainContent(doc *html.Node) *html.Node {
+	if main := findElement(doc, func(n *html.Node) bool {
+		return n.Data == "main" || attrValue(n, "role") == "main"
+	}); main != nil {
+		return main
+	}
+
+	var articles []*html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "article" {
+			articles = append(articles, n)
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	if len(articles) == 1 {
+		return articles[0]
+	}
+	return nil
+}
+
+func findElement(n *html.Node, match func(*html.Node) bool) *html.Node {
+	if n.Type == html.ElementNode && match(n) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// readableText returns the text of root outside of boilerplate elements, one
+// paragraph per line with its whitespace collapsed.
+func readableText(root *html.Node) string {
+	var paragraphs []string
+	var current strings.Builder
+	flush := func() {
+		if paragraph := strings.Join(strings.Fields(current.String()), " "); paragraph != "" {
+			paragraphs = append(paragraphs, paragraph)
+		}
+		current.Reset()
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			current.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if boilerplate[n.Data] || hasAttr(n, "hidden") {
+				return
+			}
+			if blockElements[n.Data] {
+				flush()
+				defer flush()
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+	flush()
+	return strings.Join(paragraphs, "\n")
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// isIdeograph reports whether r is written without spaces between words, and
+// counted as a word of its own.
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// countWords counts the runs of letters and digits of text, and every
+// ideograph.
+func countWords(text string) int {
+	count, inWord := 0, false
+	for _, r := range text {
+		switch {
+		case isIdeograph(r):
+			count++
+			inWord = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if !inWord {
+				count++
+			}
+			inWord = true
+		case r == '\'' || r == '’' || r == '-':
+			// keeps contractions and compounds in one word
+		default:
+			inWord = false
+		}
+	}
+	return count
+}
+
+// normalizeLanguage returns the primary subtag of a language tag, e.g. "en"
+// for "en-US".
+func normalizeLanguage(tag string) string {
+	primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+	primary, _, _ = strings.Cut(primary, "_")
+	primary = strings.ToLower(primary)
+	if len(primary) < 2 || len(primary) > 3 {
+		return ""
+	}
+	for _, r := range primary {
+		if r < 'a' || r > 'z' {
+			return ""
+		}
+	}
+	return primary
+}
+
+// scriptLanguages are the languages recognized by their script alone.
+var scriptLanguages = []struct {
+	script   *unicode.RangeTable
+	language string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// stopwords are frequent words of the languages written in Latin script.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "that", "for", "it", "with", "was", "on", "are", "be", "this", "by", "you", "not", "or", "have", "from"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "von", "sich", "auf", "für", "ich", "dem", "auch", "es", "wir"},
+	"fr": {"le", "la", "les", "et", "des", "est", "un", "une", "du", "que", "pour", "dans", "pas", "sur", "qui", "au", "avec", "ce", "il", "sont"},
+	"es": {"el", "la", "los", "las", "y", "de", "que", "en", "es", "un", "una", "por", "con", "para", "del", "se", "no", "su", "al", "como"},
+	"it": {"il", "di", "che", "e", "è", "un", "una", "per", "non", "del", "della", "con", "sono", "si", "le", "da", "gli", "nel", "anche", "più"},
+	"pt": {"o", "os", "e", "de", "que", "em", "um", "uma", "para", "com", "não", "do", "da", "por", "se", "no", "na", "é", "dos", "ao"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "op", "te", "voor", "niet", "met", "zijn", "ik", "die", "aan", "er", "ook", "je", "wordt"},
+}
+
+// stopwordLanguages maps every stopword to the languages using it.
+var stopwordLanguages = func() map[string][]string {
+	languages := make(map[string][]string)
+	for language, words := range stopwords {
+		for _, word := range words {
+			languages[word] = append(languages[word], language)
+		}
+	}
+	return languages
+}()
+
+// detectLanguage guesses the language of text from its script, or from its
+// stopwords for Latin script, returning "" when text is too short or the
+// guess too uncertain.
+func detectLanguage(text string) string {
+	letters := 0
+	scripts := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, sl := range scriptLanguages {
+			if unicode.Is(sl.script, r) {
+				scripts[sl.language]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	// kana is the tell of Japanese, which uses Han characters as well
+	if scripts["ja"] > 0 && scripts["ja"]+scripts["zh"] > letters/2 {
+		return "ja"
+	}
+	for _, sl := range scriptLanguages {
+		if scripts[sl.language] > letters/2 {
+			return sl.language
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(words) < minDetectionWords {
+		return ""
+	}
+	hits := make(map[string]int)
+	for _, word := range words {
+		for _, language := range stopwordLanguages[word] {
+			hits[language]++
+		}
+	}
+	best, bestHits, secondHits := "", 0, 0
+	for language, count := range hits {
+		switch {
+		case count > bestHits:
+			best, bestHits, secondHits = language, count, bestHits
+		case count > secondHits:
+			secondHits = count
+		}
+	}
+	// a tie or too few stopwords are not telling
+	if bestHits < 3 || bestHits == secondHits {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractContent(t *testing.T) {
+	page := `<!DOCTYPE html><html lang="en-GB"><head><title>Post</title><style>p{}</style></head><body>
+		<header><nav><a href="/">Home</a><a href="/blog">Blog</a></nav></header>
+		<main>
+			<h1>Hello   world</h1>
+			<p>This is the <b>first</b> paragraph.<script>track()</script></p>
+			<p hidden>Hidden text</p>
+			<ul><li>One</li><li>Two</li></ul>
+		</main>
+		<footer>Copyright</footer>
+	</body></html>`
+
+	info := extractContent(mustParseHTML(t, page))
+	assert.Equal(t, "Hello world\nThis is the first paragraph.\nOne\nTwo", info.Text)
+	assert.Equal(t, 9, info.WordCount)
+	assert.Equal(t, 1, info.ReadingTimeMinutes)
+	assert.Equal(t, "en", info.DeclaredLanguage)
+	assert.Equal(t, "en", info.Language)
+	assert.Len(t, info.Hash, 64)
+
+	// markup changes that keep the text keep the hash
+	restyled := strings.Replace(page, "<b>first</b>", `<em class="x">first</em>`, 1)
+	restyled = strings.Replace(restyled, "<footer>Copyright</footer>", "<footer>Copyright 2026</footer>", 1)
+	assert.Equal(t, info.Hash, extractContent(mustParseHTML(t, restyled)).Hash)
+
+	changed := strings.Replace(page, "first", "second", 1)
+	assert.NotEqual(t, info.Hash, extractContent(mustParseHTML(t, changed)).Hash)
+}
+
+func TestExtractContentWithoutMain(t *testing.T) {
+	page := `<html><body><nav>Menu</nav><div>Der Hund ist nicht mit dem Ball auf der Wiese, und die Katze ist auch nicht da.</div></body></html>`
+
+	info := extractContent(mustParseHTML(t, page))
+	assert.Equal(t, "Der Hund ist nicht mit dem Ball auf der Wiese, und die Katze ist auch nicht da.", info.Text)
+	assert.Equal(t, "", info.DeclaredLanguage)
+	assert.Equal(t, "de", info.DetectedLanguage)
+	assert.Equal(t, "de", info.Language)
+}
+
+func TestCountWords(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"one two  three", 3},
+		{"don't stop, well-known 42", 4},
+		{"日本語", 3},
+		{"Hello, 世界!", 3},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, countWords(tt.text), tt.text)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"The quick brown fox jumps over the lazy dog and this is not the end of it.", "en"},
+		{"Le chat est sur la table et il ne veut pas partir avec les enfants pour le dîner.", "fr"},
+		{"El perro de mi vecino es muy grande y no le gusta jugar con los gatos para nada.", "es"},
+		{"De kat zit op de mat en het is niet duidelijk of hij voor de hond bang is.", "nl"},
+		{"Москва является столицей России и крупнейшим городом страны.", "ru"},
+		{"東京は日本の首都です。", "ja"},
+		{"北京是中国的首都。", "zh"},
+		{"Too short to tell", ""},
+		{"12345 67890", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, detectLanguage(tt.text), tt.text)
+	}
+}
+
+func TestNormalizeLanguage(t *testing.T) {
+	for tag, want := range map[string]string{"en-US": "en", "pt_BR": "pt", " DE ": "de", "fil": "fil", "": "", "x": "", "12": ""} {
+		assert.Equal(t, want, normalizeLanguage(tag), tag)
+	}
+}
@@ -0,0 +1,461 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Crawl limits accepted from clients.
+const (
+	MaxCrawlDepth = 10
+	MaxCrawlPages = 1000
+)
+
+// CrawlOptions limits which same-site links a crawl follows. The seed page
+// has depth 0. Include and Exclude are regular expressions matched against
+// the path of a discovered URL: when Include is set a path must match one of
+// them, and it must match none of Exclude.
+type CrawlOptions struct {
+	MaxDepth int      `json:"max_depth"`
+	MaxPages int      `json:"max_pages"`
+	Include  []string `json:"include,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+}
+
+func DefaultCrawlOptions() CrawlOptions {
+	return CrawlOptions{
+		MaxDepth: 2,
+		MaxPages: 100,
+	}
+}
+
+func (o CrawlOptions) Validate() error {
+	if o.MaxDepth < 0 || o.MaxDepth > MaxCrawlDepth {
+		return fmt.Errorf("crawl max depth must be between 0 and %d", MaxCrawlDepth)
+	}
+	if o.MaxPages < 1 || o.MaxPages > MaxCrawlPages {
+		return fmt.Errorf("crawl max pages must be between 1 and %d", MaxCrawlPages)
+	}
+	if _, err := compilePatterns(o.Include); err != nil {
+		return err
+	}
+	_, err := compilePatterns(o.Exclude)
+	return err
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid crawl pattern %q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Crawl is a site crawl started from SeedURL. CompletedAt is set once every
+// discovered page reached a terminal state and no links are left to follow.
+type Crawl struct {
+	ID          int          `json:"id"`
+	Owner       string       `json:"owner,omitempty"`
+	SeedURL     string       `json:"seed_url"`
+	Options     CrawlOptions `json:"options"`
+	CreatedAt   time.Time    `json:"created_at"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+}
+
+// CrawlPage is a page enqueued by a crawl. Parent is the URL ID of the page
+// it was first discovered on, 0 for the seed.
+type CrawlPage struct {
+	URLID  int    `json:"url_id"`
+	URL    string `json:"url"`
+	Depth  int    `json:"depth"`
+	Parent int    `json:"parent,omitempty"`
+}
+
+// CrawlEdge is a link between two pages of a crawl, by URL ID.
+type CrawlEdge struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+type CrawlGraph struct {
+	Pages []CrawlPage `json:"pages"`
+	Edges []CrawlEdge `json:"edges"`
+}
+
+// CrawlSummary aggregates the analysis of the pages of a crawl. The link and
+// heading figures only cover completed pages, and AvgTTFBMs and AvgTotalMs
+// average their response timings. Skipped counts the same-site
+// URLs that were not enqueued because of the crawl limits, patterns or the
+// owner's quota.
+type CrawlSummary struct {
+	Pages              int              `json:"pages"`
+	Finished           int              `json:"finished"`
+	Counts             map[URLState]int `json:"counts"`
+	Skipped            int              `json:"skipped"`
+	Depth              int              `json:"depth"`
+	HTMLVersions       map[string]int   `json:"html_versions"`
+	HeadingTagsCount   map[string]int   `json:"heading_tags_count"`
+	InternalLinks      int              `json:"internal_links"`
+	ExternalLinks      int              `json:"external_links"`
+	InaccessibleLinks  int              `json:"inaccessible_links"`
+	PagesWithLoginForm int              `json:"pages_with_login_form"`
+	AvgTTFBMs          int64            `json:"avg_ttfb_ms"`
+	AvgTotalMs         int64            `json:"avg_total_ms"`
+}
+
+type CrawlInfo struct {
+	Crawl
+	Summary CrawlSummary `json:"summary"`
+}
+
+type CrawlManagerInterface interface {
+	StartCrawl(seedURL string, crawlOpts CrawlOptions, urlOpts URLOptions) (*CrawlInfo, error)
+	GetCrawl(id int) *CrawlInfo
+	GetCrawlGraph(id int) *CrawlGraph
+	GetAllCrawls() []*CrawlInfo
+}
+
+type crawlState struct {
+	Crawl
+	// host is the host of the site, where the redirects of the seed ended
+	host      string
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+	urlOpts   URLOptions
+	pages     []CrawlPage
+	pageIndex map[int]int
+	byURL     map[string]int
+	edges     map[CrawlEdge]bool
+	skipped   map[string]bool
+	// expanding counts the pages whose links are being followed
+	expanding int
+}
+
+type CrawlManager struct {
+	mu         sync.Mutex
+	crawls     map[int]*crawlState
+	urlCrawl   map[int]int
+	idCounter  int
+	urlManager URLManagerInterface
+	taskQueue  TaskQueueInterface
+	quota      *DailyQuota
+}
+
+// NewCrawlManager enqueues the pages discovered by crawls on taskQueue,
+// booking each of them on quota, which may be nil. Call HandleStateChange on
+// every URL state change, see URLManager.OnStateChange.
+func NewCrawlManager(urlManager URLManagerInterface, taskQueue TaskQueueInterface, quota *DailyQuota) *CrawlManager {
+	return &CrawlManager{
+		crawls:     make(map[int]*crawlState),
+		urlCrawl:   make(map[int]int),
+		urlManager: urlManager,
+		taskQueue:  taskQueue,
+		quota:      quota,
+	}
+}
+
+// StartCrawl enqueues seedURL and follows its same-site links as pages
+// complete. The seed is not booked on the quota; callers do that.
+func (cm *CrawlManager) StartCrawl(seedURL string, crawlOpts CrawlOptions, urlOpts URLOptions) (*CrawlInfo, error) {
+	if err := crawlOpts.Validate(); err != nil {
+		return nil, err
+	}
+	seed, ok := crawlURL(seedURL)
+	if !ok || seed.Host == "" {
+		return nil, errors.New("crawl seed must be an absolute http or https URL")
+	}
+	include, _ := compilePatterns(crawlOpts.Include)
+	exclude, _ := compilePatterns(crawlOpts.Exclude)
+
+	urlInfo := cm.urlManager.AddURL(seed.String(), urlOpts)
+
+	cm.mu.Lock()
+	cm.idCounter++
+	crawl := &crawlState{
+		Crawl: Crawl{
+			ID:        cm.idCounter,
+			Owner:     urlOpts.Owner,
+			SeedURL:   seed.String(),
+			Options:   crawlOpts,
+			CreatedAt: time.Now(),
+		},
+		host:      seed.Host,
+		include:   include,
+		exclude:   exclude,
+		urlOpts:   urlOpts,
+		pageIndex: make(map[int]int),
+		byURL:     make(map[string]int),
+		edges:     make(map[CrawlEdge]bool),
+		skipped:   make(map[string]bool),
+	}
+	cm.crawls[crawl.ID] = crawl
+	cm.addPage(crawl, CrawlPage{URLID: urlInfo.ID, URL: seed.String()})
+	cm.mu.Unlock()
+
+	if _, err := cm.taskQueue.AddTask(urlInfo); err != nil {
+		cm.urlManager.MarkFailed(urlInfo.ID, ClassifyError(err))
+	}
+	return cm.GetCrawl(crawl.ID), nil
+}
+
+func (cm *CrawlManager) GetCrawl(id int) *CrawlInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	crawl, exists := cm.crawls[id]
+	if !exists {
+		return nil
+	}
+	return cm.info(crawl)
+}
+
+func (cm *CrawlManager) GetCrawlGraph(id int) *CrawlGraph {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	crawl, exists := cm.crawls[id]
+	if !exists {
+		return nil
+	}
+	graph := &CrawlGraph{
+		Pages: append([]CrawlPage(nil), crawl.pages...),
+		Edges: make([]CrawlEdge, 0, len(crawl.edges)),
+	}
+	for edge := range crawl.edges {
+		graph.Edges = append(graph.Edges, edge)
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+	return graph
+}
+
+func (cm *CrawlManager) GetAllCrawls() []*CrawlInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	crawls := make([]*CrawlInfo, 0, len(cm.crawls))
+	for _, crawl := range cm.crawls {
+		crawls = append(crawls, cm.info(crawl))
+	}
+	return crawls
+}
+
+// HandleStateChange follows the links of completed crawl pages and updates
+// the completion of their crawl. Links are followed on another goroutine, as
+// state changes may be reported while the task queue holds its lock.
+func (cm *CrawlManager) HandleStateChange(urlID int, state URLState) {
+	cm.mu.Lock()
+	crawlID, exists := cm.urlCrawl[urlID]
+	if !exists {
+		cm.mu.Unlock()
+		return
+	}
+	crawl := cm.crawls[crawlID]
+
+	if state != Completed {
+		cm.mu.Unlock()
+		cm.checkCompletion(crawlID)
+		return
+	}
+	crawl.expanding++
+	cm.mu.Unlock()
+
+	go cm.expand(crawlID, urlID)
+}
+
+// expand enqueues the same-site links of a completed page that the crawl
+// limits allow.
+func (cm *CrawlManager) expand(crawlID, urlID int) {
+	var links []string
+	var finalURL string
+	if urlInfo := cm.urlManager.GetURLInfo(urlID); urlInfo != nil && urlInfo.ProcessedData != nil {
+		links = urlInfo.ProcessedData.Links
+		finalURL = urlInfo.ProcessedData.FinalURL
+	}
+
+	var queued []*URLInfo
+
+	cm.mu.Lock()
+	crawl := cm.crawls[crawlID]
+	parent := crawl.pages[crawl.pageIndex[urlID]]
+	if final, ok := crawlURL(finalURL); ok {
+		// the site is where the seed redirected to, e.g. from http://x to
+		// https://www.x/, and links to where a page ended up are that page
+		if parent.Parent == 0 && parent.Depth == 0 {
+			crawl.host = final.Host
+		}
+		if _, seen := crawl.byURL[final.String()]; !seen {
+			crawl.byURL[final.String()] = urlID
+		}
+	}
+	for _, link := range links {
+		target, ok := crawl.sameSite(link)
+		if !ok {
+			continue
+		}
+		if id, seen := crawl.byURL[target.String()]; seen {
+			if id != urlID {
+				crawl.edges[CrawlEdge{From: urlID, To: id}] = true
+			}
+			continue
+		}
+		if !cm.allowed(crawl, parent, target) {
+			crawl.skipped[target.String()] = true
+			continue
+		}
+
+		urlInfo := cm.urlManager.AddURL(target.String(), crawl.urlOpts)
+		cm.addPage(crawl, CrawlPage{URLID: urlInfo.ID, URL: target.String(), Depth: parent.Depth + 1, Parent: urlID})
+		crawl.edges[CrawlEdge{From: urlID, To: urlInfo.ID}] = true
+		queued = append(queued, urlInfo)
+	}
+	crawl.expanding--
+	cm.mu.Unlock()
+
+	for _, urlInfo := range queued {
+		if _, err := cm.taskQueue.AddTask(urlInfo); err != nil {
+			cm.urlManager.MarkFailed(urlInfo.ID, ClassifyError(err))
+			cm.quota.Release(crawl.Owner, 1)
+		}
+	}
+	cm.checkCompletion(crawlID)
+}
+
+// allowed reports whether a new page may be enqueued, booking it on the
+// owner's quota if so. cm.mu must be held.
+func (cm *CrawlManager) allowed(crawl *crawlState, parent CrawlPage, target *url.URL) bool {
+	if parent.Depth >= crawl.Options.MaxDepth || len(crawl.pages) >= crawl.Options.MaxPages {
+		return false
+	}
+	if len(crawl.include) > 0 && !matchesAny(crawl.include, target.Path) {
+		return false
+	}
+	if matchesAny(crawl.exclude, target.Path) {
+		return false
+	}
+	return cm.quota.Reserve(crawl.Owner, 1).Allowed
+}
+
+func matchesAny(patterns []*regexp.Regexp, path string) bool {
+	for _, re := range patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameSite parses link and reports whether it is on the host of the site,
+// regardless of the scheme.
+func (crawl *crawlState) sameSite(link string) (*url.URL, bool) {
+	target, ok := crawlURL(link)
+	if !ok || !strings.EqualFold(target.Host, crawl.host) {
+		return nil, false
+	}
+	return target, true
+}
+
+// crawlURL parses an http(s) URL in the form pages are deduplicated by:
+// without fragment and with at least the root path.
+func crawlURL(link string) (*url.URL, bool) {
+	target, err := url.Parse(link)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, false
+	}
+	target.Fragment = ""
+	target.RawFragment = ""
+	if target.Path == "" {
+		target.Path = "/"
+	}
+	return target, true
+}
+
+// addPage registers a page of crawl. cm.mu must be held.
+func (cm *CrawlManager) addPage(crawl *crawlState, page CrawlPage) {
+	crawl.pageIndex[page.URLID] = len(crawl.pages)
+	crawl.pages = append(crawl.pages, page)
+	crawl.byURL[page.URL] = page.URLID
+	cm.urlCrawl[page.URLID] = crawl.ID
+}
+
+func (cm *CrawlManager) checkCompletion(id int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	crawl := cm.crawls[id]
+	info := cm.info(crawl)
+	if crawl.expanding > 0 || info.Summary.Finished < info.Summary.Pages {
+		crawl.CompletedAt = nil
+		return
+	}
+	if crawl.CompletedAt == nil {
+		now := time.Now()
+		crawl.CompletedAt = &now
+	}
+}
+
+// info copies crawl and computes its summary. cm.mu must be held.
+func (cm *CrawlManager) info(crawl *crawlState) *CrawlInfo {
+	summary := CrawlSummary{
+		Pages:            len(crawl.pages),
+		Counts:           make(map[URLState]int),
+		Skipped:          len(crawl.skipped),
+		HTMLVersions:     make(map[string]int),
+		HeadingTagsCount: make(map[string]int),
+	}
+	var timed, ttfb, total int64
+	for _, page := range crawl.pages {
+		if page.Depth > summary.Depth {
+			summary.Depth = page.Depth
+		}
+		urlInfo := cm.urlManager.GetURLInfo(page.URLID)
+		if urlInfo == nil {
+			continue
+		}
+		state := cm.urlManager.GetURLState(page.URLID)
+		summary.Counts[state]++
+		if state.Terminal() {
+			summary.Finished++
+		}
+
+		data := urlInfo.ProcessedData
+		if state != Completed || data == nil {
+			continue
+		}
+		summary.HTMLVersions[data.HTMLVersion]++
+		for tag, count := range data.HeadingTagsCount {
+			summary.HeadingTagsCount[tag] += count
+		}
+		summary.InternalLinks += data.InternalLinks
+		summary.ExternalLinks += data.ExternalLinks
+		summary.InaccessibleLinks += data.InaccessibleLinks
+		if data.HasLoginForm {
+			summary.PagesWithLoginForm++
+		}
+		if data.Response != nil {
+			timed++
+			ttfb += data.Response.Timings.TTFBMs
+			total += data.Response.Timings.TotalMs
+		}
+	}
+	if timed > 0 {
+		summary.AvgTTFBMs = ttfb / timed
+		summary.AvgTotalMs = total / timed
+	}
+
+	return &CrawlInfo{Crawl: crawl.Crawl, Summary: summary}
+}
@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCrawl(t *testing.T) {
+	site := map[string][]string{
+		"http://example.com/": {
+			"http://example.com/a",
+			"http://example.com/b#top",
+			"http://example.com/private/x",
+			"http://other.example.com/",
+		},
+		"http://example.com/a": {"http://example.com/", "http://example.com/a/deep"},
+		"http://example.com/b": {"http://example.com/a"},
+	}
+	analyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			return &DataInfo{
+				HTMLVersion:      "HTML5",
+				HeadingTagsCount: map[string]int{"h1": 1},
+				InternalLinks:    len(site[url]),
+				Links:            site[url],
+				Response:         &ResponseInfo{Timings: ResponseTimings{TTFBMs: int64(10 * len(site[url])), TotalMs: 50}},
+			}, nil
+		},
+	}
+
+	urlManager := NewURLManager()
+	tq := NewTaskQueue(2, urlManager, analyzer, logrus.New())
+	crawls := NewCrawlManager(urlManager, tq, nil)
+	urlManager.OnStateChange(crawls.HandleStateChange)
+
+	crawl, err := crawls.StartCrawl("http://example.com", CrawlOptions{MaxDepth: 1, MaxPages: 10, Exclude: []string{"^/private/"}}, URLOptions{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for crawls.GetCrawl(crawl.ID).CompletedAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("crawl did not complete: %+v", crawls.GetCrawl(crawl.ID))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	info := crawls.GetCrawl(crawl.ID)
+	summary := info.Summary
+	if summary.Pages != 3 || summary.Counts[Completed] != 3 || summary.Depth != 1 {
+		t.Errorf("unexpected pages in summary: %+v", summary)
+	}
+	// /private/x is excluded and /a/deep is beyond the maximum depth
+	if summary.Skipped != 2 {
+		t.Errorf("expected 2 skipped URLs, got %d", summary.Skipped)
+	}
+	if summary.HTMLVersions["HTML5"] != 3 || summary.HeadingTagsCount["h1"] != 3 || summary.InternalLinks != 7 {
+		t.Errorf("unexpected aggregates in summary: %+v", summary)
+	}
+	if summary.AvgTTFBMs != 70/3 || summary.AvgTotalMs != 50 {
+		t.Errorf("unexpected timings in summary: %+v", summary)
+	}
+
+	graph := crawls.GetCrawlGraph(crawl.ID)
+	ids := make(map[string]int)
+	for _, page := range graph.Pages {
+		ids[page.URL] = page.URLID
+		if owner := urlManager.GetURLInfo(page.URLID).Owner; owner != "alice" {
+			t.Errorf("expected page %s to be owned by alice, got %q", page.URL, owner)
+		}
+	}
+	seed, a, b := ids["http://example.com/"], ids["http://example.com/a"], ids["http://example.com/b"]
+	if seed == 0 || a == 0 || b == 0 {
+		t.Fatalf("unexpected pages in graph: %+v", graph.Pages)
+	}
+	edges := make(map[CrawlEdge]bool)
+	for _, edge := range graph.Edges {
+		edges[edge] = true
+	}
+	for _, want := range []CrawlEdge{{seed, a}, {seed, b}, {a, seed}, {b, a}} {
+		if !edges[want] {
+			t.Errorf("expected edge %+v in %+v", want, graph.Edges)
+		}
+	}
+	if len(graph.Edges) != 4 {
+		t.Errorf("expected 4 edges, got %+v", graph.Edges)
+	}
+}
+
+func TestCrawlMaxPagesAndQuota(t *testing.T) {
+	analyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			return &DataInfo{Links: []string{
+				"http://example.com/1", "http://example.com/2", "http://example.com/3", "http://example.com/4",
+			}}, nil
+		},
+	}
+
+	urlManager := NewURLManager()
+	tq := NewTaskQueue(1, urlManager, analyzer, logrus.New())
+	quota := NewDailyQuota(3)
+	crawls := NewCrawlManager(urlManager, tq, quota)
+	urlManager.OnStateChange(crawls.HandleStateChange)
+
+	// the seed is booked by the caller
+	quota.Reserve("alice", 1)
+	crawl, err := crawls.StartCrawl("http://example.com/", CrawlOptions{MaxDepth: 3, MaxPages: 4}, URLOptions{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for crawls.GetCrawl(crawl.ID).CompletedAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("crawl did not complete: %+v", crawls.GetCrawl(crawl.ID))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the quota of 3 leaves room for two pages besides the seed
+	if summary := crawls.GetCrawl(crawl.ID).Summary; summary.Pages != 3 || summary.Skipped != 2 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
+
+func waitForCrawl(t *testing.T, crawls *CrawlManager, id int) *CrawlInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for crawls.GetCrawl(id).CompletedAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("crawl did not complete: %+v", crawls.GetCrawl(id))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return crawls.GetCrawl(id)
+}
+
+func TestCrawlFollowsSeedRedirect(t *testing.T) {
+	site := map[string][]string{
+		"https://www.example.com/":  {"https://www.example.com/", "https://www.example.com/a", "http://example.com/old"},
+		"https://www.example.com/a": {"https://www.example.com/"},
+	}
+	analyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			final := url
+			if url == "http://example.com/" {
+				final = "https://www.example.com/"
+			}
+			return &DataInfo{FinalURL: final, Links: site[final]}, nil
+		},
+	}
+
+	urlManager := NewURLManager()
+	tq := NewTaskQueue(1, urlManager, analyzer, logrus.New())
+	crawls := NewCrawlManager(urlManager, tq, nil)
+	urlManager.OnStateChange(crawls.HandleStateChange)
+
+	crawl, err := crawls.StartCrawl("http://example.com", CrawlOptions{MaxDepth: 2, MaxPages: 10}, URLOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the links of the seed are on the host it redirected to, and linking
+	// back to where the seed ended does not enqueue it again
+	info := waitForCrawl(t, crawls, crawl.ID)
+	if info.Summary.Pages != 2 || info.Summary.Skipped != 0 {
+		t.Errorf("unexpected summary: %+v", info.Summary)
+	}
+	graph := crawls.GetCrawlGraph(crawl.ID)
+	if len(graph.Pages) != 2 || graph.Pages[1].URL != "https://www.example.com/a" {
+		t.Errorf("unexpected pages: %+v", graph.Pages)
+	}
+}
+
+func TestCrawlReleasesQuotaWhenQueueingFails(t *testing.T) {
+	urlManager := NewURLManager()
+	quota := NewDailyQuota(3)
+	tq := &MockTaskQueue{
+		AddTaskFunc: func(urlInfo *URLInfo) (*Task, error) {
+			if urlInfo.URL == "http://example.com/" {
+				urlManager.UpdateProcessedData(urlInfo.ID, &DataInfo{Links: []string{"http://example.com/1", "http://example.com/2"}})
+				return &Task{ID: urlInfo.ID}, nil
+			}
+			return nil, errors.New("queue is full")
+		},
+	}
+	crawls := NewCrawlManager(urlManager, tq, quota)
+	urlManager.OnStateChange(crawls.HandleStateChange)
+
+	crawl, err := crawls.StartCrawl("http://example.com/", CrawlOptions{MaxDepth: 1, MaxPages: 10}, URLOptions{Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := waitForCrawl(t, crawls, crawl.ID)
+	if info.Summary.Counts[Failed] != 2 {
+		t.Errorf("expected the pages that could not be queued to fail: %+v", info.Summary)
+	}
+	if result := quota.Reserve("alice", 3); !result.Allowed {
+		t.Errorf("expected the quota of the failed pages to be released, %d remaining", result.Remaining)
+	}
+}
+
+func TestCrawlOptionsValidate(t *testing.T) {
+	invalid := []CrawlOptions{
+		{MaxDepth: -1, MaxPages: 1},
+		{MaxDepth: MaxCrawlDepth + 1, MaxPages: 1},
+		{MaxDepth: 1, MaxPages: 0},
+		{MaxDepth: 1, MaxPages: 1, Include: []string{"("}},
+	}
+	for _, opts := range invalid {
+		if opts.Validate() == nil {
+			t.Errorf("expected %+v to be invalid", opts)
+		}
+	}
+	if err := DefaultCrawlOptions().Validate(); err != nil {
+		t.Errorf("expected default options to be valid, got %v", err)
+	}
+
+	crawls := NewCrawlManager(NewURLManager(), &MockTaskQueue{}, nil)
+	if _, err := crawls.StartCrawl("mailto:someone@example.com", DefaultCrawlOptions(), URLOptions{}); err == nil {
+		t.Error("expected a non-http seed to be rejected")
+	}
+}
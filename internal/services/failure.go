@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// FailureReason tells why the analysis of a URL failed.
+type FailureReason string
+
+const (
+	ReasonDNSFailure         FailureReason = "dns_failure"
+	ReasonConnectionError    FailureReason = "connection_error"
+	ReasonTLSError           FailureReason = "tls_error"
+	ReasonTimeout            FailureReason = "timeout"
+	ReasonHTTPStatus         FailureReason = "http_status"
+	ReasonParseError         FailureReason = "parse_error"
+	ReasonTooLarge           FailureReason = "too_large"
+	ReasonUnsupportedContent FailureReason = "unsupported_content"
+	ReasonRedirectLoop       FailureReason = "redirect_loop"
+	ReasonTooManyRedirects   FailureReason = "too_many_redirects"
+	ReasonBlockedByPolicy    FailureReason = "blocked_by_policy"
+	ReasonBlockedByRobots    FailureReason = "blocked_by_robots"
+	ReasonUnknown            FailureReason = "unknown"
+)
+
+// FailureInfo describes a failed analysis attempt. StatusCode is set for
+// ReasonHTTPStatus, Phase for ReasonTimeout.
+type FailureInfo struct {
+	Reason     FailureReason `json:"reason"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Phase      string        `json:"phase,omitempty"`
+	Message    string        `json:"message"`
+	At         time.Time     `json:"at"`
+}
+
+// AnalysisError tags an error with the reason the analysis failed, for
+// failures that cannot be told apart by the error type alone.
+type AnalysisError struct {
+	Reason FailureReason
+	Err    error
+}
+
+func (e *AnalysisError) Error() string {
+	return string(e.Reason) + ": " + e.Err.Error()
+}
+
+func (e *AnalysisError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError maps an error returned by the page analyzer to a failure
+// reason.
+func ClassifyError(err error) *FailureInfo {
+	failure := &FailureInfo{
+		Reason:  failureReason(err),
+		Message: err.Error(),
+		At:      time.Now(),
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		failure.StatusCode = statusErr.StatusCode
+	}
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		failure.Phase = timeoutErr.Phase
+	}
+	return failure
+}
+
+func failureReason(err error) FailureReason {
+	var analysisErr *AnalysisError
+	if errors.As(err, &analysisErr) {
+		return analysisErr.Reason
+	}
+
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return ReasonBlockedByPolicy
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return ReasonHTTPStatus
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ReasonDNSFailure
+	}
+
+	if isTLSError(err) {
+		return ReasonTLSError
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ReasonTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return ReasonConnectionError
+	}
+
+	return ReasonUnknown
+}
+
+func isTLSError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr),
+		errors.As(err, &invalidCert), errors.As(err, &recordErr):
+		return true
+	}
+	// handshake alerts are not exported as a type before Go 1.21
+	return strings.Contains(err.Error(), "tls: ")
+}
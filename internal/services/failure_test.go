@@ -0,0 +1,42 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		reason     FailureReason
+		statusCode int
+	}{
+		{"http status", &StatusError{StatusCode: 404, Status: "404 Not Found"}, ReasonHTTPStatus, 404},
+		{"no such host", &url.Error{Op: "Get", URL: "http://nope.invalid", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}}}, ReasonDNSFailure, 0},
+		{"unknown authority", &url.Error{Op: "Get", URL: "https://self-signed", Err: x509.UnknownAuthorityError{}}, ReasonTLSError, 0},
+		{"handshake alert", errors.New("remote error: tls: handshake failure"), ReasonTLSError, 0},
+		{"client timeout", &url.Error{Op: "Get", URL: "http://slow", Err: context.DeadlineExceeded}, ReasonTimeout, 0},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, ReasonConnectionError, 0},
+		{"parse error", &AnalysisError{Reason: ReasonParseError, Err: errors.New("bad html")}, ReasonParseError, 0},
+		{"wrapped policy block", fmt.Errorf("fetch: %w", &AnalysisError{Reason: ReasonBlockedByPolicy, Err: errors.New("private address")}), ReasonBlockedByPolicy, 0},
+		{"other", errors.New("boom"), ReasonUnknown, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failure := ClassifyError(tt.err)
+			assert.Equal(t, tt.reason, failure.Reason)
+			assert.Equal(t, tt.statusCode, failure.StatusCode)
+			assert.Equal(t, tt.err.Error(), failure.Message)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// FetchProfile customizes the requests made to analyze a URL. Headers,
+// cookies and basic auth are only sent to the host of the analyzed page, not
+// to the external links it checks; the User-Agent, proxy and TLS options
+// apply to every request.
+type FetchProfile struct {
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Cookies   map[string]string `json:"cookies,omitempty"`
+	BasicAuth *BasicAuth        `json:"basic_auth,omitempty"`
+	// Proxy is an http, https or socks5 URL.
+	Proxy string `json:"proxy,omitempty"`
+	// InsecureSkipVerify accepts any TLS certificate, e.g. self-signed
+	// staging certificates.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// CACert is a PEM bundle of certificate authorities trusted in addition
+	// to the system ones.
+	CACert string `json:"ca_cert,omitempty"`
+}
+
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// headers the transport sets itself
+var reservedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Cookie":            true,
+	"Authorization":     true,
+	"User-Agent":        true,
+}
+
+func (p *FetchProfile) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for name, value := range p.Headers {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid header %q", name)
+		}
+		if reservedHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("header %q cannot be set, use the profile fields instead", name)
+		}
+	}
+	for name, value := range p.Cookies {
+		if (&http.Cookie{Name: name, Value: value}).String() == "" {
+			return fmt.Errorf("invalid cookie %q", name)
+		}
+	}
+	if !httpguts.ValidHeaderFieldValue(p.UserAgent) {
+		return errors.New("invalid user agent")
+	}
+	if p.BasicAuth != nil && strings.Contains(p.BasicAuth.Username, ":") {
+		return errors.New("basic auth username cannot contain ':'")
+	}
+	if p.Proxy != "" {
+		if _, err := p.proxyURL(); err != nil {
+			return err
+		}
+	}
+	if p.CACert != "" {
+		if _, err := p.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *FetchProfile) proxyURL() (*url.URL, error) {
+	proxy, err := url.Parse(p.Proxy)
+	if err != nil || proxy.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q", p.Proxy)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return proxy, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+}
+
+func (p *FetchProfile) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: p.InsecureSkipVerify}
+	if p.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(p.CACert)) {
+			return nil, errors.New("invalid CA certificate")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// customTransport reports whether the profile needs its own transport.
+func (p *FetchProfile) customTransport() bool {
+	return p != nil && (p.Proxy != "" || p.InsecureSkipVerify || p.CACert != "")
+}
+
+// transport returns a copy of base with the proxy and TLS options of the
+// profile.
+func (p *FetchProfile) transport(base *http.Transport) (*http.Transport, error) {
+	transport := base.Clone()
+	if p.Proxy != "" {
+		proxy, err := p.proxyURL()
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if p.InsecureSkipVerify || p.CACert != "" {
+		config, err := p.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if transport.TLSClientConfig != nil {
+			merged := transport.TLSClientConfig.Clone()
+			merged.InsecureSkipVerify = config.InsecureSkipVerify
+			if config.RootCAs != nil {
+				merged.RootCAs = config.RootCAs
+			}
+			config = merged
+		}
+		transport.TLSClientConfig = config
+	}
+	return transport, nil
+}
+
+// apply sets the profile on a request to the host of the analyzed page.
+func (p *FetchProfile) apply(req *http.Request) {
+	for name, value := range p.Headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range p.Cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	if p.BasicAuth != nil {
+		req.SetBasicAuth(p.BasicAuth.Username, p.BasicAuth.Password)
+	}
+}
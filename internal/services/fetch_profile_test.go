@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchProfileValidate(t *testing.T) {
+	valid := []*FetchProfile{
+		nil,
+		{},
+		{UserAgent: "Mozilla/5.0", Headers: map[string]string{"X-Env": "staging"}, Cookies: map[string]string{"session": "abc"}},
+		{BasicAuth: &BasicAuth{Username: "user", Password: "pass:word"}},
+		{Proxy: "socks5://127.0.0.1:1080", InsecureSkipVerify: true},
+	}
+	for _, p := range valid {
+		assert.NoError(t, p.Validate(), "%+v", p)
+	}
+
+	invalid := []*FetchProfile{
+		{Headers: map[string]string{"Bad Header": "x"}},
+		{Headers: map[string]string{"X-Env": "a\nb"}},
+		{Headers: map[string]string{"host": "internal"}},
+		{Cookies: map[string]string{"bad name": "x"}},
+		{BasicAuth: &BasicAuth{Username: "us:er"}},
+		{Proxy: "ftp://proxy:21"},
+		{Proxy: "not a url"},
+		{CACert: "not a certificate"},
+	}
+	for _, p := range invalid {
+		assert.Error(t, p.Validate(), "%+v", p)
+	}
+}
+
+func TestAnalyzePageProfile(t *testing.T) {
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Browser/1.0", r.Header.Get("User-Agent"))
+		assert.Empty(t, r.Header.Get("X-Env"), "headers must not leak to external links")
+		assert.Empty(t, r.Header.Get("Cookie"), "cookies must not leak to external links")
+		assert.Empty(t, r.Header.Get("Authorization"), "credentials must not leak to external links")
+	}))
+	defer external.Close()
+
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "Browser/1.0", r.Header.Get("User-Agent"))
+		assert.Equal(t, "staging", r.Header.Get("X-Env"))
+		cookie, err := r.Cookie("session")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "abc", cookie.Value)
+		}
+		fmt.Fprintf(w, `<!DOCTYPE html><html><body><a href="%s/">External</a></body></html>`, external.URL)
+	}))
+	defer site.Close()
+
+	pa := NewPageAnalyzer(&http.Client{Transport: LimitTransport(nil, NewHostLimiter(HostLimits{}))}, logrus.New(), WithUserAgent("URLsProcessor/1.0"))
+	profile := &FetchProfile{
+		UserAgent: "Browser/1.0",
+		Headers:   map[string]string{"X-Env": "staging"},
+		Cookies:   map[string]string{"session": "abc"},
+		BasicAuth: &BasicAuth{Username: "user", Password: "secret"},
+	}
+
+	// the self-signed certificate is rejected unless verification is off
+	_, err := pa.AnalyzePage(context.Background(), site.URL, &Task{Profile: profile})
+	require.Error(t, err)
+	assert.Equal(t, ReasonTLSError, ClassifyError(err).Reason)
+
+	profile.InsecureSkipVerify = true
+	data, err := pa.AnalyzePage(context.Background(), site.URL, &Task{Profile: profile})
+	require.NoError(t, err)
+	assert.Equal(t, 1, data.ExternalLinks)
+	assert.Equal(t, 0, data.InaccessibleLinks)
+}
+
+func TestAnalyzePageProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		fmt.Fprint(w, "<!DOCTYPE html><html><head><title>Proxied</title></head></html>")
+	}))
+	defer proxy.Close()
+
+	pa := NewPageAnalyzer(&http.Client{}, logrus.New())
+	data, err := pa.AnalyzePage(context.Background(), "http://staging.example.invalid/page", &Task{Profile: &FetchProfile{Proxy: proxy.URL}})
+	require.NoError(t, err)
+	assert.Equal(t, "Proxied", data.PageTitle)
+	assert.Equal(t, []string{"http://staging.example.invalid/page"}, proxied)
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIdleHosts bounds how many idle hosts the limiter remembers.
+const maxIdleHosts = 1000
+
+// HostLimits bounds the requests to a single host: at most MaxConcurrent at
+// a time, started at least Interval apart. Zero values disable a limit.
+type HostLimits struct {
+	MaxConcurrent int
+	Interval      time.Duration
+}
+
+type hostState struct {
+	slots chan struct{}
+	// next is the earliest start of the next request
+	next  time.Time
+	delay time.Duration
+}
+
+// HostLimiter applies HostLimits to every host, with a longer interval for
+// hosts that asked for a Crawl-delay. A nil HostLimiter does not limit.
+type HostLimiter struct {
+	mu     sync.Mutex
+	limits HostLimits
+	hosts  map[string]*hostState
+}
+
+func NewHostLimiter(limits HostLimits) *HostLimiter {
+	return &HostLimiter{
+		limits: limits,
+		hosts:  make(map[string]*hostState),
+	}
+}
+
+// Acquire waits until a request to host may start. release must be called
+// once the request is done.
+func (l *HostLimiter) Acquire(ctx context.Context, host string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	h := l.host(strings.ToLower(host))
+	l.mu.Unlock()
+
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release = func() {
+		if h.slots != nil {
+			<-h.slots
+		}
+	}
+
+	l.mu.Lock()
+	interval := l.limits.Interval
+	if h.delay > interval {
+		interval = h.delay
+	}
+	start := time.Now()
+	if h.next.After(start) {
+		start = h.next
+	}
+	h.next = start.Add(interval)
+	l.mu.Unlock()
+
+	if wait := time.Until(start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// SetDelay makes requests to host start at least delay apart.
+func (l *HostLimiter) SetDelay(host string, delay time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.host(strings.ToLower(host)).delay = delay
+}
+
+// host returns the state of host, forgetting idle hosts when there are too
+// many. l.mu must be held.
+func (l *HostLimiter) host(host string) *hostState {
+	if h, exists := l.hosts[host]; exists {
+		return h
+	}
+
+	if len(l.hosts) >= maxIdleHosts {
+		now := time.Now()
+		for name, h := range l.hosts {
+			if len(h.slots) == 0 && h.next.Before(now) && h.delay == 0 {
+				delete(l.hosts, name)
+			}
+		}
+	}
+
+	h := &hostState{}
+	if l.limits.MaxConcurrent > 0 {
+		h.slots = make(chan struct{}, l.limits.MaxConcurrent)
+	}
+	l.hosts[host] = h
+	return h
+}
+
+// LimitTransport returns a transport applying the limits of hosts on top of
+// base, http.DefaultTransport when nil.
+func LimitTransport(base http.RoundTripper, hosts *HostLimiter) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &limitedTransport{base: base, hosts: hosts}
+}
+
+// limitedTransport holds a slot of the host limiter for every request,
+// redirects included, until its response body is closed.
+type limitedTransport struct {
+	base  http.RoundTripper
+	hosts *HostLimiter
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.hosts.Acquire(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostLimiterConcurrency(t *testing.T) {
+	limiter := NewHostLimiter(HostLimits{MaxConcurrent: 2})
+
+	var active, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.Acquire(context.Background(), "example.com")
+			require.NoError(t, err)
+			defer release()
+
+			n := atomic.AddInt32(&active, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 2, peak)
+
+	// other hosts are not affected by a busy one
+	release, err := limiter.Acquire(context.Background(), "example.com")
+	require.NoError(t, err)
+	release2, err := limiter.Acquire(context.Background(), "example.com")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Acquire(ctx, "EXAMPLE.com")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	other, err := limiter.Acquire(context.Background(), "other.example.com")
+	require.NoError(t, err)
+	other()
+	release()
+	release2()
+}
+
+func TestHostLimiterInterval(t *testing.T) {
+	limiter := NewHostLimiter(HostLimits{Interval: 30 * time.Millisecond})
+	limiter.SetDelay("slow.example.com", 60*time.Millisecond)
+
+	elapsed := func(host string) time.Duration {
+		started := time.Now()
+		for i := 0; i < 3; i++ {
+			release, err := limiter.Acquire(context.Background(), host)
+			require.NoError(t, err)
+			release()
+		}
+		return time.Since(started)
+	}
+
+	assert.GreaterOrEqual(t, elapsed("example.com"), 60*time.Millisecond)
+	assert.GreaterOrEqual(t, elapsed("slow.example.com"), 120*time.Millisecond)
+
+	var nilLimiter *HostLimiter
+	release, err := nilLimiter.Acquire(context.Background(), "example.com")
+	require.NoError(t, err)
+	release()
+}
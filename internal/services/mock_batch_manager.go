@@ -0,0 +1,28 @@
+package services
+
+type MockBatchManager struct {
+	CreateBatchFunc   func(owner string, urlIDs []int) *BatchInfo
+	GetBatchFunc      func(id int) *BatchInfo
+	GetAllBatchesFunc func() []*BatchInfo
+}
+
+func (m *MockBatchManager) CreateBatch(owner string, urlIDs []int) *BatchInfo {
+	if m.CreateBatchFunc != nil {
+		return m.CreateBatchFunc(owner, urlIDs)
+	}
+	return nil
+}
+
+func (m *MockBatchManager) GetBatch(id int) *BatchInfo {
+	if m.GetBatchFunc != nil {
+		return m.GetBatchFunc(id)
+	}
+	return nil
+}
+
+func (m *MockBatchManager) GetAllBatches() []*BatchInfo {
+	if m.GetAllBatchesFunc != nil {
+		return m.GetAllBatchesFunc()
+	}
+	return nil
+}
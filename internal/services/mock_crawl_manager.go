@@ -0,0 +1,36 @@
+package services
+
+type MockCrawlManager struct {
+	StartCrawlFunc    func(seedURL string, crawlOpts CrawlOptions, urlOpts URLOptions) (*CrawlInfo, error)
+	GetCrawlFunc      func(id int) *CrawlInfo
+	GetCrawlGraphFunc func(id int) *CrawlGraph
+	GetAllCrawlsFunc  func() []*CrawlInfo
+}
+
+func (m *MockCrawlManager) StartCrawl(seedURL string, crawlOpts CrawlOptions, urlOpts URLOptions) (*CrawlInfo, error) {
+	if m.StartCrawlFunc != nil {
+		return m.StartCrawlFunc(seedURL, crawlOpts, urlOpts)
+	}
+	return nil, nil
+}
+
+func (m *MockCrawlManager) GetCrawl(id int) *CrawlInfo {
+	if m.GetCrawlFunc != nil {
+		return m.GetCrawlFunc(id)
+	}
+	return nil
+}
+
+func (m *MockCrawlManager) GetCrawlGraph(id int) *CrawlGraph {
+	if m.GetCrawlGraphFunc != nil {
+		return m.GetCrawlGraphFunc(id)
+	}
+	return nil
+}
+
+func (m *MockCrawlManager) GetAllCrawls() []*CrawlInfo {
+	if m.GetAllCrawlsFunc != nil {
+		return m.GetAllCrawlsFunc()
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package services
+
+import (
+	"context"
+	"errors"
+)
+
+type MockReanalyzer struct {
+	ReanalyzeFunc     func(ctx context.Context, id int, snapshotID string) (*DataInfo, error)
+	ReanalyzeManyFunc func(ctx context.Context, ids []int, allowed func(urlInfo *URLInfo) bool) []ReanalysisResult
+}
+
+func (m *MockReanalyzer) Reanalyze(ctx context.Context, id int, snapshotID string) (*DataInfo, error) {
+	if m.ReanalyzeFunc != nil {
+		return m.ReanalyzeFunc(ctx, id, snapshotID)
+	}
+	return nil, errors.New("Reanalyze function not implemented")
+}
+
+func (m *MockReanalyzer) ReanalyzeMany(ctx context.Context, ids []int, allowed func(urlInfo *URLInfo) bool) []ReanalysisResult {
+	if m.ReanalyzeManyFunc != nil {
+		return m.ReanalyzeManyFunc(ctx, ids, allowed)
+	}
+	return nil
+}
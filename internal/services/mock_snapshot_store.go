@@ -0,0 +1,36 @@
+package services
+
+type MockSnapshotStore struct {
+	SaveFunc  func(snapshot *Snapshot) error
+	ListFunc  func(urlInfo *URLInfo) ([]*Snapshot, error)
+	GetFunc   func(urlInfo *URLInfo, id string) (*Snapshot, error)
+	PruneFunc func() error
+}
+
+func (m *MockSnapshotStore) Save(snapshot *Snapshot) error {
+	if m.SaveFunc != nil {
+		return m.SaveFunc(snapshot)
+	}
+	return nil
+}
+
+func (m *MockSnapshotStore) List(urlInfo *URLInfo) ([]*Snapshot, error) {
+	if m.ListFunc != nil {
+		return m.ListFunc(urlInfo)
+	}
+	return nil, nil
+}
+
+func (m *MockSnapshotStore) Get(urlInfo *URLInfo, id string) (*Snapshot, error) {
+	if m.GetFunc != nil {
+		return m.GetFunc(urlInfo, id)
+	}
+	return nil, ErrSnapshotNotFound
+}
+
+func (m *MockSnapshotStore) Prune() error {
+	if m.PruneFunc != nil {
+		return m.PruneFunc()
+	}
+	return nil
+}
@@ -3,8 +3,14 @@ package services
 import "errors"
 
 type MockTaskQueue struct {
-	AddTaskFunc  func(urlInfo *URLInfo) (*Task, error)
-	StopTaskFunc func(id int) (*Task, error)
+	AddTaskFunc        func(urlInfo *URLInfo) (*Task, error)
+	StopTaskFunc       func(id int) (*Task, error)
+	QueuePositionsFunc func() map[int]QueuePosition
+	PauseFunc          func(cancelInFlight bool)
+	ResumeFunc         func()
+	StatusFunc         func() QueueStatus
+	SetWorkerCountFunc func(n int) error
+	SetAutoscalingFunc func(config AutoscaleConfig) error
 }
 
 func (m *MockTaskQueue) AddTask(urlInfo *URLInfo) (*Task, error) {
@@ -20,3 +26,43 @@ func (m *MockTaskQueue) StopTask(id int) (*Task, error) {
 	}
 	return nil, errors.New("StopTask function not implemented")
 }
+
+func (m *MockTaskQueue) QueuePositions() map[int]QueuePosition {
+	if m.QueuePositionsFunc != nil {
+		return m.QueuePositionsFunc()
+	}
+	return nil
+}
+
+func (m *MockTaskQueue) Pause(cancelInFlight bool) {
+	if m.PauseFunc != nil {
+		m.PauseFunc(cancelInFlight)
+	}
+}
+
+func (m *MockTaskQueue) Resume() {
+	if m.ResumeFunc != nil {
+		m.ResumeFunc()
+	}
+}
+
+func (m *MockTaskQueue) Status() QueueStatus {
+	if m.StatusFunc != nil {
+		return m.StatusFunc()
+	}
+	return QueueStatus{}
+}
+
+func (m *MockTaskQueue) SetWorkerCount(n int) error {
+	if m.SetWorkerCountFunc != nil {
+		return m.SetWorkerCountFunc(n)
+	}
+	return errors.New("SetWorkerCount function not implemented")
+}
+
+func (m *MockTaskQueue) SetAutoscaling(config AutoscaleConfig) error {
+	if m.SetAutoscalingFunc != nil {
+		return m.SetAutoscalingFunc(config)
+	}
+	return errors.New("SetAutoscaling function not implemented")
+}
@@ -1,8 +1,14 @@
 package services
 
+import "time"
+
 type MockURLManager struct {
-	AddURLFunc              func(url string) *URLInfo
+	AddURLFunc              func(url string, opts URLOptions) *URLInfo
 	UpdateURLStateFunc      func(id int, state URLState)
+	UpdateURLPriorityFunc   func(id int, priority int)
+	RecordAttemptFunc       func(id int, err error, nextAttemptAt *time.Time)
+	ResetAttemptsFunc       func(id int)
+	MarkFailedFunc          func(id int, failure *FailureInfo)
 	UpdateProcessedDataFunc func(id int, data *DataInfo)
 	GetURLInfoFunc          func(id int) *URLInfo
 	GetAllURLsFunc          func() []*URLInfo
@@ -10,9 +16,9 @@ type MockURLManager struct {
 	GetURLStateFunc         func(id int) URLState
 }
 
-func (m *MockURLManager) AddURL(url string) *URLInfo {
+func (m *MockURLManager) AddURL(url string, opts URLOptions) *URLInfo {
 	if m.AddURLFunc != nil {
-		return m.AddURLFunc(url)
+		return m.AddURLFunc(url, opts)
 	}
 	return nil
 }
@@ -23,6 +29,30 @@ func (m *MockURLManager) UpdateURLState(id int, state URLState) {
 	}
 }
 
+func (m *MockURLManager) UpdateURLPriority(id int, priority int) {
+	if m.UpdateURLPriorityFunc != nil {
+		m.UpdateURLPriorityFunc(id, priority)
+	}
+}
+
+func (m *MockURLManager) RecordAttempt(id int, err error, nextAttemptAt *time.Time) {
+	if m.RecordAttemptFunc != nil {
+		m.RecordAttemptFunc(id, err, nextAttemptAt)
+	}
+}
+
+func (m *MockURLManager) ResetAttempts(id int) {
+	if m.ResetAttemptsFunc != nil {
+		m.ResetAttemptsFunc(id)
+	}
+}
+
+func (m *MockURLManager) MarkFailed(id int, failure *FailureInfo) {
+	if m.MarkFailedFunc != nil {
+		m.MarkFailedFunc(id, failure)
+	}
+}
+
 func (m *MockURLManager) UpdateProcessedData(id int, data *DataInfo) {
 	if m.UpdateProcessedDataFunc != nil {
 		m.UpdateProcessedDataFunc(id, data)
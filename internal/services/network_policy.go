@@ -0,0 +1,229 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PolicyError is returned when the network policy forbids connecting to an
+// address.
+type PolicyError struct {
+	Host   string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("connection to %s blocked by network policy: %s", e.Host, e.Reason)
+}
+
+// reservedRanges are blocked besides the loopback, private, link-local,
+// unspecified and multicast addresses.
+var reservedRanges = []struct {
+	prefix netip.Prefix
+	reason string
+}{
+	{netip.MustParsePrefix("0.0.0.0/8"), "reserved address"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "shared address"},
+	{netip.MustParsePrefix("192.0.0.0/24"), "reserved address"},
+	{netip.MustParsePrefix("198.18.0.0/15"), "reserved address"},
+	{netip.MustParsePrefix("240.0.0.0/4"), "reserved address"},
+}
+
+var metadataAddrs = []netip.Addr{
+	netip.MustParseAddr("169.254.169.254"),
+	netip.MustParseAddr("fd00:ec2::254"),
+	netip.MustParseAddr("100.100.100.200"),
+}
+
+// NetworkPolicy keeps page fetches and link checks away from internal
+// networks. It is enforced when connecting, on the resolved address of every
+// connection, so that neither redirects nor DNS records pointing at internal
+// addresses get around it. Denied entries always win; allowed entries lift
+// the default blocks, e.g. for a staging host on a private network.
+type NetworkPolicy struct {
+	allowNets  []netip.Prefix
+	allowHosts []string
+	denyNets   []netip.Prefix
+	denyHosts  []string
+	dialer     *net.Dialer
+}
+
+// NewNetworkPolicy parses the allow and deny lists, whose entries are IP
+// addresses, CIDR ranges, host names or *.domain patterns matching the
+// subdomains of domain.
+func NewNetworkPolicy(allow, deny []string) (*NetworkPolicy, error) {
+	p := &NetworkPolicy{
+		dialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+	var err error
+	if p.allowNets, p.allowHosts, err = parsePolicyEntries(allow); err != nil {
+		return nil, err
+	}
+	if p.denyNets, p.denyHosts, err = parsePolicyEntries(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parsePolicyEntries(entries []string) ([]netip.Prefix, []string, error) {
+	var nets []netip.Prefix
+	var hosts []string
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid network policy range %q", entry)
+			}
+			nets = append(nets, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				addr = addr.Unmap()
+				nets = append(nets, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			if strings.ContainsAny(strings.TrimPrefix(entry, "*."), "*:") {
+				return nil, nil, fmt.Errorf("invalid network policy host %q", entry)
+			}
+			hosts = append(hosts, entry)
+		}
+	}
+	return nets, hosts, nil
+}
+
+// DialContext connects like net.Dialer.DialContext when the policy allows
+// it. Set it as the DialContext of the http.Transport used for fetching.
+func (p *NetworkPolicy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if matchesHost(p.denyHosts, host) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &PolicyError{Host: host, Reason: "host denied"}}
+	}
+	if matchesHost(p.allowHosts, host) {
+		return p.dialer.DialContext(ctx, network, address)
+	}
+
+	dialer := *p.dialer
+	dialer.Control = func(network, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return &PolicyError{Host: host, Reason: "unknown address " + address}
+		}
+		return p.checkAddr(host, addrPort.Addr())
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// CheckHost resolves host and returns a PolicyError when the policy does not
+// allow connecting to it. DialContext only sees the proxy when requests go
+// through one, so their targets are checked this way before they are sent.
+func (p *NetworkPolicy) CheckHost(ctx context.Context, host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchesHost(p.denyHosts, host) {
+		return &PolicyError{Host: host, Reason: "host denied"}
+	}
+	if matchesHost(p.allowHosts, host) {
+		return nil
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(host, addr)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := p.checkAddr(host, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyTransport checks the target of every request against policy before
+// handing it to a proxy.
+type policyTransport struct {
+	base   http.RoundTripper
+	policy *NetworkPolicy
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.CheckHost(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// checkAddr returns a PolicyError when host, resolved to addr, may not be
+// connected to.
+func (p *NetworkPolicy) checkAddr(host string, addr netip.Addr) error {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range p.denyNets {
+		if prefix.Contains(addr) {
+			return &PolicyError{Host: host, Reason: "address " + addr.String() + " denied"}
+		}
+	}
+	for _, prefix := range p.allowNets {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+
+	if reason := blockedReason(addr); reason != "" {
+		return &PolicyError{Host: host, Reason: reason + " " + addr.String()}
+	}
+	return nil
+}
+
+func blockedReason(addr netip.Addr) string {
+	for _, metadata := range metadataAddrs {
+		if addr == metadata {
+			return "cloud metadata address"
+		}
+	}
+	switch {
+	case addr.IsLoopback():
+		return "loopback address"
+	case addr.IsPrivate():
+		return "private address"
+	case addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast():
+		return "link-local address"
+	case addr.IsUnspecified():
+		return "unspecified address"
+	case addr.IsMulticast():
+		return "multicast address"
+	}
+	for _, reserved := range reservedRanges {
+		if reserved.prefix.Contains(addr) {
+			return reserved.reason
+		}
+	}
+	return ""
+}
+
+func matchesHost(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
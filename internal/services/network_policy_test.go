@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkPolicyCheckAddr(t *testing.T) {
+	policy, err := NewNetworkPolicy([]string{"10.0.0.0/8", "staging.internal"}, []string{"203.0.113.7", "*.blocked.example"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"192.168.1.1", false},
+		{"172.16.0.1", false},
+		{"fc00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"10.1.2.3", true},
+		{"203.0.113.7", false},
+	}
+	for _, tt := range tests {
+		err := policy.checkAddr("example.com", netip.MustParseAddr(tt.addr))
+		assert.Equal(t, tt.allowed, err == nil, "%s: %v", tt.addr, err)
+	}
+
+	err = policy.checkAddr("example.com", netip.MustParseAddr("169.254.169.254"))
+	assert.Contains(t, err.Error(), "cloud metadata address")
+
+	assert.True(t, matchesHost(policy.allowHosts, "staging.internal"))
+	assert.True(t, matchesHost(policy.denyHosts, "a.blocked.example"))
+	assert.False(t, matchesHost(policy.denyHosts, "blocked.example"))
+
+	for _, invalid := range [][]string{{"10.0.0.0/33"}, {"*.*.example"}, {"bad:host"}} {
+		_, err := NewNetworkPolicy(invalid, nil)
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+func newPolicyClient(t *testing.T, allow, deny []string) *http.Client {
+	t.Helper()
+	policy, err := NewNetworkPolicy(allow, deny)
+	require.NoError(t, err)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = policy.DialContext
+	return &http.Client{Transport: transport}
+}
+
+func TestAnalyzePageNetworkPolicy(t *testing.T) {
+	var localURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, localURL, http.StatusFound)
+		default:
+			fmt.Fprintf(w, `<!DOCTYPE html><html><body><a href="%s">Local</a></body></html>`, localURL)
+		}
+	}))
+	defer srv.Close()
+	localURL = fmt.Sprintf("http://localhost:%d/", srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	// loopback addresses are blocked by default, whatever name resolves to them
+	pa := NewPageAnalyzer(newPolicyClient(t, nil, nil), logrus.New())
+	for _, target := range []string{srv.URL, localURL} {
+		_, err := pa.AnalyzePage(context.Background(), target, &Task{})
+		require.Error(t, err)
+		var policyErr *PolicyError
+		assert.ErrorAs(t, err, &policyErr)
+		assert.Equal(t, ReasonBlockedByPolicy, ClassifyError(err).Reason)
+		assert.False(t, IsRetryable(err))
+	}
+
+	// allowing the address lifts the block, but a denied host stays denied,
+	// also when reached through a redirect or checked as a link
+	pa = NewPageAnalyzer(newPolicyClient(t, []string{"127.0.0.1"}, []string{"localhost"}), logrus.New())
+	data, err := pa.AnalyzePage(context.Background(), srv.URL, &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, data.BlockedLinks)
+	assert.Equal(t, 0, data.InaccessibleLinks)
+
+	_, err = pa.AnalyzePage(context.Background(), srv.URL+"/redirect", &Task{})
+	assert.Equal(t, ReasonBlockedByPolicy, ClassifyError(err).Reason)
+}
+
+func TestAnalyzePageNetworkPolicyProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		fmt.Fprint(w, `<!DOCTYPE html><html><head><title>Proxied</title></head></html>`)
+	}))
+	defer proxy.Close()
+
+	// the proxy itself is allowed, the targets it is asked for are checked
+	// on their own
+	policy, err := NewNetworkPolicy([]string{"127.0.0.1"}, []string{"internal.example.com"})
+	require.NoError(t, err)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = policy.DialContext
+	pa := NewPageAnalyzer(&http.Client{Transport: transport}, logrus.New(), WithNetworkPolicy(policy))
+	task := &Task{Profile: &FetchProfile{Proxy: proxy.URL}}
+	for _, target := range []string{"http://internal.example.com/", "http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/"} {
+		_, err := pa.AnalyzePage(context.Background(), target, task)
+		assert.Equal(t, ReasonBlockedByPolicy, ClassifyError(err).Reason, target)
+	}
+	assert.Empty(t, proxied)
+
+	data, err := pa.AnalyzePage(context.Background(), "http://203.0.113.10/", task)
+	require.NoError(t, err)
+	assert.Equal(t, "Proxied", data.PageTitle)
+	assert.Equal(t, []string{"http://203.0.113.10/"}, proxied)
+}
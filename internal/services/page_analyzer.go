@@ -1,51 +1,232 @@
 package services
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	neturl "net/url"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 )
 
+// linkCheckTimeout keeps a single unresponsive link from using up the whole
+// link checks budget.
+const linkCheckTimeout = 10 * time.Second
+
+// DefaultMaxBodySize is how much of a page is analyzed unless configured
+// with WithMaxBodySize.
+const DefaultMaxBodySize = 10 << 20
+
+// ErrUnsupportedContent is returned for pages that are not HTML.
+var ErrUnsupportedContent = errors.New("content is not HTML")
+
 type PageAnalyzerInterface interface {
-	AnalyzePage(url string, task *Task) (*DataInfo, error)
+	AnalyzePage(ctx context.Context, url string, task *Task) (*DataInfo, error)
+}
+
+// SnapshotAnalyzerInterface analyzes stored pages without fetching them.
+type SnapshotAnalyzerInterface interface {
+	AnalyzeSnapshot(ctx context.Context, snapshot *Snapshot) (*DataInfo, error)
 }
 
 type PageAnalyzer struct {
-	client *http.Client
-	logger *logrus.Logger
+	client       *http.Client
+	logger       *logrus.Logger
+	userAgent    string
+	robots       *RobotsCache
+	maxBodySize  int64
+	maxRedirects int
+	trackers     *TrackerList
+	snapshots    SnapshotStoreInterface
+	rootCAs      *x509.CertPool
+	policy       *NetworkPolicy
+}
+
+type PageAnalyzerOption func(*PageAnalyzer)
+
+// WithUserAgent sends userAgent with every request.
+func WithUserAgent(userAgent string) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.userAgent = userAgent
+	}
+}
+
+// WithRobots skips pages that robots disallows, failing them with
+// ReasonBlockedByRobots. Links that robots disallows are not checked and are
+// counted as RobotsBlockedLinks.
+func WithRobots(robots *RobotsCache) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.robots = robots
+	}
+}
+
+// WithMaxBodySize analyzes at most the first n bytes of a page, marking the
+// result as truncated when the page is longer.
+func WithMaxBodySize(n int64) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.maxBodySize = n
+	}
+}
+
+// WithMaxRedirects follows at most n redirects when fetching a page, failing
+// it with ReasonTooManyRedirects beyond that.
+func WithMaxRedirects(n int) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.maxRedirects = n
+	}
+}
+
+// WithTrackers flags the resources pages load from the domains of trackers
+// instead of DefaultTrackerDomains.
+func WithTrackers(trackers *TrackerList) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.trackers = trackers
+	}
+}
+
+// WithRootCAs verifies the certificate chains of TLS audits against roots
+// instead of the system roots.
+func WithRootCAs(roots *x509.CertPool) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.rootCAs = roots
+	}
+}
+
+// WithNetworkPolicy checks the targets of requests that fetch profiles send
+// through a proxy against policy, which the dialer of the client only
+// applies to the proxy itself.
+func WithNetworkPolicy(policy *NetworkPolicy) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.policy = policy
+	}
+}
+
+// WithSnapshots keeps the response of every page fetched in snapshots.
+func WithSnapshots(snapshots SnapshotStoreInterface) PageAnalyzerOption {
+	return func(pa *PageAnalyzer) {
+		pa.snapshots = snapshots
+	}
 }
 
-func NewPageAnalyzer(client *http.Client, logger *logrus.Logger) *PageAnalyzer {
-	return &PageAnalyzer{client: client, logger: logger}
+func NewPageAnalyzer(client *http.Client, logger *logrus.Logger, opts ...PageAnalyzerOption) *PageAnalyzer {
+	pa := &PageAnalyzer{
+		client:       client,
+		logger:       logger,
+		maxBodySize:  DefaultMaxBodySize,
+		maxRedirects: DefaultMaxRedirects,
+		trackers:     NewTrackerList(DefaultTrackerDomains),
+	}
+	for _, opt := range opts {
+		opt(pa)
+	}
+	return pa
 }
 
-func (pa *PageAnalyzer) AnalyzePage(url string, task *Task) (*DataInfo, error) {
+// AnalyzePage fetches url, parses it and checks its external links. ctx
+// bounds the whole analysis; the phase budgets come from task.Timeouts.
+func (pa *PageAnalyzer) AnalyzePage(ctx context.Context, url string, task *Task) (*DataInfo, error) {
 	pa.logger.Infof("Starting analysis for URL: %s", url)
 
-	resp, err := pa.client.Get(url)
+	var timeouts Timeouts
+	var profile *FetchProfile
+	if task != nil {
+		timeouts = task.Timeouts
+		profile = task.Profile
+	}
+
+	sess, err := pa.newSession(url, profile)
 	if err != nil {
-		pa.logger.Errorf("Failed to fetch URL: %s, error: %v", url, err)
+		pa.logger.Errorf("Invalid fetch profile for URL: %s, error: %v", url, err)
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer sess.close()
 
-	if resp.StatusCode != http.StatusOK {
-		err := errors.New("failed to fetch URL: " + resp.Status)
-		pa.logger.Errorf("URL returned non-OK status: %s, status code: %d", url, resp.StatusCode)
+	page, err := pa.fetch(ctx, sess, url, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	if pa.snapshots != nil && task != nil {
+		pa.saveSnapshot(task, page)
+	}
+
+	parseStarted := time.Now()
+	data, externalLinks, err := pa.analyze(page)
+	if err != nil {
+		return nil, err
+	}
+
+	// parsing cannot be interrupted, so the budget is checked afterwards
+	if err := ctx.Err(); err != nil {
+		return nil, phaseError(ctx, nil, timeouts, PhaseParse, err)
+	}
+	if timeouts.Parse > 0 && time.Since(parseStarted) > timeouts.Parse {
+		pa.logger.Errorf("Parsing URL: %s took longer than %s", url, timeouts.Parse)
+		return nil, &TimeoutError{Phase: PhaseParse, Budget: timeouts.Parse}
+	}
+
+	checks, err := pa.checkLinks(ctx, sess, externalLinks, timeouts)
+	if err != nil {
+		pa.logger.Errorf("Checking links of URL: %s did not finish, error: %v", url, err)
+		return nil, err
+	}
+	data.InaccessibleLinks = checks.inaccessible
+	data.BlockedLinks = checks.blocked
+	data.RobotsBlockedLinks = checks.robotsBlocked
+
+	pa.logger.Infof("Completed analysis for URL: %s", url)
+
+	return data, nil
+}
+
+// AnalyzeSnapshot runs the parse stage of AnalyzePage over the body stored in
+// snapshot instead of fetching the page. External links are counted but not
+// checked, so InaccessibleLinks, BlockedLinks and RobotsBlockedLinks are left
+// at zero.
+func (pa *PageAnalyzer) AnalyzeSnapshot(ctx context.Context, snapshot *Snapshot) (*DataInfo, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	pa.logger.Infof("Starting analysis of snapshot %s of URL: %s", snapshot.ID, snapshot.URL)
 
-	doc, err := html.Parse(resp.Body)
+	data, _, err := pa.analyze(pageFromSnapshot(snapshot))
 	if err != nil {
-		pa.logger.Errorf("Failed to parse HTML for URL: %s, error: %v", url, err)
 		return nil, err
 	}
+	data.SnapshotID = snapshot.ID
+
+	pa.logger.Infof("Completed analysis of snapshot %s of URL: %s", snapshot.ID, snapshot.URL)
+	return data, nil
+}
 
+// analyze parses a fetched page, returning its analysis and the external
+// links still to be checked.
+func (pa *PageAnalyzer) analyze(page *fetchedPage) (*DataInfo, []string, error) {
+	encoding, charsetName, _ := charset.DetermineEncoding(page.body, page.contentType)
+	doc, err := html.Parse(encoding.NewDecoder().Reader(bytes.NewReader(page.body)))
+	if err != nil {
+		pa.logger.Errorf("Failed to parse HTML for URL: %s, error: %v", page.url, err)
+		return nil, nil, &AnalysisError{Reason: ReasonParseError, Err: err}
+	}
 	data := &DataInfo{
 		HeadingTagsCount: make(map[string]int),
+		Charset:          charsetName,
+		Truncated:        page.truncated,
+		FinalURL:         page.url,
+		RedirectChain:    page.chain,
+		Response:         page.response,
+	}
+	for _, hop := range page.chain {
+		data.InsecureRedirect = data.InsecureRedirect || hop.Downgrade
 	}
 
 	// Detect HTML version
@@ -59,6 +240,10 @@ func (pa *PageAnalyzer) AnalyzePage(url string, task *Task) (*DataInfo, error) {
 		data.HTMLVersion = "HTML 4.01"
 	}
 
+	var externalLinks []string
+	// relative links are relative to where the redirects ended
+	base, _ := neturl.Parse(page.url)
+
 	// Traverse the document
 	var f func(*html.Node)
 	f = func(n *html.Node) {
@@ -75,12 +260,13 @@ func (pa *PageAnalyzer) AnalyzePage(url string, task *Task) (*DataInfo, error) {
 					if attr.Key == "href" {
 						if strings.HasPrefix(attr.Val, "http") {
 							data.ExternalLinks++
-							if pa.isInaccessible(attr.Val) {
-								data.InaccessibleLinks++
-							}
+							externalLinks = append(externalLinks, attr.Val)
 						} else {
 							data.InternalLinks++
 						}
+						if link := resolveLink(base, attr.Val); link != "" {
+							data.Links = append(data.Links, link)
+						}
 					}
 				}
 			case "form":
@@ -97,16 +283,303 @@ func (pa *PageAnalyzer) AnalyzePage(url string, task *Task) (*DataInfo, error) {
 	}
 	f(doc)
 
-	pa.logger.Infof("Completed analysis for URL: %s", url)
+	data.Content = extractContent(doc)
+	if base != nil {
+		data.Security = auditSecurity(base, page.header, page.tls, doc)
+		data.Resources = inventoryResources(base, doc, pa.trackers)
+	}
 
-	return data, nil
+	return data, externalLinks, nil
 }
 
-func (pa *PageAnalyzer) isInaccessible(url string) bool {
-	resp, err := pa.client.Get(url)
+// fetchedPage is the downloaded part of a page, fetched from url after the
+// redirects of chain.
+type fetchedPage struct {
+	url         string
+	chain       []RedirectHop
+	body        []byte
+	contentType string
+	truncated   bool
+	response    *ResponseInfo
+	header      http.Header
+	tls         *TLSAudit
+}
+
+// fetch downloads the page within the fetch budget, following its redirects,
+// up to the maximum body size.
+func (pa *PageAnalyzer) fetch(ctx context.Context, sess *session, url string, timeouts Timeouts) (*fetchedPage, error) {
+	fetchCtx, cancel := withBudget(ctx, timeouts.Fetch)
+	defer cancel()
+
+	resp, chain, trace, err := pa.follow(fetchCtx, sess, url)
 	if err != nil {
-		return true
+		pa.logger.Errorf("Failed to fetch URL: %s, error: %v", url, err)
+		return nil, phaseError(ctx, fetchCtx, timeouts, PhaseFetch, err)
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode >= 400 && resp.StatusCode < 600
+
+	if resp.StatusCode != http.StatusOK {
+		err := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		pa.logger.Errorf("URL returned non-OK status: %s, status code: %d", url, resp.StatusCode)
+		return nil, err
+	}
+
+	// sniffing needs the start of the body, so binary downloads are rejected
+	// before they are read any further
+	page := &fetchedPage{
+		url:         resp.Request.URL.String(),
+		chain:       chain,
+		contentType: resp.Header.Get("Content-Type"),
+		header:      resp.Header,
+	}
+	if resp.TLS != nil {
+		page.tls = newTLSAudit(resp.Request.URL.Hostname(), resp.TLS, sess.rootCAs, time.Now())
+	}
+	reader := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := reader.Peek(sniffLen)
+	if !isHTML(page.contentType, head) {
+		pa.logger.Errorf("URL is not HTML: %s, content type: %q", url, page.contentType)
+		return nil, &AnalysisError{Reason: ReasonUnsupportedContent, Err: fmt.Errorf("%w: %q", ErrUnsupportedContent, page.contentType)}
+	}
+
+	// read the body first so that network errors are not reported as parse
+	// errors
+	body, err := io.ReadAll(io.LimitReader(reader, pa.maxBodySize+1))
+	if err != nil {
+		pa.logger.Errorf("Failed to read body of URL: %s, error: %v", url, err)
+		return nil, phaseError(ctx, fetchCtx, timeouts, PhaseFetch, err)
+	}
+	if int64(len(body)) > pa.maxBodySize {
+		pa.logger.Warnf("Body of URL: %s is larger than %d bytes, truncating", url, pa.maxBodySize)
+		body = body[:pa.maxBodySize]
+		page.truncated = true
+	}
+	page.body = body
+	page.response = newResponseInfo(resp, int64(len(body)), trace, time.Now())
+	return page, nil
+}
+
+// saveSnapshot stores page as a snapshot of the run of task. Failing to do
+// so does not fail the analysis.
+func (pa *PageAnalyzer) saveSnapshot(task *Task, page *fetchedPage) {
+	snapshot := &Snapshot{
+		URLID:         task.ID,
+		RequestedURL:  task.URL,
+		Owner:         task.User,
+		URL:           page.url,
+		Attempt:       task.Attempt,
+		StatusCode:    page.response.StatusCode,
+		Header:        page.header,
+		Truncated:     page.truncated,
+		RedirectChain: page.chain,
+		Response:      page.response,
+		TLS:           page.tls,
+		Body:          page.body,
+	}
+	if err := pa.snapshots.Save(snapshot); err != nil {
+		pa.logger.Errorf("Failed to save snapshot of URL: %s, error: %v", task.URL, err)
+	}
+}
+
+// sniffLen is how much of a body http.DetectContentType looks at.
+const sniffLen = 512
+
+// isHTML reports whether a response with contentType, whose body starts with
+// head, is an HTML page. Missing or generic content types are sniffed.
+func isHTML(contentType string, head []byte) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/plain" || mediaType == "application/octet-stream" {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// linkChecks counts the links that could not be checked successfully.
+type linkChecks struct {
+	inaccessible  int
+	blocked       int
+	robotsBlocked int
+}
+
+// checkLinks counts the links that cannot be reached, those the network
+// policy does not allow checking and those robots.txt disallows, giving up
+// once the link checks budget is spent.
+func (pa *PageAnalyzer) checkLinks(ctx context.Context, sess *session, links []string, timeouts Timeouts) (linkChecks, error) {
+	linkCtx, cancel := withBudget(ctx, timeouts.LinkChecks)
+	defer cancel()
+
+	var checks linkChecks
+	for _, link := range links {
+		switch err := pa.checkLink(linkCtx, sess, link); {
+		case err == nil:
+		case failureReason(err) == ReasonBlockedByPolicy:
+			checks.blocked++
+		case failureReason(err) == ReasonBlockedByRobots:
+			checks.robotsBlocked++
+		default:
+			checks.inaccessible++
+		}
+		if err := linkCtx.Err(); err != nil {
+			return linkChecks{}, phaseError(ctx, linkCtx, timeouts, PhaseLinkChecks, err)
+		}
+	}
+	return checks, nil
+}
+
+// checkLink returns an error when url cannot be reached, answers with an
+// error status or is disallowed by robots.txt.
+func (pa *PageAnalyzer) checkLink(ctx context.Context, sess *session, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, linkCheckTimeout)
+	defer cancel()
+
+	req, err := sess.newRequest(ctx, url)
+	if err != nil {
+		return err
+	}
+	if pa.robots != nil {
+		allowed, err := pa.robots.Allowed(ctx, req.URL)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &AnalysisError{Reason: ReasonBlockedByRobots, Err: ErrBlockedByRobots}
+		}
+	}
+	resp, err := sess.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode < 600 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// resolveLink returns href as an absolute http(s) URL without fragment, or ""
+// when it points elsewhere, e.g. to a mailto: address.
+func resolveLink(base *neturl.URL, href string) string {
+	if base == nil {
+		return ""
+	}
+	link, err := base.Parse(strings.TrimSpace(href))
+	if err != nil || (link.Scheme != "http" && link.Scheme != "https") || link.Host == "" {
+		return ""
+	}
+	link.Fragment = ""
+	link.RawFragment = ""
+	return link.String()
+}
+
+// session holds what the requests of one analysis are made with.
+type session struct {
+	client    *http.Client
+	ownClient bool
+	userAgent string
+	profile   *FetchProfile
+	pageHost  string
+	rootCAs   *x509.CertPool
+}
+
+// newSession prepares the requests for url according to profile, which may
+// be nil.
+func (pa *PageAnalyzer) newSession(url string, profile *FetchProfile) (*session, error) {
+	sess := &session{client: pa.client, userAgent: pa.userAgent, profile: profile, rootCAs: pa.rootCAs}
+	if profile == nil {
+		return sess, nil
+	}
+
+	if profile.UserAgent != "" {
+		sess.userAgent = profile.UserAgent
+	}
+	if target, err := neturl.Parse(url); err == nil {
+		sess.pageHost = strings.ToLower(target.Host)
+	}
+	if profile.customTransport() {
+		client, err := pa.profileClient(profile)
+		if err != nil {
+			return nil, err
+		}
+		sess.client, sess.ownClient = client, true
+	}
+	if profile.CACert != "" {
+		config, err := profile.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		sess.rootCAs = config.RootCAs
+	}
+	return sess, nil
+}
+
+// profileClient returns a copy of the client of pa with the proxy and TLS
+// options of profile, keeping the host limits.
+func (pa *PageAnalyzer) profileClient(profile *FetchProfile) (*http.Client, error) {
+	rt := pa.client.Transport
+	limited, isLimited := rt.(*limitedTransport)
+	if isLimited {
+		rt = limited.base
+	}
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	base, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, errors.New("proxy and TLS options need an *http.Transport")
+	}
+
+	transport, err := profile.transport(base)
+	if err != nil {
+		return nil, err
+	}
+	var profileRT http.RoundTripper = transport
+	if pa.policy != nil && profile.Proxy != "" {
+		profileRT = &policyTransport{base: transport, policy: pa.policy}
+	}
+	client := *pa.client
+	client.Transport = profileRT
+	if isLimited {
+		client.Transport = LimitTransport(profileRT, limited.hosts)
+	}
+	return &client, nil
+}
+
+// close releases the connections of a client made for the session.
+func (sess *session) close() {
+	if sess.ownClient {
+		sess.client.CloseIdleConnections()
+	}
+}
+
+func (sess *session) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sess.userAgent != "" {
+		req.Header.Set("User-Agent", sess.userAgent)
+	}
+	if sess.profile != nil && strings.EqualFold(req.URL.Host, sess.pageHost) {
+		sess.profile.apply(req)
+	}
+	return req, nil
+}
+
+func withBudget(ctx context.Context, budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, budget)
+}
+
+// phaseError turns err into a TimeoutError when the task deadline or the
+// budget of phase ran out.
+func phaseError(ctx, phaseCtx context.Context, timeouts Timeouts, phase string, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Phase: PhaseTotal, Budget: timeouts.Total}
+	}
+	if phaseCtx != nil && phaseCtx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Phase: phase, Budget: timeouts.Budget(phase)}
+	}
+	return err
 }
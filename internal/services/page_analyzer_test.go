@@ -0,0 +1,293 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSite(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<!DOCTYPE html><html><head><title>Home</title></head><body>
+			<h1>Hi</h1><a href="/about">About</a><a href="%[1]s/slow">Slow</a><a href="%[1]s/missing">Missing</a>
+		</body></html>`, srv.URL)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAnalyzePage(t *testing.T) {
+	srv := newTestSite(t)
+	pa := NewPageAnalyzer(srv.Client(), logrus.New())
+
+	data, err := pa.AnalyzePage(context.Background(), srv.URL, &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, "HTML5", data.HTMLVersion)
+	assert.Equal(t, "Home", data.PageTitle)
+	assert.Equal(t, 1, data.InternalLinks)
+	assert.Equal(t, 2, data.ExternalLinks)
+	assert.Equal(t, 1, data.InaccessibleLinks)
+	assert.Equal(t, []string{srv.URL + "/about", srv.URL + "/slow", srv.URL + "/missing"}, data.Links)
+	require.NotNil(t, data.Content)
+	assert.Equal(t, "Hi\nAboutSlowMissing", data.Content.Text)
+}
+
+func TestAnalyzePageTimeouts(t *testing.T) {
+	srv := newTestSite(t)
+	pa := NewPageAnalyzer(srv.Client(), logrus.New())
+
+	tests := []struct {
+		name     string
+		url      string
+		timeouts Timeouts
+		deadline time.Duration
+		phase    string
+	}{
+		{"fetch budget", srv.URL + "/slow", Timeouts{Fetch: 50 * time.Millisecond}, 0, PhaseFetch},
+		{"link checks budget", srv.URL, Timeouts{LinkChecks: 50 * time.Millisecond}, 0, PhaseLinkChecks},
+		{"task deadline", srv.URL, Timeouts{Total: 50 * time.Millisecond}, 50 * time.Millisecond, PhaseTotal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+
+			started := time.Now()
+			_, err := pa.AnalyzePage(ctx, tt.url, &Task{Timeouts: tt.timeouts})
+
+			var timeoutErr *TimeoutError
+			require.True(t, errors.As(err, &timeoutErr), "got %v", err)
+			assert.Equal(t, tt.phase, timeoutErr.Phase)
+			assert.Less(t, time.Since(started), 500*time.Millisecond)
+
+			failure := ClassifyError(err)
+			assert.Equal(t, ReasonTimeout, failure.Reason)
+			assert.Equal(t, tt.phase, failure.Phase)
+		})
+	}
+}
+
+func TestAnalyzePageRobots(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+	})
+	var srv *httptest.Server
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<!DOCTYPE html><html><head><title>Page</title></head><body><a href="%[1]s/other">other</a><a href="%[1]s/private/other">private</a></body></html>`, srv.URL)
+	})
+	mux.HandleFunc("/private/other", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("disallowed link was checked")
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	robots := NewRobotsCache(srv.Client(), "URLsProcessor/1.0", time.Hour, nil)
+	pa := NewPageAnalyzer(srv.Client(), logrus.New(), WithUserAgent("URLsProcessor/1.0"), WithRobots(robots))
+
+	data, err := pa.AnalyzePage(context.Background(), srv.URL+"/public", &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, data.ExternalLinks)
+	assert.Equal(t, 0, data.InaccessibleLinks)
+	assert.Equal(t, 1, data.RobotsBlockedLinks)
+
+	_, err = pa.AnalyzePage(context.Background(), srv.URL+"/private/page", &Task{})
+	require.ErrorIs(t, err, ErrBlockedByRobots)
+	assert.Equal(t, ReasonBlockedByRobots, ClassifyError(err).Reason)
+	assert.False(t, IsRetryable(err))
+}
+
+func TestAnalyzePageContent(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<!DOCTYPE html><html><head><title>Large</title></head><body>")
+		for i := 0; i < 1000; i++ {
+			fmt.Fprint(w, "<h2>Section</h2>")
+		}
+	})
+	mux.HandleFunc("/pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		fmt.Fprint(w, "%PDF-1.7")
+	})
+	mux.HandleFunc("/binary", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a})
+	})
+	mux.HandleFunc("/untyped", func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Content-Type"] = nil
+		fmt.Fprint(w, "<!DOCTYPE html><html><head><title>Sniffed</title></head></html>")
+	})
+	mux.HandleFunc("/latin1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		_, _ = w.Write([]byte("<!DOCTYPE html><html><head><title>Caf\xe9</title></head></html>"))
+	})
+	mux.HandleFunc("/meta", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<!DOCTYPE html><html><head><meta charset=\"windows-1252\"><title>\x93Quoted\x94</title></head></html>"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	pa := NewPageAnalyzer(srv.Client(), logrus.New(), WithMaxBodySize(2000))
+
+	data, err := pa.AnalyzePage(context.Background(), srv.URL+"/large", &Task{})
+	require.NoError(t, err)
+	assert.True(t, data.Truncated)
+	assert.Equal(t, "Large", data.PageTitle)
+	assert.Less(t, data.HeadingTagsCount["h2"], 1000)
+
+	for _, path := range []string{"/pdf", "/binary"} {
+		_, err = pa.AnalyzePage(context.Background(), srv.URL+path, &Task{})
+		require.ErrorIs(t, err, ErrUnsupportedContent, path)
+		assert.Equal(t, ReasonUnsupportedContent, ClassifyError(err).Reason)
+		assert.False(t, IsRetryable(err))
+	}
+
+	data, err = pa.AnalyzePage(context.Background(), srv.URL+"/untyped", &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, "Sniffed", data.PageTitle)
+	assert.False(t, data.Truncated)
+
+	data, err = pa.AnalyzePage(context.Background(), srv.URL+"/latin1", &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, "Café", data.PageTitle)
+	assert.Equal(t, "windows-1252", data.Charset)
+
+	data, err = pa.AnalyzePage(context.Background(), srv.URL+"/meta", &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, "\u201cQuoted\u201d", data.PageTitle)
+}
+
+func TestAnalyzePageRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/middle", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/middle", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/en/home?lang=en", http.StatusFound)
+	})
+	mux.HandleFunc("/en/home", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<!DOCTYPE html><html><head><title>Home</title></head><body><a href="about">About</a></body></html>`)
+	})
+	mux.HandleFunc("/loop-a", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop-b", http.StatusFound)
+	})
+	mux.HandleFunc("/loop-b", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop-a", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/hop/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path+"/next", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	secure := httptest.NewTLSServer(http.RedirectHandler(srv.URL+"/en/home?lang=en", http.StatusMovedPermanently))
+	defer secure.Close()
+
+	pa := NewPageAnalyzer(secure.Client(), logrus.New(), WithMaxRedirects(3))
+
+	data, err := pa.AnalyzePage(context.Background(), srv.URL+"/start", &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL+"/en/home?lang=en", data.FinalURL)
+	require.Len(t, data.RedirectChain, 3)
+	assert.Equal(t, RedirectHop{URL: srv.URL + "/start", StatusCode: 301, Location: srv.URL + "/middle"}, withoutDuration(data.RedirectChain[0]))
+	assert.Equal(t, RedirectHop{URL: srv.URL + "/middle", StatusCode: 302, Location: srv.URL + "/en/home?lang=en"}, withoutDuration(data.RedirectChain[1]))
+	assert.Equal(t, RedirectHop{URL: srv.URL + "/en/home?lang=en", StatusCode: 200}, withoutDuration(data.RedirectChain[2]))
+	assert.False(t, data.InsecureRedirect)
+	assert.Equal(t, []string{srv.URL + "/en/about"}, data.Links)
+
+	data, err = pa.AnalyzePage(context.Background(), srv.URL+"/en/home?lang=en", &Task{})
+	require.NoError(t, err)
+	assert.Len(t, data.RedirectChain, 1)
+
+	data, err = pa.AnalyzePage(context.Background(), secure.URL, &Task{})
+	require.NoError(t, err)
+	assert.True(t, data.InsecureRedirect)
+	assert.True(t, data.RedirectChain[0].Downgrade)
+	assert.Equal(t, srv.URL+"/en/home?lang=en", data.FinalURL)
+
+	_, err = pa.AnalyzePage(context.Background(), srv.URL+"/loop-a", &Task{})
+	require.ErrorIs(t, err, ErrRedirectLoop)
+	assert.Equal(t, ReasonRedirectLoop, ClassifyError(err).Reason)
+	assert.Contains(t, err.Error(), "/loop-a -> "+srv.URL+"/loop-b -> "+srv.URL+"/loop-a")
+	assert.False(t, IsRetryable(err))
+
+	_, err = pa.AnalyzePage(context.Background(), srv.URL+"/hop/0", &Task{})
+	require.ErrorIs(t, err, ErrTooManyRedirects)
+	assert.Equal(t, ReasonTooManyRedirects, ClassifyError(err).Reason)
+}
+
+func withoutDuration(hop RedirectHop) RedirectHop {
+	hop.DurationMs = 0
+	return hop
+}
+
+func TestAnalyzePageResponse(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Server", "test")
+		w.Header().Set("X-Ignored", "1")
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "<!DOCTYPE html><html><head><title>Timed</title></head></html>")
+	}))
+	defer srv.Close()
+
+	pa := NewPageAnalyzer(srv.Client(), logrus.New())
+	data, err := pa.AnalyzePage(context.Background(), srv.URL, &Task{})
+	require.NoError(t, err)
+
+	response := data.Response
+	require.NotNil(t, response)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, map[string]string{
+		"cache-control": "max-age=60",
+		"content-type":  "text/html; charset=utf-8",
+		"server":        "test",
+	}, response.Headers)
+	assert.EqualValues(t, 61, response.BodySize)
+	assert.GreaterOrEqual(t, response.Timings.TTFBMs, int64(20))
+	assert.GreaterOrEqual(t, response.Timings.TotalMs, response.Timings.TTFBMs)
+	// a fresh connection to the test server is made with a TLS handshake
+	assert.GreaterOrEqual(t, response.Timings.TTFBMs, response.Timings.TLSMs)
+
+	gzipped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprint(zw, "<!DOCTYPE html><html><head><title>Zipped</title></head></html>")
+		zw.Close()
+	}))
+	defer gzipped.Close()
+
+	data, err = NewPageAnalyzer(&http.Client{}, logrus.New()).AnalyzePage(context.Background(), gzipped.URL, &Task{})
+	require.NoError(t, err)
+	assert.Equal(t, "Zipped", data.PageTitle)
+	assert.Equal(t, "gzip", data.Response.Headers["content-encoding"])
+	assert.EqualValues(t, 62, data.Response.BodySize)
+}
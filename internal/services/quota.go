@@ -0,0 +1,75 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+type QuotaResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	ResetAt   time.Time
+}
+
+// DailyQuota counts URLs submitted for analysis per user and calendar day
+// (UTC). A limit of 0, or a nil *DailyQuota, means no limit.
+type DailyQuota struct {
+	mu    sync.Mutex
+	limit int
+	day   time.Time
+	used  map[string]int
+	now   func() time.Time
+}
+
+func NewDailyQuota(limit int) *DailyQuota {
+	return &DailyQuota{
+		limit: limit,
+		used:  make(map[string]int),
+		now:   time.Now,
+	}
+}
+
+// Reserve books n URLs for user, either all of them or none.
+func (q *DailyQuota) Reserve(user string, n int) QuotaResult {
+	if q == nil || q.limit <= 0 {
+		return QuotaResult{Allowed: true, Remaining: -1}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+
+	result := QuotaResult{Limit: q.limit, ResetAt: q.day.Add(24 * time.Hour)}
+	if q.used[user]+n <= q.limit {
+		q.used[user] += n
+		result.Allowed = true
+	}
+	result.Remaining = q.limit - q.used[user]
+	return result
+}
+
+// Release gives back n URLs reserved today, e.g. when they could not be
+// queued after all.
+func (q *DailyQuota) Release(user string, n int) {
+	if q == nil || q.limit <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+
+	q.used[user] -= n
+	if q.used[user] <= 0 {
+		delete(q.used, user)
+	}
+}
+
+func (q *DailyQuota) rollover() {
+	today := q.now().UTC().Truncate(24 * time.Hour)
+	if !today.Equal(q.day) {
+		q.day = today
+		q.used = make(map[string]int)
+	}
+}
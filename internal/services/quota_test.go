@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDailyQuota(t *testing.T) {
+	now := time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)
+	quota := NewDailyQuota(5)
+	quota.now = func() time.Time { return now }
+
+	result := quota.Reserve("admin@example.com", 3)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining)
+	assert.Equal(t, time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC), result.ResetAt)
+
+	result = quota.Reserve("admin@example.com", 3)
+	assert.False(t, result.Allowed, "reservations are all or nothing")
+	assert.Equal(t, 2, result.Remaining)
+
+	quota.Release("admin@example.com", 1)
+	assert.True(t, quota.Reserve("admin@example.com", 3).Allowed)
+	assert.True(t, quota.Reserve("someone@example.com", 5).Allowed, "quotas are per user")
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, 5, quota.Reserve("admin@example.com", 0).Remaining, "quotas reset every day")
+}
+
+func TestDailyQuotaUnlimited(t *testing.T) {
+	var quota *DailyQuota
+	assert.True(t, quota.Reserve("admin@example.com", 1000).Allowed)
+	assert.True(t, NewDailyQuota(0).Reserve("admin@example.com", 1000).Allowed)
+}
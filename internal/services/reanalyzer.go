@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrURLNotFound = errors.New("URL not found")
+	// ErrURLBusy is returned for URLs that are pending or processing, whose
+	// results are about to be replaced by a fetch.
+	ErrURLBusy = errors.New("URL is pending or processing")
+	// ErrURLNotCompleted is returned for URLs that were stopped, failed or
+	// timed out, which have no results to replace.
+	ErrURLNotCompleted = errors.New("URL has not completed")
+)
+
+// ReanalysisResult is the outcome of analyzing a URL again. Error is empty
+// when the URL was analyzed.
+type ReanalysisResult struct {
+	ID         int    `json:"id"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ReanalyzerInterface interface {
+	// Reanalyze analyzes URL id again from its snapshot snapshotID, the
+	// newest when empty, and stores the results.
+	Reanalyze(ctx context.Context, id int, snapshotID string) (*DataInfo, error)
+	// ReanalyzeMany analyzes again the URLs ids from their newest snapshots,
+	// every completed URL when ids is empty. URLs allowed returns false for
+	// are reported as not found, or left out when ids is empty; a nil
+	// allowed accepts every URL.
+	ReanalyzeMany(ctx context.Context, ids []int, allowed func(urlInfo *URLInfo) bool) []ReanalysisResult
+}
+
+// Reanalyzer recomputes the results of URLs from their stored snapshots,
+// without fetching the pages again. The external links of snapshots are not
+// checked; the counts of inaccessible and blocked links are kept from the
+// previous results.
+type Reanalyzer struct {
+	urlManager URLManagerInterface
+	snapshots  SnapshotStoreInterface
+	analyzer   SnapshotAnalyzerInterface
+	logger     *logrus.Logger
+}
+
+func NewReanalyzer(urlManager URLManagerInterface, snapshots SnapshotStoreInterface, analyzer SnapshotAnalyzerInterface, logger *logrus.Logger) *Reanalyzer {
+	return &Reanalyzer{
+		urlManager: urlManager,
+		snapshots:  snapshots,
+		analyzer:   analyzer,
+		logger:     logger,
+	}
+}
+
+// Reanalyze only analyzes URLs that completed with results, so that the
+// state and failure of the others are left alone, and leaves the previous
+// results in place when it fails.
+func (ra *Reanalyzer) Reanalyze(ctx context.Context, id int, snapshotID string) (*DataInfo, error) {
+	urlInfo := ra.urlManager.GetURLInfo(id)
+	if urlInfo == nil {
+		return nil, ErrURLNotFound
+	}
+	if err := ra.checkCompleted(id); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := ra.snapshots.Get(urlInfo, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ra.analyzer.AnalyzeSnapshot(ctx, snapshot)
+	if err != nil {
+		ra.logger.Errorf("Failed to analyze snapshot %s of URL ID: %d, error: %v", snapshot.ID, id, err)
+		return nil, err
+	}
+
+	// a fetch may have started while the snapshot was analyzed
+	if err := ra.checkCompleted(id); err != nil {
+		return nil, err
+	}
+	previous := ra.urlManager.GetURLInfo(id).ProcessedData
+	data.InaccessibleLinks = previous.InaccessibleLinks
+	data.BlockedLinks = previous.BlockedLinks
+	data.RobotsBlockedLinks = previous.RobotsBlockedLinks
+	ra.urlManager.UpdateProcessedData(id, data)
+	ra.logger.Infof("Reanalyzed URL ID: %d from snapshot %s", id, snapshot.ID)
+	return data, nil
+}
+
+// checkCompleted returns ErrURLBusy or ErrURLNotCompleted unless URL id
+// completed with results.
+func (ra *Reanalyzer) checkCompleted(id int) error {
+	switch state := ra.urlManager.GetURLState(id); {
+	case !state.Terminal():
+		return ErrURLBusy
+	case state != Completed:
+		return ErrURLNotCompleted
+	}
+	if urlInfo := ra.urlManager.GetURLInfo(id); urlInfo == nil || urlInfo.ProcessedData == nil {
+		return ErrURLNotCompleted
+	}
+	return nil
+}
+
+// ReanalyzeMany analyzes up to one URL per CPU at a time. The results are in
+// the order of ids, or of the URL IDs when ids is empty.
+func (ra *Reanalyzer) ReanalyzeMany(ctx context.Context, ids []int, allowed func(urlInfo *URLInfo) bool) []ReanalysisResult {
+	if allowed == nil {
+		allowed = func(*URLInfo) bool { return true }
+	}
+	if len(ids) == 0 {
+		for _, urlInfo := range ra.urlManager.GetAllURLs() {
+			if allowed(urlInfo) && ra.checkCompleted(urlInfo.ID) == nil {
+				ids = append(ids, urlInfo.ID)
+			}
+		}
+		sort.Ints(ids)
+	}
+
+	results := make([]ReanalysisResult, len(ids))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		results[i].ID = id
+		if err := ctx.Err(); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if urlInfo := ra.urlManager.GetURLInfo(id); urlInfo == nil || !allowed(urlInfo) {
+			results[i].Error = ErrURLNotFound.Error()
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(result *ReanalysisResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			data, err := ra.Reanalyze(ctx, result.ID, "")
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.SnapshotID = data.SnapshotID
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReanalyze(t *testing.T) {
+	manager := NewURLManager()
+	done := manager.AddURL("http://example.com/", URLOptions{})
+	manager.UpdateProcessedData(done.ID, &DataInfo{PageTitle: "Old", InaccessibleLinks: 2, BlockedLinks: 1})
+	busy := manager.AddURL("http://example.com/busy", URLOptions{})
+	manager.UpdateURLState(busy.ID, Processing)
+	unfetched := manager.AddURL("http://example.com/none", URLOptions{})
+	manager.UpdateURLState(unfetched.ID, Stopped)
+	failed := manager.AddURL("http://example.com/missing", URLOptions{})
+	manager.MarkFailed(failed.ID, &FailureInfo{Reason: ReasonHTTPStatus, Message: "404 Not Found"})
+	unsaved := manager.AddURL("http://example.com/unsaved", URLOptions{})
+	manager.UpdateProcessedData(unsaved.ID, &DataInfo{PageTitle: "Unsaved"})
+
+	var requested []string
+	store := &MockSnapshotStore{
+		GetFunc: func(urlInfo *URLInfo, id string) (*Snapshot, error) {
+			// the failed URL has a snapshot of the error page it got
+			if urlInfo.ID != done.ID && urlInfo.ID != failed.ID {
+				return nil, ErrSnapshotNotFound
+			}
+			requested = append(requested, id)
+			return &Snapshot{
+				ID:         "00000000000000000042",
+				URLID:      urlInfo.ID,
+				URL:        "http://example.com/",
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/html"}},
+				Body:       []byte(`<title>New</title><a href="https://example.org/">out</a>`),
+			}, nil
+		},
+	}
+	ra := NewReanalyzer(manager, store, NewPageAnalyzer(http.DefaultClient, logrus.New()), logrus.New())
+
+	data, err := ra.Reanalyze(context.Background(), done.ID, "00000000000000000042")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00000000000000000042"}, requested)
+	assert.Equal(t, "00000000000000000042", data.SnapshotID)
+	stored := manager.GetURLInfo(done.ID)
+	assert.Equal(t, Completed, stored.State)
+	assert.Equal(t, "New", stored.ProcessedData.PageTitle)
+	assert.Equal(t, 1, stored.ProcessedData.ExternalLinks)
+	// the link checks of the last fetch are kept
+	assert.Equal(t, 2, stored.ProcessedData.InaccessibleLinks)
+	assert.Equal(t, 1, stored.ProcessedData.BlockedLinks)
+
+	_, err = ra.Reanalyze(context.Background(), busy.ID, "")
+	assert.ErrorIs(t, err, ErrURLBusy)
+	_, err = ra.Reanalyze(context.Background(), unfetched.ID, "")
+	assert.ErrorIs(t, err, ErrURLNotCompleted)
+	assert.Nil(t, manager.GetURLInfo(unfetched.ID).ProcessedData)
+	// URLs that did not complete keep their state and failure
+	_, err = ra.Reanalyze(context.Background(), failed.ID, "")
+	assert.ErrorIs(t, err, ErrURLNotCompleted)
+	assert.Equal(t, Failed, manager.GetURLState(failed.ID))
+	assert.Equal(t, ReasonHTTPStatus, manager.GetURLInfo(failed.ID).Failure.Reason)
+	assert.Nil(t, manager.GetURLInfo(failed.ID).ProcessedData)
+	_, err = ra.Reanalyze(context.Background(), unsaved.ID, "")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+	_, err = ra.Reanalyze(context.Background(), 99, "")
+	assert.ErrorIs(t, err, ErrURLNotFound)
+
+	// without IDs, every completed URL is analyzed again
+	results := ra.ReanalyzeMany(context.Background(), nil, nil)
+	assert.Equal(t, []ReanalysisResult{
+		{ID: done.ID, SnapshotID: "00000000000000000042"},
+		{ID: unsaved.ID, Error: ErrSnapshotNotFound.Error()},
+	}, results)
+
+	results = ra.ReanalyzeMany(context.Background(), []int{busy.ID, done.ID}, nil)
+	assert.Equal(t, []ReanalysisResult{
+		{ID: busy.ID, Error: ErrURLBusy.Error()},
+		{ID: done.ID, SnapshotID: "00000000000000000042"},
+	}, results)
+
+	// URLs that are not allowed are reported as not found, or left out
+	other := manager.AddURL("http://example.com/other", URLOptions{Owner: "bob"})
+	manager.UpdateProcessedData(other.ID, &DataInfo{PageTitle: "Other"})
+	unowned := func(urlInfo *URLInfo) bool { return urlInfo.Owner == "" }
+	results = ra.ReanalyzeMany(context.Background(), []int{other.ID, done.ID}, unowned)
+	assert.Equal(t, []ReanalysisResult{
+		{ID: other.ID, Error: ErrURLNotFound.Error()},
+		{ID: done.ID, SnapshotID: "00000000000000000042"},
+	}, results)
+	results = ra.ReanalyzeMany(context.Background(), nil, unowned)
+	assert.Equal(t, []ReanalysisResult{
+		{ID: done.ID, SnapshotID: "00000000000000000042"},
+		{ID: unsaved.ID, Error: ErrSnapshotNotFound.Error()},
+	}, results)
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// DefaultMaxRedirects is how many redirects a page fetch follows unless
+// configured with WithMaxRedirects, the same as http.Client.
+const DefaultMaxRedirects = 10
+
+// maxRedirectDrain is how much of a redirect response body is read so that
+// its connection can be reused.
+const maxRedirectDrain = 4 << 10
+
+var (
+	ErrRedirectLoop     = errors.New("redirect loop")
+	ErrTooManyRedirects = errors.New("too many redirects")
+	errRedirectLocation = errors.New("invalid redirect location")
+)
+
+// RedirectHop is one response received while fetching a page. Location is
+// set on redirects; Downgrade marks a redirect from https to http.
+type RedirectHop struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	Location   string `json:"location,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Downgrade  bool   `json:"downgrade,omitempty"`
+}
+
+// isRedirect reports whether the client would follow a response with status.
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// follow requests url and the redirects it answers with one at a time,
+// recording every response. The response returned is the first that is not
+// a redirect, with the trace of its request; its body must be closed.
+func (pa *PageAnalyzer) follow(ctx context.Context, sess *session, url string) (*http.Response, []RedirectHop, *requestTrace, error) {
+	client := *sess.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	var chain []RedirectHop
+	visited := make(map[string]bool)
+	for {
+		req, err := sess.newRequest(ctx, url)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		visited[req.URL.String()] = true
+
+		if pa.robots != nil {
+			allowed, err := pa.robots.Allowed(ctx, req.URL)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if !allowed {
+				pa.logger.Warnf("URL disallowed by robots.txt: %s", url)
+				return nil, nil, nil, &AnalysisError{Reason: ReasonBlockedByRobots, Err: ErrBlockedByRobots}
+			}
+		}
+
+		trace := newRequestTrace()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		hop := RedirectHop{
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			DurationMs: time.Since(trace.start).Milliseconds(),
+		}
+
+		location := resp.Header.Get("Location")
+		if !isRedirect(resp.StatusCode) || location == "" {
+			chain = append(chain, hop)
+			return resp, chain, trace, nil
+		}
+		_, _ = io.CopyN(io.Discard, resp.Body, maxRedirectDrain)
+		resp.Body.Close()
+
+		next, err := req.URL.Parse(location)
+		if err != nil || (next.Scheme != "http" && next.Scheme != "https") {
+			chain = append(chain, hop)
+			return nil, nil, nil, fmt.Errorf("%w %q", errRedirectLocation, location)
+		}
+		next.Fragment, next.RawFragment = "", ""
+		hop.Location = next.String()
+		hop.Downgrade = req.URL.Scheme == "https" && next.Scheme == "http"
+		chain = append(chain, hop)
+
+		if visited[hop.Location] {
+			return nil, nil, nil, &AnalysisError{Reason: ReasonRedirectLoop, Err: fmt.Errorf("%w: %s", ErrRedirectLoop, chainString(chain))}
+		}
+		if len(chain) > pa.maxRedirects {
+			return nil, nil, nil, &AnalysisError{Reason: ReasonTooManyRedirects, Err: fmt.Errorf("%w: more than %d", ErrTooManyRedirects, pa.maxRedirects)}
+		}
+		if hop.Downgrade {
+			pa.logger.Warnf("URL: %s redirects from https to http: %s", url, hop.Location)
+		}
+		url = hop.Location
+	}
+}
+
+// chainString lists the URLs of chain, ending with where its last hop
+// redirects to.
+func chainString(chain []RedirectHop) string {
+	urls := make([]string, 0, len(chain)+1)
+	for _, hop := range chain {
+		urls = append(urls, hop.URL)
+	}
+	if last := chain[len(chain)-1]; last.Location != "" {
+		urls = append(urls, last.Location)
+	}
+	return strings.Join(urls, " -> ")
+}
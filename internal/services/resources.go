@@ -0,0 +1,336 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
+)
+
+// maxResources bounds how many resources of a page are listed.
+const maxResources = 500
+
+// Types of the resources a page loads.
+const (
+	ResourceScript     = "script"
+	ResourceStylesheet = "stylesheet"
+	ResourceImage      = "image"
+	ResourceIframe     = "iframe"
+	ResourceVideo      = "video"
+	ResourceSource     = "source"
+)
+
+// DefaultTrackerDomains are common analytics, advertising and tracking
+// domains. Their subdomains are trackers too.
+var DefaultTrackerDomains = []string{
+	"google-analytics.com",
+	"googletagmanager.com",
+	"googleadservices.com",
+	"googlesyndication.com",
+	"doubleclick.net",
+	"facebook.net",
+	"connect.facebook.com",
+	"analytics.twitter.com",
+	"ads-twitter.com",
+	"licdn.com",
+	"analytics.tiktok.com",
+	"bat.bing.com",
+	"clarity.ms",
+	"hotjar.com",
+	"segment.com",
+	"segment.io",
+	"mixpanel.com",
+	"amplitude.com",
+	"heap.io",
+	"fullstory.com",
+	"mouseflow.com",
+	"crazyegg.com",
+	"scorecardresearch.com",
+	"quantserve.com",
+	"chartbeat.com",
+	"criteo.com",
+	"criteo.net",
+	"taboola.com",
+	"outbrain.com",
+	"adnxs.com",
+	"adsrvr.org",
+	"rubiconproject.com",
+	"pubmatic.com",
+	"mc.yandex.ru",
+	"hs-analytics.net",
+	"nr-data.net",
+}
+
+// TrackerList recognizes the hosts of tracker domains and their subdomains.
+type TrackerList struct {
+	domains map[string]bool
+}
+
+func NewTrackerList(domains []string) *TrackerList {
+	tl := &TrackerList{domains: make(map[string]bool)}
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain != "" {
+			tl.domains[domain] = true
+		}
+	}
+	return tl
+}
+
+// LoadTrackerList reads a tracker list from a file with one domain per line.
+// Empty lines and lines starting with # are ignored.
+func LoadTrackerList(path string) (*TrackerList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.ContainsAny(line, " /:*") {
+			return nil, fmt.Errorf("invalid tracker domain %q", line)
+		}
+		domains = append(domains, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewTrackerList(domains), nil
+}
+
+// Match returns the tracker domain host belongs to, or "".
+func (tl *TrackerList) Match(host string) string {
+	if tl == nil {
+		return ""
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for {
+		if tl.domains[host] {
+			return host
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return ""
+		}
+		host = host[i+1:]
+	}
+}
+
+// Resource is a script, stylesheet, image, frame or media file a page
+// loads. ThirdParty is set when it is served by another site than the page,
+// and Tracker names the tracker domain it belongs to.
+type Resource struct {
+	Type       string `json:"type"`
+	URL        string `json:"url"`
+	Host       string `json:"host"`
+	ThirdParty bool   `json:"third_party"`
+	Tracker    string `json:"tracker,omitempty"`
+}
+
+// ResourceHost counts the resources a page loads from a host.
+type ResourceHost struct {
+	Host    string `json:"host"`
+	Count   int    `json:"count"`
+	Tracker string `json:"tracker,omitempty"`
+}
+
+// ResourceInventory lists what a page loads, once per type and URL. Hosts
+// on the same site as the page, like cdn.example.com for www.example.com,
+// are first-party. Counts and hosts cover every resource; Resources lists at
+// most 500.
+type ResourceInventory struct {
+	Total           int            `json:"total"`
+	FirstParty      int            `json:"first_party"`
+	ThirdParty      int            `json:"third_party"`
+	Counts          map[string]int `json:"counts"`
+	FirstPartyHosts []ResourceHost `json:"first_party_hosts"`
+	ThirdPartyHosts []ResourceHost `json:"third_party_hosts"`
+	Trackers        []string       `json:"trackers"`
+	Resources       []Resource     `json:"resources"`
+}
+
+// resourceAttrs are the elements referencing resources, with the type of
+// the resource and the attribute holding its URL.
+var resourceAttrs = map[string]struct {
+	kind string
+	attr string
+}{
+	"script": {ResourceScript, "src"},
+	"img":    {ResourceImage, "src"},
+	"iframe": {ResourceIframe, "src"},
+	"video":  {ResourceVideo, "src"},
+	"source": {ResourceSource, "src"},
+}
+
+// inventoryResources collects the resources doc, fetched from pageURL,
+// references.
+func inventoryResources(pageURL *neturl.URL, doc *html.Node, trackers *TrackerList) *ResourceInventory {
+	inventory := &ResourceInventory{
+		Counts:          make(map[string]int),
+		FirstPartyHosts: []ResourceHost{},
+		ThirdPartyHosts: []ResourceHost{},
+		Trackers:        []string{},
+		Resources:       []Resource{},
+	}
+	site := siteOf(pageURL.Hostname())
+	seen := make(map[Resource]bool)
+	hosts := make(map[string]*ResourceHost)
+	thirdParty := make(map[string]bool)
+	trackerSet := make(map[string]bool)
+
+	add := func(kind, ref string) {
+		link := resolveLink(pageURL, ref)
+		if link == "" {
+			return
+		}
+		parsed, err := neturl.Parse(link)
+		if err != nil {
+			return
+		}
+		host := strings.ToLower(parsed.Hostname())
+		resource := Resource{
+			Type:       kind,
+			URL:        link,
+			Host:       host,
+			ThirdParty: siteOf(host) != site,
+			Tracker:    trackers.Match(host),
+		}
+		if seen[resource] {
+			return
+		}
+		seen[resource] = true
+
+		inventory.Total++
+		inventory.Counts[kind]++
+		if resource.ThirdParty {
+			inventory.ThirdParty++
+		} else {
+			inventory.FirstParty++
+		}
+		if len(inventory.Resources) < maxResources {
+			inventory.Resources = append(inventory.Resources, resource)
+		}
+		if hosts[host] == nil {
+			hosts[host] = &ResourceHost{Host: host, Tracker: resource.Tracker}
+			thirdParty[host] = resource.ThirdParty
+		}
+		hosts[host].Count++
+		if resource.Tracker != "" {
+			trackerSet[resource.Tracker] = true
+		}
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if ref, ok := resourceAttrs[n.Data]; ok {
+				if src := attrValue(n, ref.attr); src != "" {
+					add(ref.kind, src)
+				}
+				if n.Data == "img" || n.Data == "source" {
+					for _, candidate := range srcsetURLs(attrValue(n, "srcset")) {
+						add(ref.kind, candidate)
+					}
+				}
+			}
+			if n.Data == "link" && hasToken(attrValue(n, "rel"), "stylesheet") {
+				if href := attrValue(n, "href"); href != "" {
+					add(ResourceStylesheet, href)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	for host, counts := range hosts {
+		if thirdParty[host] {
+			inventory.ThirdPartyHosts = append(inventory.ThirdPartyHosts, *counts)
+		} else {
+			inventory.FirstPartyHosts = append(inventory.FirstPartyHosts, *counts)
+		}
+	}
+	sortResourceHosts(inventory.FirstPartyHosts)
+	sortResourceHosts(inventory.ThirdPartyHosts)
+	for tracker := range trackerSet {
+		inventory.Trackers = append(inventory.Trackers, tracker)
+	}
+	sort.Strings(inventory.Trackers)
+	return inventory
+}
+
+// siteOf returns the registrable domain of host, e.g. example.co.uk for
+// www.example.co.uk, or host itself for IP addresses and the like.
+func siteOf(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return site
+}
+
+// srcsetURLs returns the URLs of the candidates of a srcset attribute. URLs
+// may contain commas, like data: URLs, but end with whitespace or a comma
+// before their descriptors.
+func srcsetURLs(srcset string) []string {
+	var urls []string
+	for {
+		srcset = strings.TrimLeft(srcset, ", \t\n\f\r")
+		if srcset == "" {
+			return urls
+		}
+		end := strings.IndexAny(srcset, " \t\n\f\r")
+		if end < 0 {
+			end = len(srcset)
+		}
+		url := srcset[:end]
+		srcset = srcset[end:]
+		if trimmed := strings.TrimRight(url, ","); trimmed != url {
+			// a comma right after the URL ends a candidate without descriptors
+			url = trimmed
+		} else if i := strings.IndexByte(srcset, ','); i >= 0 {
+			srcset = srcset[i+1:]
+		} else {
+			srcset = ""
+		}
+		urls = append(urls, url)
+	}
+}
+
+// hasToken reports whether the space-separated list value contains token,
+// ignoring case.
+func hasToken(value, token string) bool {
+	for _, field := range strings.Fields(value) {
+		if strings.EqualFold(field, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortResourceHosts orders hosts by descending count, then by name.
+func sortResourceHosts(hosts []ResourceHost) {
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Count != hosts[j].Count {
+			return hosts[i].Count > hosts[j].Count
+		}
+		return hosts[i].Host < hosts[j].Host
+	})
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventoryResources(t *testing.T) {
+	pageURL, _ := neturl.Parse("https://www.example.com/blog/post")
+	doc := mustParseHTML(t, `<html><head>
+		<link rel="stylesheet" href="/css/site.css">
+		<link rel="Preload StyleSheet" href="https://fonts.example.net/font.css">
+		<link rel="icon" href="/favicon.ico">
+		<script src="https://cdn.example.com/app.js"></script>
+		<script src="https://www.googletagmanager.com/gtag/js?id=G-1"></script>
+		<script>inline()</script>
+	</head><body>
+		<img src="img/a.png" srcset="img/a-2x.png 2x, data:image/png;base64,AAAA 3x, img/a-4x.png">
+		<img src="img/a.png">
+		<iframe src="https://player.video.example.org/embed/1"></iframe>
+		<video src="movie.mp4"><source src="https://media.example.org/movie.webm" type="video/webm"></video>
+		<img src="https://stats.g.doubleclick.net/pixel.gif">
+	</body></html>`)
+
+	inventory := inventoryResources(pageURL, doc, NewTrackerList(DefaultTrackerDomains))
+	assert.Equal(t, 11, inventory.Total)
+	assert.Equal(t, 6, inventory.FirstParty)
+	assert.Equal(t, 5, inventory.ThirdParty)
+	assert.Equal(t, map[string]int{
+		ResourceStylesheet: 2,
+		ResourceScript:     2,
+		ResourceImage:      4,
+		ResourceIframe:     1,
+		ResourceVideo:      1,
+		ResourceSource:     1,
+	}, inventory.Counts)
+	assert.Equal(t, []ResourceHost{
+		{Host: "www.example.com", Count: 5},
+		{Host: "cdn.example.com", Count: 1},
+	}, inventory.FirstPartyHosts)
+	assert.Equal(t, []ResourceHost{
+		{Host: "fonts.example.net", Count: 1},
+		{Host: "media.example.org", Count: 1},
+		{Host: "player.video.example.org", Count: 1},
+		{Host: "stats.g.doubleclick.net", Count: 1, Tracker: "doubleclick.net"},
+		{Host: "www.googletagmanager.com", Count: 1, Tracker: "googletagmanager.com"},
+	}, inventory.ThirdPartyHosts)
+	assert.Equal(t, []string{"doubleclick.net", "googletagmanager.com"}, inventory.Trackers)
+	assert.Contains(t, inventory.Resources, Resource{
+		Type: ResourceImage,
+		URL:  "https://www.example.com/blog/img/a-4x.png",
+		Host: "www.example.com",
+	})
+}
+
+func TestSrcsetURLs(t *testing.T) {
+	assert.Equal(t, []string{"a.png", "b.png", "c.png"}, srcsetURLs("a.png 1x,b.png 2x , c.png"))
+	// as in browsers, only a comma after whitespace or at the end of a URL
+	// separates candidates
+	assert.Equal(t, []string{"a.png", "b.png"}, srcsetURLs("a.png, b.png"))
+	assert.Equal(t, []string{"a.png,b.png"}, srcsetURLs("a.png,b.png"))
+	assert.Equal(t, []string{"data:image/png;base64,AA==", "b.png"}, srcsetURLs("data:image/png;base64,AA== 1x, b.png 480w"))
+	assert.Empty(t, srcsetURLs(" , "))
+}
+
+func TestTrackerList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trackers.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# analytics\nStats.Example.com\n\nads.example.net.\n"), 0o600))
+
+	trackers, err := LoadTrackerList(path)
+	require.NoError(t, err)
+	assert.Equal(t, "stats.example.com", trackers.Match("stats.example.com"))
+	assert.Equal(t, "stats.example.com", trackers.Match("eu.STATS.example.com"))
+	assert.Equal(t, "ads.example.net", trackers.Match("ads.example.net."))
+	assert.Equal(t, "", trackers.Match("example.com"))
+	assert.Equal(t, "", trackers.Match("notstats.example.com"))
+
+	require.NoError(t, os.WriteFile(path, []byte("https://tracker.example/\n"), 0o600))
+	_, err = LoadTrackerList(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseHeaders are the response headers kept in ResponseInfo.
+var responseHeaders = []string{"Cache-Control", "Content-Type", "Server", "Content-Encoding"}
+
+// ResponseInfo describes the response a page was analyzed from. Headers
+// holds the headers of interest the response had, with lower case names;
+// BodySize is the number of bytes of the body read, after decompression.
+type ResponseInfo struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers"`
+	BodySize   int64             `json:"body_size"`
+	Timings    ResponseTimings   `json:"timings"`
+}
+
+// ResponseTimings breaks down the time the request of a page took, in
+// milliseconds. DNS, Connect and TLS are zero when an open connection was
+// reused; TTFB runs from the start of the request to the first response
+// byte, Download from there to the end of the body, and Total covers both.
+type ResponseTimings struct {
+	DNSMs      int64 `json:"dns_ms"`
+	ConnectMs  int64 `json:"connect_ms"`
+	TLSMs      int64 `json:"tls_ms"`
+	TTFBMs     int64 `json:"ttfb_ms"`
+	DownloadMs int64 `json:"download_ms"`
+	TotalMs    int64 `json:"total_ms"`
+}
+
+// newResponseInfo records resp, whose body of size bytes was read by done.
+func newResponseInfo(resp *http.Response, size int64, trace *requestTrace, done time.Time) *ResponseInfo {
+	info := &ResponseInfo{
+		StatusCode: resp.StatusCode,
+		Headers:    make(map[string]string),
+		BodySize:   size,
+		Timings:    trace.timings(done),
+	}
+	for _, name := range responseHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			info.Headers[strings.ToLower(name)] = value
+		}
+	}
+	// the transport removes the header of the bodies it decompresses
+	if resp.Uncompressed {
+		info.Headers["content-encoding"] = "gzip"
+	}
+	return info
+}
+
+// requestTrace collects the phases of a request through httptrace. The
+// dialer may report from other goroutines, racing for a connection.
+type requestTrace struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+}
+
+func newRequestTrace() *requestTrace {
+	return &requestTrace{start: time.Now()}
+}
+
+func (t *requestTrace) record(at *time.Time, overwrite bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if overwrite || at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// clientTrace returns the hooks recording the first start and the last end
+// of every phase.
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.record(&t.dnsStart, false) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.record(&t.dnsDone, true) },
+		ConnectStart:         func(string, string) { t.record(&t.connectStart, false) },
+		ConnectDone:          func(string, string, error) { t.record(&t.connectDone, true) },
+		TLSHandshakeStart:    func() { t.record(&t.tlsStart, false) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.record(&t.tlsDone, true) },
+		GotFirstResponseByte: func() { t.record(&t.firstByte, false) },
+	}
+}
+
+func (t *requestTrace) timings(done time.Time) ResponseTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timings := ResponseTimings{
+		DNSMs:     elapsedMs(t.dnsStart, t.dnsDone),
+		ConnectMs: elapsedMs(t.connectStart, t.connectDone),
+		TLSMs:     elapsedMs(t.tlsStart, t.tlsDone),
+		TotalMs:   elapsedMs(t.start, done),
+	}
+	if !t.firstByte.IsZero() {
+		timings.TTFBMs = elapsedMs(t.start, t.firstByte)
+		timings.DownloadMs = elapsedMs(t.firstByte, done)
+	}
+	return timings
+}
+
+// elapsedMs returns the milliseconds from start to end, or 0 when either is
+// unknown.
+func elapsedMs(start, end time.Time) int64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start).Milliseconds()
+}
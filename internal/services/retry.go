@@ -0,0 +1,106 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// StatusError is returned when a page answers with a status other than
+// 200 OK.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "failed to fetch URL: " + e.Status
+}
+
+// RetryPolicy decides whether and when a failed analysis is tried again.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt too: 1 disables retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is the fraction of the delay that is randomized, from 0 to 1.
+	Jitter float64
+	// Retryable classifies errors, IsRetryable when nil.
+	Retryable func(err error) bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		Jitter:      0.5,
+	}
+}
+
+// ShouldRetry reports whether an analysis that failed with err on the given
+// attempt (starting at 1) gets another one.
+func (p RetryPolicy) ShouldRetry(attempt int, err error) bool {
+	if err == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// Backoff returns how long to wait after the given failed attempt: BaseDelay
+// doubled for every previous attempt, capped at MaxDelay, of which the
+// Jitter fraction is random.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	jitter := math.Min(math.Max(p.Jitter, 0), 1)
+	return time.Duration(delay*(1-jitter) + delay*jitter*rand.Float64())
+}
+
+// IsRetryable reports whether err looks transient: timeouts, DNS lookups
+// that may succeed later, refused or reset connections, truncated responses
+// and the HTTP statuses servers use for temporary conditions. Running out of
+// the task deadline or a phase budget is not: the budgets bound the whole
+// task, which retries would multiply.
+func IsRetryable(err error) bool {
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: 0.5}
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{5, 500 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			delay := policy.Backoff(tt.attempt)
+			assert.GreaterOrEqual(t, delay, tt.min, "attempt %d", tt.attempt)
+			assert.LessOrEqual(t, delay, tt.max, "attempt %d", tt.attempt)
+		}
+	}
+
+	policy.Jitter = 0
+	assert.Equal(t, 400*time.Millisecond, policy.Backoff(3))
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3}
+	unavailable := &StatusError{StatusCode: 503, Status: "503 Service Unavailable"}
+
+	assert.True(t, policy.ShouldRetry(1, unavailable))
+	assert.True(t, policy.ShouldRetry(2, unavailable))
+	assert.False(t, policy.ShouldRetry(3, unavailable), "attempts exhausted")
+	assert.False(t, policy.ShouldRetry(1, nil))
+
+	policy.Retryable = func(err error) bool { return false }
+	assert.False(t, policy.ShouldRetry(1, unavailable))
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"service unavailable", &StatusError{StatusCode: 503}, true},
+		{"too many requests", fmt.Errorf("fetch: %w", &StatusError{StatusCode: 429}), true},
+		{"not found", &StatusError{StatusCode: 404}, false},
+		{"deadline", context.DeadlineExceeded, true},
+		{"dns timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{"no such host", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"other", errors.New("boom"), false},
+		{"task deadline", &TimeoutError{Phase: PhaseTotal, Budget: time.Minute}, false},
+		{"phase budget", fmt.Errorf("fetch: %w", &TimeoutError{Phase: PhaseFetch, Budget: time.Second}), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsRetryable(tt.err))
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBlockedByRobots is returned for pages the robots.txt of their site
+// disallows.
+var ErrBlockedByRobots = errors.New("disallowed by robots.txt")
+
+const (
+	// maxRobotsSize is the part of a robots.txt that is parsed, as RFC 9309
+	// requires parsing at least 500 KiB.
+	maxRobotsSize = 500 << 10
+	// robotsErrorTTL is how long an unreachable robots.txt disallows its site
+	// before it is fetched again.
+	robotsErrorTTL = time.Minute
+	// MaxCrawlDelay caps the Crawl-delay a site can ask for, so that a
+	// single host cannot stall the workers.
+	MaxCrawlDelay = 10 * time.Second
+)
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// robotsGroup holds the rules of the user-agent lines of a robots.txt that
+// matched.
+type robotsGroup struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// parseRobots returns the group of body that applies to the agent product
+// token: the groups naming it, or else the "*" groups.
+func parseRobots(body []byte, agent string) robotsGroup {
+	var named, wildcard robotsGroup
+	var foundNamed bool
+	var current []*robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			if !inAgents {
+				current = nil
+			}
+			inAgents = true
+			switch token := strings.ToLower(value); {
+			case agent != "" && token == agent:
+				foundNamed = true
+				current = append(current, &named)
+			case token == "*":
+				current = append(current, &wildcard)
+			}
+			continue
+		}
+		inAgents = false
+
+		for _, group := range current {
+			switch key {
+			case "allow", "disallow":
+				// an empty disallow allows everything, like no rule
+				if value != "" {
+					group.rules = append(group.rules, robotsRule{allow: key == "allow", pattern: value})
+				}
+			case "crawl-delay":
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					group.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	if foundNamed {
+		return named
+	}
+	return wildcard
+}
+
+// allowed applies the longest matching rule to path, preferring allow rules
+// on ties.
+func (g robotsGroup) allowed(path string) bool {
+	allow, longest := true, -1
+	for _, rule := range g.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			allow, longest = rule.allow, len(rule.pattern)
+		}
+	}
+	return allow
+}
+
+// robotsMatch matches path against a robots.txt pattern, where * matches any
+// characters and a trailing $ anchors the pattern at the end of the path.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 && anchored {
+			return strings.HasSuffix(path, part)
+		}
+		j := strings.Index(path, part)
+		if j < 0 {
+			return false
+		}
+		path = path[j+len(part):]
+	}
+	return !anchored || path == ""
+}
+
+// robotsAgent returns the product token of a User-Agent, e.g. "urlsprocessor"
+// for "URLsProcessor/1.0".
+func robotsAgent(userAgent string) string {
+	token := strings.FieldsFunc(userAgent, func(r rune) bool {
+		return r == '/' || r == ' '
+	})
+	if len(token) == 0 {
+		return ""
+	}
+	return strings.ToLower(token[0])
+}
+
+type robotsEntry struct {
+	group   robotsGroup
+	expires time.Time
+	// ready is closed once group is fetched
+	ready chan struct{}
+}
+
+// RobotsCache fetches and caches the robots.txt of every site, and tells
+// whether a URL may be fetched by userAgent. A robots.txt that does not exist
+// allows everything; a server error disallows everything for a minute, as RFC
+// 9309 asks for.
+type RobotsCache struct {
+	client    *http.Client
+	userAgent string
+	agent     string
+	ttl       time.Duration
+	hosts     *HostLimiter
+
+	mu      sync.Mutex
+	entries map[string]*robotsEntry
+}
+
+// NewRobotsCache keeps robots.txt files for ttl. The Crawl-delay of a site is
+// applied to hosts, which may be nil.
+func NewRobotsCache(client *http.Client, userAgent string, ttl time.Duration, hosts *HostLimiter) *RobotsCache {
+	return &RobotsCache{
+		client:    client,
+		userAgent: userAgent,
+		agent:     robotsAgent(userAgent),
+		ttl:       ttl,
+		hosts:     hosts,
+		entries:   make(map[string]*robotsEntry),
+	}
+}
+
+// Allowed reports whether target may be fetched. The error is only set when
+// ctx ended before the robots.txt was fetched.
+func (rc *RobotsCache) Allowed(ctx context.Context, target *url.URL) (bool, error) {
+	group, err := rc.group(ctx, target)
+	if err != nil {
+		return false, err
+	}
+
+	path := target.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if target.RawQuery != "" {
+		path += "?" + target.RawQuery
+	}
+	// /robots.txt itself is always allowed
+	return path == "/robots.txt" || group.allowed(path), nil
+}
+
+func (rc *RobotsCache) group(ctx context.Context, target *url.URL) (robotsGroup, error) {
+	host := strings.ToLower(target.Host)
+	origin := target.Scheme + "://" + host
+
+	for {
+		rc.mu.Lock()
+		entry, exists := rc.entries[origin]
+		if !exists || (isClosed(entry.ready) && time.Now().After(entry.expires)) {
+			entry = &robotsEntry{ready: make(chan struct{})}
+			rc.entries[origin] = entry
+			rc.mu.Unlock()
+
+			if err := rc.fetch(ctx, origin, host, entry); err != nil {
+				rc.mu.Lock()
+				delete(rc.entries, origin)
+				rc.mu.Unlock()
+				close(entry.ready)
+				return robotsGroup{}, err
+			}
+			close(entry.ready)
+			return entry.group, nil
+		}
+		rc.mu.Unlock()
+
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return robotsGroup{}, ctx.Err()
+		}
+		rc.mu.Lock()
+		current := rc.entries[origin] == entry
+		rc.mu.Unlock()
+		// the fetch was abandoned, try again
+		if current {
+			return entry.group, nil
+		}
+	}
+}
+
+// fetch fills entry from the robots.txt at origin, returning an error only
+// when ctx ended.
+func (rc *RobotsCache) fetch(ctx context.Context, origin, host string, entry *robotsEntry) error {
+	entry.expires = time.Now().Add(robotsErrorTTL)
+	disallowAll := robotsGroup{rules: []robotsRule{{pattern: "/"}}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		entry.group = disallowAll
+		return nil
+	}
+	if rc.userAgent != "" {
+		req.Header.Set("User-Agent", rc.userAgent)
+	}
+
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the page itself will most likely fail with the same, more telling
+		// error; the robots.txt is fetched again next time
+		entry.expires = time.Now()
+		return nil
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxRobotsSize))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			entry.expires = time.Now()
+			return nil
+		}
+		entry.group = parseRobots(body, rc.agent)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		entry.group = robotsGroup{}
+	default:
+		entry.group = disallowAll
+		return nil
+	}
+
+	entry.expires = time.Now().Add(rc.ttl)
+	if delay := entry.group.crawlDelay; delay > 0 {
+		if delay > MaxCrawlDelay {
+			delay = MaxCrawlDelay
+		}
+		rc.hosts.SetDelay(host, delay)
+	}
+	return nil
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
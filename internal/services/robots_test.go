@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRobots = `
+# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+
+User-agent: OtherBot
+User-agent: URLsProcessor
+Disallow: /no-bots
+Crawl-delay: 0.5
+
+User-agent: OtherBot
+Disallow: /
+`
+
+func TestParseRobots(t *testing.T) {
+	wildcard := parseRobots([]byte(testRobots), "somebot")
+	named := parseRobots([]byte(testRobots), "urlsprocessor")
+
+	tests := []struct {
+		group robotsGroup
+		path  string
+		want  bool
+	}{
+		{wildcard, "/", true},
+		{wildcard, "/private", false},
+		{wildcard, "/private/secret", false},
+		{wildcard, "/private/public/page", true},
+		{wildcard, "/files/report.pdf", false},
+		{wildcard, "/files/report.pdf?download=1", true},
+		{wildcard, "/no-bots", true},
+		{named, "/private", true},
+		{named, "/no-bots/page", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.group.allowed(tt.path), tt.path)
+	}
+	assert.Equal(t, 500*time.Millisecond, named.crawlDelay)
+	assert.Zero(t, wildcard.crawlDelay)
+	assert.Equal(t, "urlsprocessor", robotsAgent("URLsProcessor/1.0 (+https://example.com)"))
+}
+
+func TestRobotsCache(t *testing.T) {
+	var fetches int32
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		assert.Equal(t, "URLsProcessor/1.0", r.Header.Get("User-Agent"))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(testRobots))
+	}))
+	defer srv.Close()
+
+	allowed := func(rc *RobotsCache, path string) bool {
+		target, err := url.Parse(srv.URL + path)
+		require.NoError(t, err)
+		ok, err := rc.Allowed(context.Background(), target)
+		require.NoError(t, err)
+		return ok
+	}
+
+	hosts := NewHostLimiter(HostLimits{})
+	rc := NewRobotsCache(srv.Client(), "URLsProcessor/1.0", time.Hour, hosts)
+	assert.True(t, allowed(rc, "/private"))
+	assert.False(t, allowed(rc, "/no-bots"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fetches), "robots.txt should be cached")
+	assert.Equal(t, 500*time.Millisecond, hosts.hosts[srv.Listener.Addr().String()].delay)
+
+	status = http.StatusNotFound
+	rc = NewRobotsCache(srv.Client(), "URLsProcessor/1.0", time.Hour, nil)
+	assert.True(t, allowed(rc, "/no-bots"), "a missing robots.txt allows everything")
+
+	status = http.StatusServiceUnavailable
+	rc = NewRobotsCache(srv.Client(), "URLsProcessor/1.0", time.Hour, nil)
+	assert.False(t, allowed(rc, "/"), "an unavailable robots.txt disallows everything")
+	assert.True(t, allowed(rc, "/robots.txt"))
+}
@@ -0,0 +1,461 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// minHSTSMaxAge is the Strict-Transport-Security max-age below which
+	// the header is considered weak, as HSTS preload lists require.
+	minHSTSMaxAge = 180 * 24 * time.Hour
+	// certExpiryWarning is how long before its expiry a certificate is
+	// reported as expiring soon.
+	certExpiryWarning = 30 * 24 * time.Hour
+	// maxMixedContent bounds how many insecure references are listed.
+	maxMixedContent = 50
+)
+
+// Checks of a security audit, naming the part of the response an issue is
+// about.
+const (
+	CheckHeaders      = "headers"
+	CheckCookies      = "cookies"
+	CheckMixedContent = "mixed_content"
+	CheckTLS          = "tls"
+)
+
+// SecurityReport grades the security of a page from 0 to 100. Every issue
+// found costs its Penalty; the grade goes from A (90 and above) to F (below
+// 60). TLS is only set for pages served over https.
+type SecurityReport struct {
+	Score        int              `json:"score"`
+	Grade        string           `json:"grade"`
+	Issues       []SecurityIssue  `json:"issues"`
+	Headers      []SecurityHeader `json:"headers"`
+	Cookies      []CookieAudit    `json:"cookies"`
+	MixedContent MixedContent     `json:"mixed_content"`
+	TLS          *TLSAudit        `json:"tls,omitempty"`
+}
+
+type SecurityIssue struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+	Penalty int    `json:"penalty"`
+}
+
+// SecurityHeader is the audit of one security header. Passed is false when
+// the header is missing or too weak.
+type SecurityHeader struct {
+	Name    string `json:"name"`
+	Value   string `json:"value,omitempty"`
+	Present bool   `json:"present"`
+	Passed  bool   `json:"passed"`
+}
+
+// CookieAudit lists the flags of a cookie the page sets.
+type CookieAudit struct {
+	Name     string `json:"name"`
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"http_only"`
+	SameSite string `json:"same_site,omitempty"`
+}
+
+// MixedContent lists the http references of a page served over https.
+// Active content (scripts, stylesheets, frames, plugins) can rewrite the
+// page and is blocked by browsers; passive content (images and media) is
+// only displayed. At most 50 references of each kind are listed; the counts
+// cover all of them.
+type MixedContent struct {
+	ActiveCount  int      `json:"active_count"`
+	PassiveCount int      `json:"passive_count"`
+	Active       []string `json:"active,omitempty"`
+	Passive      []string `json:"passive,omitempty"`
+}
+
+// TLSAudit describes the connection and the certificate chain of an https
+// page when it was fetched. Trusted is set when the client verified the
+// chain, which it does not with a fetch profile accepting any certificate;
+// Deprecated marks protocols older than TLS 1.2.
+type TLSAudit struct {
+	Version       string            `json:"version"`
+	Deprecated    bool              `json:"deprecated"`
+	CipherSuite   string            `json:"cipher_suite"`
+	Trusted       bool              `json:"trusted"`
+	HostnameMatch bool              `json:"hostname_match"`
+	Expired       bool              `json:"expired"`
+	ExpiresInDays int               `json:"expires_in_days"`
+	Chain         []CertificateInfo `json:"chain"`
+}
+
+type CertificateInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+}
+
+// auditSecurity grades the page at pageURL from the header and TLS audit of
+// its response and from its parsed document.
+func auditSecurity(pageURL *neturl.URL, header http.Header, tlsAudit *TLSAudit, doc *html.Node) *SecurityReport {
+	report := &SecurityReport{Score: 100}
+	https := pageURL.Scheme == "https"
+
+	if !https {
+		report.penalize(CheckTLS, "page is not served over https", 30)
+	}
+	report.auditHeaders(header, https)
+	report.auditCookies(header, https)
+	if https {
+		report.auditMixedContent(pageURL, doc)
+		if tlsAudit != nil {
+			report.gradeTLS(pageURL.Hostname(), tlsAudit)
+		}
+	}
+
+	if report.Score < 0 {
+		report.Score = 0
+	}
+	report.Grade = grade(report.Score)
+	return report
+}
+
+func (r *SecurityReport) penalize(check, message string, penalty int) {
+	r.Issues = append(r.Issues, SecurityIssue{Check: check, Message: message, Penalty: penalty})
+	r.Score -= penalty
+}
+
+func grade(score int) string {
+	switch {
+	case score >= 90:
+		return "A"
+	case score >= 80:
+		return "B"
+	case score >= 70:
+		return "C"
+	case score >= 60:
+		return "D"
+	}
+	return "F"
+}
+
+func (r *SecurityReport) auditHeaders(header http.Header, https bool) {
+	csp := parseCSP(header.Get("Content-Security-Policy"))
+
+	check := func(name string, penalty int, verify func(value string) (string, bool)) {
+		value := header.Get(name)
+		audit := SecurityHeader{Name: name, Value: value, Present: value != ""}
+		if !audit.Present {
+			r.penalize(CheckHeaders, "missing "+name, penalty)
+		} else if problem, ok := verify(value); ok {
+			audit.Passed = true
+		} else {
+			r.penalize(CheckHeaders, name+": "+problem, (penalty+1)/2)
+		}
+		r.Headers = append(r.Headers, audit)
+	}
+
+	if https {
+		check("Strict-Transport-Security", 20, func(value string) (string, bool) {
+			maxAge, ok := hstsMaxAge(value)
+			if !ok {
+				return "no valid max-age", false
+			}
+			if maxAge < minHSTSMaxAge {
+				return "max-age shorter than 180 days", false
+			}
+			return "", true
+		})
+	}
+	check("Content-Security-Policy", 20, func(string) (string, bool) {
+		scripts, ok := csp["script-src"]
+		if !ok {
+			scripts = csp["default-src"]
+		}
+		for _, source := range scripts {
+			if source == "'unsafe-inline'" || source == "'unsafe-eval'" {
+				return "allows " + source + " scripts", false
+			}
+		}
+		return "", true
+	})
+
+	// frame-ancestors supersedes X-Frame-Options
+	if _, ok := csp["frame-ancestors"]; ok {
+		r.Headers = append(r.Headers, SecurityHeader{
+			Name:    "X-Frame-Options",
+			Value:   header.Get("X-Frame-Options"),
+			Present: header.Get("X-Frame-Options") != "",
+			Passed:  true,
+		})
+	} else {
+		check("X-Frame-Options", 10, func(value string) (string, bool) {
+			switch strings.ToUpper(strings.TrimSpace(value)) {
+			case "DENY", "SAMEORIGIN":
+				return "", true
+			}
+			return "should be DENY or SAMEORIGIN", false
+		})
+	}
+	check("X-Content-Type-Options", 10, func(value string) (string, bool) {
+		if strings.EqualFold(strings.TrimSpace(value), "nosniff") {
+			return "", true
+		}
+		return "should be nosniff", false
+	})
+	check("Referrer-Policy", 5, func(value string) (string, bool) {
+		// the last policy the browser supports applies
+		policies := strings.Split(value, ",")
+		if strings.EqualFold(strings.TrimSpace(policies[len(policies)-1]), "unsafe-url") {
+			return "unsafe-url leaks full URLs", false
+		}
+		return "", true
+	})
+	check("Permissions-Policy", 5, func(string) (string, bool) {
+		return "", true
+	})
+}
+
+// parseCSP returns the sources of every directive of a Content-Security-Policy.
+func parseCSP(policy string) map[string][]string {
+	directives := make(map[string][]string)
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		// only the first occurrence of a directive applies
+		if _, exists := directives[name]; !exists {
+			directives[name] = fields[1:]
+		}
+	}
+	return directives
+}
+
+func hstsMaxAge(value string) (time.Duration, bool) {
+	for _, directive := range strings.Split(value, ";") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(arg), `"`), 10, 64)
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// maxCookiePenalty caps what the cookies of a page can cost together.
+const maxCookiePenalty = 15
+
+func (r *SecurityReport) auditCookies(header http.Header, https bool) {
+	cookies := (&http.Response{Header: header}).Cookies()
+	r.Cookies = make([]CookieAudit, 0, len(cookies))
+	penalty := 0
+	for _, cookie := range cookies {
+		audit := CookieAudit{Name: cookie.Name, Secure: cookie.Secure, HttpOnly: cookie.HttpOnly}
+		switch cookie.SameSite {
+		case http.SameSiteLaxMode:
+			audit.SameSite = "Lax"
+		case http.SameSiteStrictMode:
+			audit.SameSite = "Strict"
+		case http.SameSiteNoneMode:
+			audit.SameSite = "None"
+		}
+		r.Cookies = append(r.Cookies, audit)
+
+		var missing []string
+		if https && !audit.Secure {
+			missing = append(missing, "Secure")
+		}
+		if !audit.HttpOnly {
+			missing = append(missing, "HttpOnly")
+		}
+		if audit.SameSite == "" {
+			missing = append(missing, "SameSite")
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		cost := 2 * len(missing)
+		if penalty+cost > maxCookiePenalty {
+			cost = maxCookiePenalty - penalty
+		}
+		penalty += cost
+		r.penalize(CheckCookies, fmt.Sprintf("cookie %q lacks %s", cookie.Name, strings.Join(missing, ", ")), cost)
+	}
+}
+
+// activeContent are the elements whose http sources make up active mixed
+// content, with the attribute holding the source.
+var activeContent = map[string]string{
+	"script": "src",
+	"iframe": "src",
+	"frame":  "src",
+	"object": "data",
+	"embed":  "src",
+}
+
+var passiveContent = map[string]string{
+	"img":    "src",
+	"audio":  "src",
+	"video":  "src",
+	"source": "src",
+	"track":  "src",
+}
+
+func (r *SecurityReport) auditMixedContent(pageURL *neturl.URL, doc *html.Node) {
+	mixed := &r.MixedContent
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			attr, active := activeContent[n.Data]
+			if !active {
+				attr = passiveContent[n.Data]
+			}
+			if n.Data == "link" && hasToken(attrValue(n, "rel"), "stylesheet") {
+				attr, active = "href", true
+			}
+			if attr != "" {
+				if ref := insecureReference(pageURL, attrValue(n, attr)); ref != "" {
+					if active {
+						mixed.ActiveCount++
+						if len(mixed.Active) < maxMixedContent {
+							mixed.Active = append(mixed.Active, ref)
+						}
+					} else {
+						mixed.PassiveCount++
+						if len(mixed.Passive) < maxMixedContent {
+							mixed.Passive = append(mixed.Passive, ref)
+						}
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	if doc != nil {
+		walk(doc)
+	}
+
+	if mixed.ActiveCount > 0 {
+		r.penalize(CheckMixedContent, fmt.Sprintf("%d active resources loaded over http", mixed.ActiveCount), 20)
+	}
+	if mixed.PassiveCount > 0 {
+		r.penalize(CheckMixedContent, fmt.Sprintf("%d passive resources loaded over http", mixed.PassiveCount), 10)
+	}
+}
+
+// insecureReference returns ref resolved against the page when it is an http
+// URL, or "" otherwise.
+func insecureReference(pageURL *neturl.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	resolved, err := pageURL.Parse(ref)
+	if err != nil || resolved.Scheme != "http" {
+		return ""
+	}
+	return resolved.String()
+}
+
+func attrValue(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// newTLSAudit describes the TLS state of a response from host at now. The
+// chain is verified against roots, the system roots when nil, whether or not
+// the client verified it during the handshake.
+func newTLSAudit(host string, state *tls.ConnectionState, roots *x509.CertPool, now time.Time) *TLSAudit {
+	audit := &TLSAudit{
+		Version:     tlsVersionName(state.Version),
+		Deprecated:  state.Version < tls.VersionTLS12,
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) == 0 {
+		return audit
+	}
+
+	for _, cert := range state.PeerCertificates {
+		audit.Chain = append(audit.Chain, certificateInfo(cert))
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now})
+	audit.Trusted = err == nil
+	audit.HostnameMatch = leaf.VerifyHostname(host) == nil
+	audit.Expired = now.After(leaf.NotAfter)
+	audit.ExpiresInDays = int(leaf.NotAfter.Sub(now).Hours() / 24)
+	return audit
+}
+
+func (r *SecurityReport) gradeTLS(host string, audit *TLSAudit) {
+	r.TLS = audit
+
+	if audit.Deprecated {
+		r.penalize(CheckTLS, audit.Version+" is deprecated", 20)
+	}
+	if len(audit.Chain) == 0 {
+		return
+	}
+
+	switch {
+	case audit.Expired:
+		r.penalize(CheckTLS, "certificate expired on "+audit.Chain[0].NotAfter.Format("2006-01-02"), 30)
+	case audit.ExpiresInDays < int(certExpiryWarning.Hours()/24):
+		r.penalize(CheckTLS, fmt.Sprintf("certificate expires in %d days", audit.ExpiresInDays), 5)
+	}
+	if !audit.HostnameMatch {
+		r.penalize(CheckTLS, "certificate is not valid for "+host, 30)
+	}
+	if !audit.Trusted {
+		r.penalize(CheckTLS, "certificate chain was not verified", 20)
+	}
+}
+
+func certificateInfo(cert *x509.Certificate) CertificateInfo {
+	return CertificateInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DNSNames:  cert.DNSNames,
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("unknown (0x%04x)", version)
+}
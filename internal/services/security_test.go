@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/html"
+)
+
+func mustParseHTML(t *testing.T, page string) *html.Node {
+	t.Helper()
+	doc, err := html.Parse(strings.NewReader(page))
+	require.NoError(t, err)
+	return doc
+}
+
+func TestAuditSecurityHeaders(t *testing.T) {
+	pageURL, _ := neturl.Parse("https://example.com/")
+	header := http.Header{}
+	header.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+	header.Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+	header.Set("Permissions-Policy", "camera=()")
+	header.Add("Set-Cookie", "session=1; Secure; HttpOnly; SameSite=Lax")
+
+	report := auditSecurity(pageURL, header, nil, mustParseHTML(t, "<p>hi</p>"))
+	assert.Equal(t, 100, report.Score)
+	assert.Equal(t, "A", report.Grade)
+	assert.Empty(t, report.Issues)
+	assert.Len(t, report.Headers, 6)
+	for _, h := range report.Headers {
+		assert.True(t, h.Passed, h.Name)
+	}
+	assert.Equal(t, []CookieAudit{{Name: "session", Secure: true, HttpOnly: true, SameSite: "Lax"}}, report.Cookies)
+
+	weak := http.Header{}
+	weak.Set("Strict-Transport-Security", "max-age=600")
+	weak.Set("Content-Security-Policy", "script-src 'self' 'unsafe-inline'")
+	weak.Set("X-Frame-Options", "ALLOW-FROM https://other.example")
+	weak.Add("Set-Cookie", "tracking=1")
+
+	report = auditSecurity(pageURL, weak, nil, mustParseHTML(t, "<p>hi</p>"))
+	// 10 (short HSTS) + 10 (unsafe-inline) + 5 (X-Frame-Options) + 10 + 5 + 5
+	// (missing headers) + 6 (cookie)
+	assert.Equal(t, 49, report.Score)
+	assert.Equal(t, "F", report.Grade)
+	assert.Contains(t, report.Issues, SecurityIssue{Check: CheckHeaders, Message: "Strict-Transport-Security: max-age shorter than 180 days", Penalty: 10})
+	assert.Contains(t, report.Issues, SecurityIssue{Check: CheckCookies, Message: `cookie "tracking" lacks Secure, HttpOnly, SameSite`, Penalty: 6})
+}
+
+func TestAuditSecurityPlainHTTP(t *testing.T) {
+	pageURL, _ := neturl.Parse("http://example.com/")
+	doc := mustParseHTML(t, `<script src="http://cdn.example.com/app.js"></script>`)
+
+	report := auditSecurity(pageURL, http.Header{}, nil, doc)
+	assert.Nil(t, report.TLS)
+	// HSTS is not checked, and mixed content only exists on https pages
+	assert.Len(t, report.Headers, 5)
+	assert.Zero(t, report.MixedContent.ActiveCount)
+	assert.Equal(t, 100-30-20-10-10-5-5, report.Score)
+}
+
+func TestAuditSecurityMixedContent(t *testing.T) {
+	pageURL, _ := neturl.Parse("https://example.com/blog/")
+	doc := mustParseHTML(t, `<html><head>
+		<script src="http://cdn.example.com/app.js"></script>
+		<link rel="stylesheet" href="http://cdn.example.com/site.css">
+		<link rel="icon" href="http://cdn.example.com/favicon.ico">
+		<link rel="no-stylesheet" href="http://cdn.example.com/other.css">
+		<script src="https://cdn.example.com/safe.js"></script>
+	</head><body>
+		<img src="http://images.example.com/a.png"><img src="/b.png">
+		<iframe src="//video.example.com/embed"></iframe>
+		<a href="http://example.org/">not a resource</a>
+	</body></html>`)
+
+	report := auditSecurity(pageURL, http.Header{}, nil, doc)
+	assert.Equal(t, MixedContent{
+		ActiveCount:  2,
+		PassiveCount: 1,
+		Active:       []string{"http://cdn.example.com/app.js", "http://cdn.example.com/site.css"},
+		Passive:      []string{"http://images.example.com/a.png"},
+	}, report.MixedContent)
+}
+
+func TestAnalyzePageSecurityTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<!DOCTYPE html><html><head><title>Secure</title></head></html>")
+	}))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	pa := NewPageAnalyzer(srv.Client(), logrus.New(), WithRootCAs(roots))
+	data, err := pa.AnalyzePage(context.Background(), srv.URL, &Task{})
+	require.NoError(t, err)
+
+	audit := data.Security.TLS
+	require.NotNil(t, audit)
+	assert.True(t, audit.Trusted)
+	assert.True(t, audit.HostnameMatch)
+	assert.False(t, audit.Expired)
+	assert.NotEmpty(t, audit.Version)
+	require.NotEmpty(t, audit.Chain)
+	assert.Contains(t, audit.Chain[0].DNSNames, "example.com")
+
+	// the test certificate is only valid for example.com and 127.0.0.1
+	client := srv.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+	localhost := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	data, err = NewPageAnalyzer(client, logrus.New(), WithRootCAs(roots)).AnalyzePage(context.Background(), localhost, &Task{})
+	require.NoError(t, err)
+	audit = data.Security.TLS
+	// the chain is verified by the audit, whatever the client skipped
+	assert.True(t, audit.Trusted)
+	assert.False(t, audit.HostnameMatch)
+	assert.Contains(t, data.Security.Issues, SecurityIssue{Check: CheckTLS, Message: "certificate is not valid for localhost", Penalty: 30})
+
+	// the test certificate is not signed by any of the system roots
+	data, err = NewPageAnalyzer(client, logrus.New()).AnalyzePage(context.Background(), localhost, &Task{})
+	require.NoError(t, err)
+	assert.False(t, data.Security.TLS.Trusted)
+	assert.Contains(t, data.Security.Issues, SecurityIssue{Check: CheckTLS, Message: "certificate chain was not verified", Penalty: 20})
+
+	// a fetch profile verifies the chain against its CA certificate
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	data, err = NewPageAnalyzer(client, logrus.New()).AnalyzePage(context.Background(), srv.URL, &Task{Profile: &FetchProfile{CACert: caCert}})
+	require.NoError(t, err)
+	assert.True(t, data.Security.TLS.Trusted)
+	assert.True(t, data.Security.TLS.HostnameMatch)
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSnapshotNotFound is returned for URLs or snapshots that are not stored.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshot is the response a run of a URL analyzed: its final URL, status,
+// headers and body, along with the redirects, timings and TLS audit of the
+// fetch so that the page can be analyzed again without fetching it. Body is
+// only loaded by SnapshotStoreInterface.Get.
+//
+// URL IDs start over when the service restarts, so a snapshot also records
+// the URL that was submitted and its owner, and only belongs to the URL with
+// its ID when they match.
+type Snapshot struct {
+	ID            string        `json:"id"`
+	URLID         int           `json:"url_id"`
+	RequestedURL  string        `json:"requested_url"`
+	Owner         string        `json:"owner,omitempty"`
+	URL           string        `json:"url"`
+	Attempt       int           `json:"attempt"`
+	StatusCode    int           `json:"status_code"`
+	Header        http.Header   `json:"headers"`
+	Truncated     bool          `json:"truncated"`
+	RedirectChain []RedirectHop `json:"redirect_chain,omitempty"`
+	Response      *ResponseInfo `json:"response,omitempty"`
+	TLS           *TLSAudit     `json:"tls,omitempty"`
+	FetchedAt     time.Time     `json:"fetched_at"`
+	BodyHash      string        `json:"body_hash"`
+	BodySize      int64         `json:"body_size"`
+	Body          []byte        `json:"-"`
+}
+
+// pageFromSnapshot returns the page snapshot was taken of, as if it had just
+// been fetched.
+func pageFromSnapshot(snapshot *Snapshot) *fetchedPage {
+	response := snapshot.Response
+	if response == nil {
+		// snapshots saved before responses were kept only have the headers
+		response = &ResponseInfo{
+			StatusCode: snapshot.StatusCode,
+			Headers:    make(map[string]string),
+			BodySize:   int64(len(snapshot.Body)),
+		}
+		for _, name := range responseHeaders {
+			if value := snapshot.Header.Get(name); value != "" {
+				response.Headers[strings.ToLower(name)] = value
+			}
+		}
+	}
+	return &fetchedPage{
+		url:         snapshot.URL,
+		chain:       snapshot.RedirectChain,
+		body:        snapshot.Body,
+		contentType: snapshot.Header.Get("Content-Type"),
+		truncated:   snapshot.Truncated,
+		response:    response,
+		header:      snapshot.Header,
+		tls:         snapshot.TLS,
+	}
+}
+
+// SnapshotRetention bounds the snapshots kept: at most MaxPerURL for every
+// URL, none older than MaxAge. Zero values disable a limit.
+type SnapshotRetention struct {
+	MaxPerURL int
+	MaxAge    time.Duration
+}
+
+// belongsTo reports whether snapshot was taken of urlInfo rather than of a
+// URL that had the same ID before a restart.
+func (snapshot *Snapshot) belongsTo(urlInfo *URLInfo) bool {
+	return snapshot.URLID == urlInfo.ID && snapshot.RequestedURL == urlInfo.URL && snapshot.Owner == urlInfo.Owner
+}
+
+type SnapshotStoreInterface interface {
+	Save(snapshot *Snapshot) error
+	// List returns the snapshots of a URL without their bodies, newest
+	// first.
+	List(urlInfo *URLInfo) ([]*Snapshot, error)
+	// Get returns a snapshot of a URL with its body, the newest when id is
+	// empty.
+	Get(urlInfo *URLInfo, id string) (*Snapshot, error)
+	Prune() error
+}
+
+// FileSnapshotStore keeps snapshots in a directory. Bodies are stored once
+// per content as gzip compressed blobs named after their SHA-256, under
+// blobs/; the other fields of every snapshot are a JSON file under
+// snapshots/<url id>/.
+type FileSnapshotStore struct {
+	dir       string
+	retention SnapshotRetention
+
+	// mu keeps Prune from deleting the blob of a snapshot being saved
+	mu sync.Mutex
+}
+
+func NewFileSnapshotStore(dir string, retention SnapshotRetention) (*FileSnapshotStore, error) {
+	for _, sub := range []string{"blobs", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileSnapshotStore{dir: dir, retention: retention}, nil
+}
+
+// Save stores snapshot, setting its ID, hash and size, and drops the oldest
+// snapshots of its URL beyond the retention.
+func (s *FileSnapshotStore) Save(snapshot *Snapshot) error {
+	sum := sha256.Sum256(snapshot.Body)
+	snapshot.BodyHash = hex.EncodeToString(sum[:])
+	snapshot.BodySize = int64(len(snapshot.Body))
+	if snapshot.FetchedAt.IsZero() {
+		snapshot.FetchedAt = time.Now()
+	}
+	// zero padded so that IDs sort by time
+	snapshot.ID = fmt.Sprintf("%020d", snapshot.FetchedAt.UnixNano())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeBlob(snapshot.BodyHash, snapshot.Body); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	urlDir := s.urlDir(snapshot.URLID)
+	if err := os.MkdirAll(urlDir, 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(urlDir, snapshot.ID+".json"), func(w io.Writer) error {
+		_, err := w.Write(meta)
+		return err
+	}); err != nil {
+		return err
+	}
+	return s.pruneURL(snapshot.URLID, time.Now())
+}
+
+// List leaves out the snapshots of other URLs that had the ID of urlInfo.
+func (s *FileSnapshotStore) List(urlInfo *URLInfo) ([]*Snapshot, error) {
+	ids, err := s.ids(urlInfo.ID)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		snapshot, err := s.readMeta(urlInfo.ID, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		if snapshot.belongsTo(urlInfo) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// Get returns ErrSnapshotNotFound for the snapshots of other URLs that had
+// the ID of urlInfo.
+func (s *FileSnapshotStore) Get(urlInfo *URLInfo, id string) (*Snapshot, error) {
+	var snapshot *Snapshot
+	if id == "" {
+		snapshots, err := s.List(urlInfo)
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) == 0 {
+			return nil, ErrSnapshotNotFound
+		}
+		snapshot = snapshots[0]
+	} else {
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return nil, ErrSnapshotNotFound
+		}
+		var err error
+		if snapshot, err = s.readMeta(urlInfo.ID, id); err != nil {
+			return nil, err
+		}
+		if !snapshot.belongsTo(urlInfo) {
+			return nil, ErrSnapshotNotFound
+		}
+	}
+
+	var err error
+	if snapshot.Body, err = s.readBlob(snapshot.BodyHash); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Prune drops the snapshots beyond the retention and the blobs no snapshot
+// refers to anymore.
+func (s *FileSnapshotStore) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, "snapshots"))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	referenced := make(map[string]bool)
+	for _, entry := range entries {
+		urlID, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if err := s.pruneURL(urlID, now); err != nil {
+			return err
+		}
+		ids, err := s.ids(urlID)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			_ = os.Remove(s.urlDir(urlID))
+		}
+		for _, id := range ids {
+			snapshot, err := s.readMeta(urlID, id)
+			if err != nil {
+				return err
+			}
+			referenced[snapshot.BodyHash] = true
+		}
+	}
+
+	return filepath.WalkDir(filepath.Join(s.dir, "blobs"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if hash := strings.TrimSuffix(d.Name(), ".gz"); !referenced[hash] {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// pruneURL drops the snapshots of urlID beyond the retention. s.mu must be
+// held.
+func (s *FileSnapshotStore) pruneURL(urlID int, now time.Time) error {
+	ids, err := s.ids(urlID)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		keep := s.retention.MaxPerURL <= 0 || len(ids)-i <= s.retention.MaxPerURL
+		if keep && s.retention.MaxAge > 0 {
+			nanos, _ := strconv.ParseInt(id, 10, 64)
+			keep = now.Sub(time.Unix(0, nanos)) <= s.retention.MaxAge
+		}
+		if keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.urlDir(urlID), id+".json")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSnapshotStore) urlDir(urlID int) string {
+	return filepath.Join(s.dir, "snapshots", strconv.Itoa(urlID))
+}
+
+func (s *FileSnapshotStore) blobPath(hash string) string {
+	return filepath.Join(s.dir, "blobs", hash[:2], hash+".gz")
+}
+
+// ids returns the IDs of the snapshots of urlID, oldest first.
+func (s *FileSnapshotStore) ids(urlID int) ([]string, error) {
+	entries, err := os.ReadDir(s.urlDir(urlID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *FileSnapshotStore) readMeta(urlID int, id string) (*Snapshot, error) {
+	meta, err := os.ReadFile(filepath.Join(s.urlDir(urlID), id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(meta, &snapshot); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot %s of URL %d: %w", id, urlID, err)
+	}
+	return &snapshot, nil
+}
+
+// writeBlob stores body under hash unless it is stored already.
+func (s *FileSnapshotStore) writeBlob(hash string, body []byte) error {
+	path := s.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+func (s *FileSnapshotStore) readBlob(hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, ErrSnapshotNotFound
+	}
+	file, err := os.Open(s.blobPath(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// writeFileAtomic writes path through a temporary file, so that readers
+// never see it half written.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
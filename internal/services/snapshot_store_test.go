@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countBlobs(t *testing.T, dir string) int {
+	t.Helper()
+	count := 0
+	err := filepath.WalkDir(filepath.Join(dir, "blobs"), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return count
+}
+
+func TestFileSnapshotStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSnapshotStore(dir, SnapshotRetention{MaxPerURL: 2})
+	require.NoError(t, err)
+
+	first := &URLInfo{ID: 1, URL: "http://example.com", Owner: "alice"}
+	second := &URLInfo{ID: 2, URL: "http://example.org/"}
+	start := time.Now()
+	for i, body := range []string{"<p>one</p>", "<p>two</p>", "<p>two</p>"} {
+		require.NoError(t, store.Save(&Snapshot{
+			URLID:        1,
+			RequestedURL: "http://example.com",
+			Owner:        "alice",
+			URL:          "http://example.com/",
+			Attempt:      i + 1,
+			StatusCode:   200,
+			Header:       http.Header{"Content-Type": {"text/html"}},
+			FetchedAt:    start.Add(time.Duration(i) * time.Second),
+			Body:         []byte(body),
+		}))
+	}
+	require.NoError(t, store.Save(&Snapshot{URLID: 2, RequestedURL: "http://example.org/", URL: "http://example.org/", Body: []byte("<p>two</p>")}))
+
+	// the first snapshot is beyond the retention, the others share a blob
+	snapshots, err := store.List(first)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, 3, snapshots[0].Attempt)
+	assert.Equal(t, 2, snapshots[1].Attempt)
+	assert.Nil(t, snapshots[0].Body)
+	assert.Equal(t, snapshots[0].BodyHash, snapshots[1].BodyHash)
+
+	latest, err := store.Get(first, "")
+	require.NoError(t, err)
+	assert.Equal(t, "<p>two</p>", string(latest.Body))
+	assert.EqualValues(t, 10, latest.BodySize)
+	assert.Equal(t, "text/html", latest.Header.Get("Content-Type"))
+
+	older, err := store.Get(first, snapshots[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, older.Attempt)
+
+	_, err = store.Get(first, "../2/x")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+	_, err = store.Get(&URLInfo{ID: 3}, "")
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+
+	// after a restart, ID 1 may be given to another URL or another user
+	for _, other := range []*URLInfo{{ID: 1, URL: "http://example.net/", Owner: "alice"}, {ID: 1, URL: "http://example.com", Owner: "bob"}} {
+		others, err := store.List(other)
+		require.NoError(t, err)
+		assert.Empty(t, others)
+		_, err = store.Get(other, "")
+		assert.ErrorIs(t, err, ErrSnapshotNotFound)
+		_, err = store.Get(other, snapshots[0].ID)
+		assert.ErrorIs(t, err, ErrSnapshotNotFound)
+	}
+
+	// the blob of the dropped snapshot is only deleted by Prune
+	assert.Equal(t, 2, countBlobs(t, dir))
+	require.NoError(t, store.Prune())
+	assert.Equal(t, 1, countBlobs(t, dir))
+	latest, err = store.Get(second, "")
+	require.NoError(t, err)
+	assert.Equal(t, "<p>two</p>", string(latest.Body))
+}
+
+func TestFileSnapshotStoreMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileSnapshotStore(dir, SnapshotRetention{MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Save(&Snapshot{URLID: 1, FetchedAt: time.Now().Add(-2 * time.Hour), Body: []byte("old")}))
+	require.NoError(t, store.Save(&Snapshot{URLID: 2, FetchedAt: time.Now().Add(-3 * time.Hour), Body: []byte("older")}))
+	require.NoError(t, store.Save(&Snapshot{URLID: 1, Body: []byte("new")}))
+
+	require.NoError(t, store.Prune())
+	snapshots, err := store.List(&URLInfo{ID: 1})
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	snapshots, err = store.List(&URLInfo{ID: 2})
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+	assert.Equal(t, 1, countBlobs(t, dir))
+	_, err = os.Stat(filepath.Join(dir, "snapshots", "2"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAnalyzePageSnapshots(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<!DOCTYPE html><html><head><title>Snap</title></head></html>")
+	}))
+	defer srv.Close()
+
+	var saved *Snapshot
+	store := &MockSnapshotStore{
+		SaveFunc: func(snapshot *Snapshot) error {
+			saved = snapshot
+			return nil
+		},
+	}
+	pa := NewPageAnalyzer(srv.Client(), logrus.New(), WithSnapshots(store))
+	_, err := pa.AnalyzePage(context.Background(), srv.URL, &Task{ID: 7, URL: srv.URL, User: "alice", Attempt: 2})
+	require.NoError(t, err)
+
+	require.NotNil(t, saved)
+	assert.Equal(t, 7, saved.URLID)
+	assert.Equal(t, 2, saved.Attempt)
+	assert.Equal(t, srv.URL, saved.RequestedURL)
+	assert.Equal(t, "alice", saved.Owner)
+	assert.Equal(t, srv.URL, saved.URL)
+	assert.Equal(t, http.StatusOK, saved.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", saved.Header.Get("Content-Type"))
+	assert.Equal(t, "<!DOCTYPE html><html><head><title>Snap</title></head></html>", string(saved.Body))
+}
+
+func TestAnalyzeSnapshot(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/", http.StatusMovedPermanently)
+			return
+		}
+		hits++
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fmt.Fprint(w, `<!DOCTYPE html><html lang="en"><head><title>Snap</title></head><body>
+			<h1>Hello</h1><a href="/about">About</a><a href="http://127.0.0.1:1/">Down</a>
+			<script src="https://www.googletagmanager.com/gtag/js"></script>
+		</body></html>`)
+	}))
+	defer srv.Close()
+
+	store, err := NewFileSnapshotStore(t.TempDir(), SnapshotRetention{})
+	require.NoError(t, err)
+	pa := NewPageAnalyzer(srv.Client(), logrus.New(), WithSnapshots(store))
+	fetched, err := pa.AnalyzePage(context.Background(), srv.URL+"/old", &Task{ID: 1, URL: srv.URL + "/old", Attempt: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, hits)
+
+	snapshot, err := store.Get(&URLInfo{ID: 1, URL: srv.URL + "/old"}, "")
+	require.NoError(t, err)
+	data, err := pa.AnalyzeSnapshot(context.Background(), snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, 1, hits, "snapshots are analyzed without fetching")
+
+	assert.Equal(t, snapshot.ID, data.SnapshotID)
+	assert.Zero(t, data.InaccessibleLinks, "links of snapshots are not checked")
+	fetched.InaccessibleLinks = 0
+	data.SnapshotID = ""
+	assert.Equal(t, fetched, data)
+
+	// snapshots saved before the response was kept still analyze
+	snapshot.Response, snapshot.RedirectChain = nil, nil
+	data, err = pa.AnalyzeSnapshot(context.Background(), snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, "Snap", data.PageTitle)
+	assert.Equal(t, http.StatusOK, data.Response.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", data.Response.Headers["content-type"])
+}
@@ -1,7 +1,10 @@
 package services
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,96 +12,557 @@ import (
 )
 
 type Task struct {
-	ID     int
-	URL    string
-	Result *DataInfo
-	Err    error
-	Done   bool
-	Stop   bool
+	ID       int
+	URL      string
+	User     string
+	Priority int
+	Timeouts Timeouts
+	Profile  *FetchProfile
+	Result   *DataInfo
+	Err      error
+	Done     bool
+	Stop     bool
+	Attempt  int
+
+	queued      bool
+	running     bool
+	retryTimer  *time.Timer
+	cancel      context.CancelFunc
+	interrupted bool
+	enqueuedAt  time.Time
+	// restart holds the URL a restart was requested for while the previous
+	// run was still in flight, applied once that run finished
+	restart *URLInfo
+}
+
+// QueuePosition describes where a pending task stands in the queue.
+// Position 1 means the task is the next one to start.
+type QueuePosition struct {
+	Position       int
+	EstimatedStart *time.Time
+}
+
+// QueueStatus is a snapshot of the task queue. QueueDepth counts the tasks
+// waiting for a worker, ActiveWorkers the workers processing a task.
+// Autoscale is set while the pool is autoscaled.
+type QueueStatus struct {
+	Paused        bool             `json:"paused"`
+	QueueDepth    int              `json:"queue_depth"`
+	ActiveWorkers int              `json:"active_workers"`
+	Workers       int              `json:"workers"`
+	Autoscale     *AutoscaleConfig `json:"autoscale,omitempty"`
 }
 
 type TaskQueueInterface interface {
 	AddTask(urlInfo *URLInfo) (*Task, error)
 	StopTask(id int) (*Task, error)
+	QueuePositions() map[int]QueuePosition
+	Pause(cancelInFlight bool)
+	Resume()
+	Status() QueueStatus
+	SetWorkerCount(n int) error
+	SetAutoscaling(config AutoscaleConfig) error
 }
 
+type TaskQueueOption func(tq *TaskQueue)
+
+// WithTimeouts sets the timeouts of tasks whose URL does not set its own.
+func WithTimeouts(timeouts Timeouts) TaskQueueOption {
+	return func(tq *TaskQueue) {
+		tq.timeouts = timeouts
+	}
+}
+
+// WithRetryPolicy retries failed analyses according to policy. Without it a
+// failed analysis is not retried.
+func WithRetryPolicy(policy RetryPolicy) TaskQueueOption {
+	return func(tq *TaskQueue) {
+		tq.retryPolicy = policy
+	}
+}
+
+// WithMaxTasksPerUser caps how many tasks of a single user are processed at
+// the same time. 0 means no cap.
+func WithMaxTasksPerUser(n int) TaskQueueOption {
+	return func(tq *TaskQueue) {
+		tq.maxPerUser = n
+	}
+}
+
+// TaskQueue keeps the pending tasks of every user ordered by priority, then
+// submission order, and hands them to the workers taking turns across users,
+// so a large batch of one user does not delay everyone else. Priorities only
+// order the tasks of one user: a user submitting everything at the highest
+// priority still waits for their turn.
 type TaskQueue struct {
 	tasks        map[int]*Task
+	queues       map[string][]*Task
+	users        []string
+	active       map[string]int
+	lastServed   map[string]uint64
+	serveSeq     uint64
+	avgDuration  time.Duration
+	paused       bool
+	maxPerUser   int
+	retryPolicy  RetryPolicy
+	timeouts     Timeouts
 	workerCount  int
+	liveWorkers  int
+	autoscale    *AutoscaleConfig
+	scalerActive bool
+	avgWait      time.Duration
 	urlManager   URLManagerInterface
 	pageAnalyzer PageAnalyzerInterface
 	logger       *logrus.Logger
 	mu           sync.Mutex
-	sem          chan struct{}
+	wake         chan struct{}
 }
 
-func NewTaskQueue(workerCount int, urlManager URLManagerInterface, pageAnalyzer PageAnalyzerInterface, logger *logrus.Logger) *TaskQueue {
+func NewTaskQueue(workerCount int, urlManager URLManagerInterface, pageAnalyzer PageAnalyzerInterface, logger *logrus.Logger, opts ...TaskQueueOption) *TaskQueue {
 	tq := &TaskQueue{
 		tasks:        make(map[int]*Task),
+		queues:       make(map[string][]*Task),
+		active:       make(map[string]int),
+		lastServed:   make(map[string]uint64),
+		retryPolicy:  RetryPolicy{MaxAttempts: 1},
 		workerCount:  workerCount,
 		urlManager:   urlManager,
 		pageAnalyzer: pageAnalyzer,
 		logger:       logger,
-		sem:          make(chan struct{}, workerCount),
+		wake:         make(chan struct{}, 1),
 	}
 
-	for i := 0; i < workerCount; i++ {
-		go tq.worker()
+	for _, opt := range opts {
+		opt(tq)
 	}
 
+	tq.mu.Lock()
+	tq.startWorkers()
+	if tq.autoscale != nil {
+		tq.startAutoscaler()
+	}
+	tq.mu.Unlock()
+
 	return tq
 }
 
+// startWorkers starts goroutines until there are workerCount of them.
+func (tq *TaskQueue) startWorkers() {
+	for ; tq.liveWorkers < tq.workerCount; tq.liveWorkers++ {
+		go tq.worker()
+	}
+}
+
+// SetWorkerCount resizes the worker pool. Surplus workers exit once they
+// finish their current task, so no task is dropped. It turns autoscaling
+// off.
+func (tq *TaskQueue) SetWorkerCount(n int) error {
+	if n < 1 || n > MaxWorkerCount {
+		return fmt.Errorf("worker count must be between 1 and %d", MaxWorkerCount)
+	}
+
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.autoscale = nil
+	tq.resize(n)
+	return nil
+}
+
+func (tq *TaskQueue) resize(n int) {
+	if n == tq.workerCount {
+		return
+	}
+	tq.logger.Infof("Resizing worker pool from %d to %d", tq.workerCount, n)
+	tq.workerCount = n
+	tq.startWorkers()
+	// idle workers notice they are surplus when woken up
+	tq.signal()
+}
+
 func (tq *TaskQueue) worker() {
 	for {
-		tq.sem <- struct{}{}
-		tq.mu.Lock()
-		var taskToProcess *Task
-		for _, task := range tq.tasks {
-			if tq.urlManager.GetURLState(task.ID) == Pending {
-				tq.urlManager.UpdateURLState(task.ID, Processing)
-				taskToProcess = task
-				break
+		task, retire := tq.nextTask()
+		if retire {
+			return
+		}
+		if task == nil {
+			select {
+			case <-tq.wake:
+			case <-time.After(1 * time.Second):
 			}
+			continue
+		}
+
+		tq.processTask(task)
+		tq.finishTask(task)
+	}
+}
+
+// nextTask picks the next pending task: the head of the queue of the user
+// served least recently, which is that user's highest priority task. Users
+// that already have maxPerUser tasks in progress are skipped.
+//
+// retire is true when the pool shrank and the calling worker has to exit.
+func (tq *TaskQueue) nextTask() (task *Task, retire bool) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	defer tq.removeEmptyQueues()
+
+	if tq.liveWorkers > tq.workerCount {
+		tq.liveWorkers--
+		tq.signal()
+		return nil, true
+	}
+
+	if tq.paused {
+		return nil, false
+	}
+
+	var best *Task
+	for _, user := range tq.users {
+		if tq.maxPerUser > 0 && tq.active[user] >= tq.maxPerUser {
+			continue
 		}
-		tq.mu.Unlock()
+		head := tq.peekTask(user)
+		if head != nil && (best == nil || tq.before(head, best, tq.lastServed)) {
+			best = head
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
 
-		if taskToProcess != nil {
-			go func(task *Task) {
-				tq.processTask(task)
-				<-tq.sem
-			}(taskToProcess)
+	tq.queues[best.User] = tq.queues[best.User][1:]
+	best.queued = false
+	tq.recordWait(time.Since(best.enqueuedAt))
+
+	tq.serveSeq++
+	tq.lastServed[best.User] = tq.serveSeq
+	tq.active[best.User]++
+	best.running = true
+	tq.urlManager.UpdateURLState(best.ID, Processing)
+	tq.signal()
+	return best, false
+}
+
+// before reports whether head task a should be started before head task b
+// of another user.
+func (tq *TaskQueue) before(a, b *Task, lastServed map[string]uint64) bool {
+	return lastServed[a.User] < lastServed[b.User]
+}
+
+// peekTask returns the first task of user that is still pending, dropping
+// tasks that were stopped while they waited.
+func (tq *TaskQueue) peekTask(user string) *Task {
+	queue := tq.queues[user]
+	for len(queue) > 0 {
+		task := queue[0]
+		if !task.running && tq.urlManager.GetURLState(task.ID) == Pending {
+			break
+		}
+		task.queued = false
+		queue = queue[1:]
+	}
+	tq.queues[user] = queue
+	if len(queue) == 0 {
+		return nil
+	}
+	return queue[0]
+}
+
+func (tq *TaskQueue) removeEmptyQueues() {
+	users := tq.users[:0]
+	for _, user := range tq.users {
+		if len(tq.queues[user]) > 0 {
+			users = append(users, user)
 		} else {
-			<-tq.sem
-			time.Sleep(1 * time.Second)
+			delete(tq.queues, user)
+		}
+	}
+	tq.users = users
+}
+
+// enqueue inserts task into its user's queue after every task with the same
+// or a higher priority. An already queued task is moved if its priority
+// changed.
+func (tq *TaskQueue) enqueue(task *Task) {
+	queue := tq.queues[task.User]
+	if task.queued {
+		for i, t := range queue {
+			if t == task {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+	} else {
+		task.enqueuedAt = time.Now()
+		if _, exists := tq.queues[task.User]; !exists {
+			tq.users = append(tq.users, task.User)
 		}
 	}
+
+	pos := sort.Search(len(queue), func(i int) bool {
+		return queue[i].Priority < task.Priority
+	})
+	queue = append(queue, nil)
+	copy(queue[pos+1:], queue[pos:])
+	queue[pos] = task
+
+	tq.queues[task.User] = queue
+	task.queued = true
+	tq.signal()
+}
+
+func (tq *TaskQueue) signal() {
+	select {
+	case tq.wake <- struct{}{}:
+	default:
+	}
 }
 
 func (tq *TaskQueue) processTask(task *Task) {
-	tq.logger.Infof("Processing task ID: %d, URL: %s", task.ID, task.URL)
-	tq.urlManager.UpdateURLState(task.ID, Processing)
+	tq.logger.Infof("Processing task ID: %d, URL: %s, user: %s", task.ID, task.URL, task.User)
 
-	data, err := tq.pageAnalyzer.AnalyzePage(task.URL, task)
+	ctx, cancel := tq.taskContext(task)
+	defer cancel()
+
+	started := time.Now()
+	data, err := tq.pageAnalyzer.AnalyzePage(ctx, task.URL, task)
 
 	tq.mu.Lock()
 	defer tq.mu.Unlock()
 
+	task.cancel = nil
+
+	if task.interrupted {
+		task.interrupted = false
+		// a task that finished before it noticed the cancellation is kept
+		if !task.Stop && err != nil {
+			tq.logger.Infof("Task ID: %d interrupted, queued again", task.ID)
+			tq.urlManager.UpdateURLState(task.ID, Pending)
+			return
+		}
+	}
+
+	tq.recordDuration(time.Since(started))
+
 	if task.Stop {
 		tq.logger.Infof("Task ID: %d processing stopped", task.ID)
 		tq.urlManager.UpdateURLState(task.ID, Stopped)
+		task.Done = true
+		return
+	}
+
+	task.Result = data
+	task.Err = err
+	task.Attempt++
+
+	if err != nil && tq.retryPolicy.ShouldRetry(task.Attempt, err) {
+		delay := tq.retryPolicy.Backoff(task.Attempt)
+		retryAt := time.Now().Add(delay)
+		tq.logger.Warnf("Task ID: %d attempt %d failed, retrying in %s: %v", task.ID, task.Attempt, delay, err)
+		tq.urlManager.RecordAttempt(task.ID, err, &retryAt)
+		tq.urlManager.UpdateURLState(task.ID, Pending)
+		tq.scheduleRetry(task, delay)
+		return
+	}
+
+	tq.urlManager.RecordAttempt(task.ID, err, nil)
+	if err == nil {
+		tq.urlManager.UpdateProcessedData(task.ID, data)
 	} else {
-		task.Result = data
-		task.Err = err
+		failure := ClassifyError(err)
+		tq.logger.Warnf("Task ID: %d failed - reason: %s, error: %v", task.ID, failure.Reason, err)
+		tq.urlManager.MarkFailed(task.ID, failure)
+	}
 
-		if err == nil {
-			tq.urlManager.UpdateProcessedData(task.ID, data)
-		} else {
-			tq.urlManager.UpdateURLState(task.ID, Failed)
+	task.Done = true
+}
+
+// taskContext bounds a run of task by its total deadline. StopTask cancels
+// it.
+func (tq *TaskQueue) taskContext(task *Task) (context.Context, context.CancelFunc) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if task.Timeouts.Total > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), task.Timeouts.Total)
+	}
+	task.cancel = cancel
+	return ctx, cancel
+}
+
+// scheduleRetry queues task again once delay has passed, unless it was
+// stopped or restarted in the meantime.
+func (tq *TaskQueue) scheduleRetry(task *Task, delay time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		tq.mu.Lock()
+		defer tq.mu.Unlock()
+
+		if task.retryTimer != timer {
+			return
 		}
+		task.retryTimer = nil
+		if !task.running && tq.urlManager.GetURLState(task.ID) == Pending {
+			tq.enqueue(task)
+		}
+	})
+	task.retryTimer = timer
+}
+
+func (task *Task) cancelRetry() {
+	if task.retryTimer != nil {
+		task.retryTimer.Stop()
+		task.retryTimer = nil
 	}
+}
 
-	task.Done = true
+func (tq *TaskQueue) finishTask(task *Task) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	task.running = false
+	tq.active[task.User]--
+	if tq.active[task.User] <= 0 {
+		delete(tq.active, task.User)
+	}
+
+	if task.restart != nil {
+		tq.reset(task)
+		tq.configure(task, task.restart)
+		task.restart = nil
+	}
+	// the task was restarted, or interrupted, while its run was finishing
+	if task.retryTimer == nil && tq.urlManager.GetURLState(task.ID) == Pending {
+		tq.enqueue(task)
+	}
+	tq.signal()
+}
+
+// Pause stops workers from picking up queued tasks. Tasks in progress finish
+// unless cancelInFlight is set, in which case they are cancelled and queued
+// again to run after Resume.
+func (tq *TaskQueue) Pause(cancelInFlight bool) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.paused = true
+	if !cancelInFlight {
+		return
+	}
+	for _, task := range tq.tasks {
+		if task.running && task.cancel != nil {
+			task.interrupted = true
+			task.cancel()
+		}
+	}
+}
+
+func (tq *TaskQueue) Resume() {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	tq.paused = false
+	tq.signal()
+}
+
+func (tq *TaskQueue) Status() QueueStatus {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	status := QueueStatus{Paused: tq.paused, Workers: tq.workerCount}
+	if tq.autoscale != nil {
+		autoscale := *tq.autoscale
+		status.Autoscale = &autoscale
+	}
+	for _, queue := range tq.queues {
+		for _, task := range queue {
+			if !task.running && tq.urlManager.GetURLState(task.ID) == Pending {
+				status.QueueDepth++
+			}
+		}
+	}
+	for _, active := range tq.active {
+		status.ActiveWorkers += active
+	}
+	return status
+}
+
+// recordDuration keeps an exponentially weighted average of how long a task
+// takes, used to estimate start times.
+func (tq *TaskQueue) recordDuration(d time.Duration) {
+	if tq.avgDuration == 0 {
+		tq.avgDuration = d
+		return
+	}
+	tq.avgDuration = (tq.avgDuration*4 + d) / 5
+}
+
+// recordWait keeps an exponentially weighted average of how long tasks wait
+// for a worker, used by the autoscaler.
+func (tq *TaskQueue) recordWait(d time.Duration) {
+	if tq.avgWait == 0 {
+		tq.avgWait = d
+		return
+	}
+	tq.avgWait = (tq.avgWait*4 + d) / 5
+}
+
+// QueuePositions replays the scheduling order of all pending tasks. The
+// result is an estimate: per-user caps and tasks submitted later can change
+// the actual order.
+func (tq *TaskQueue) QueuePositions() map[int]QueuePosition {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+
+	heads := make(map[string]int, len(tq.users))
+	lastServed := make(map[string]uint64, len(tq.lastServed))
+	for user, seq := range tq.lastServed {
+		lastServed[user] = seq
+	}
+	seq := tq.serveSeq
+
+	pending := func(task *Task) bool {
+		return !task.running && tq.urlManager.GetURLState(task.ID) == Pending
+	}
+
+	positions := make(map[int]QueuePosition)
+	now := time.Now()
+	for {
+		var best *Task
+		for _, user := range tq.users {
+			queue := tq.queues[user]
+			for heads[user] < len(queue) && !pending(queue[heads[user]]) {
+				heads[user]++
+			}
+			if heads[user] == len(queue) {
+				continue
+			}
+			head := queue[heads[user]]
+			if best == nil || tq.before(head, best, lastServed) {
+				best = head
+			}
+		}
+		if best == nil {
+			break
+		}
+		heads[best.User]++
+		seq++
+		lastServed[best.User] = seq
+
+		position := QueuePosition{Position: len(positions) + 1}
+		if tq.avgDuration > 0 && tq.workerCount > 0 {
+			wait := time.Duration(float64(position.Position-1) / float64(tq.workerCount) * float64(tq.avgDuration))
+			start := now.Add(wait)
+			position.EstimatedStart = &start
+		}
+		positions[best.ID] = position
+	}
+
+	return positions
 }
 
 func (tq *TaskQueue) AddTask(urlInfo *URLInfo) (*Task, error) {
@@ -110,35 +574,76 @@ func (tq *TaskQueue) AddTask(urlInfo *URLInfo) (*Task, error) {
 
 		state := tq.urlManager.GetURLState(urlInfo.ID)
 		tq.logger.Infof(" GetURLState: %s", state)
-		if state == Stopped || state == Completed {
-			task.Stop = false
-			task.Done = false
-			task.Result = nil
-			task.Err = nil
-			tq.urlManager.UpdateURLState(urlInfo.ID, Pending)
-			tq.logger.Infof("Resetting task ID: %d", urlInfo.ID)
+		// task.Done also covers runs that the caller already put back to Pending
+		restart := task.Done || state.Terminal()
+		if task.running {
+			// the run in flight still reads the task, and would record its
+			// cancellation over the restart
+			if restart {
+				task.restart = urlInfo
+				tq.logger.Infof("Task ID: %d restarts once its current run finished", urlInfo.ID)
+			}
+			return task, nil
+		}
+		if restart {
+			tq.reset(task)
 		}
 	} else {
 
 		task = &Task{
-			ID:   urlInfo.ID,
-			URL:  urlInfo.URL,
-			Done: false,
-			Stop: false,
+			ID:       urlInfo.ID,
+			URL:      urlInfo.URL,
+			User:     urlInfo.Owner,
+			Priority: urlInfo.Priority,
+			Done:     false,
+			Stop:     false,
 		}
 		tq.tasks[task.ID] = task
 	}
+	tq.configure(task, urlInfo)
+
+	if tq.urlManager.GetURLState(task.ID) == Pending {
+		tq.enqueue(task)
+	}
 
 	return task, nil
 }
 
+// reset prepares a finished or stopped task for a new run. The task must not
+// be running.
+func (tq *TaskQueue) reset(task *Task) {
+	task.Stop = false
+	task.Done = false
+	task.Result = nil
+	task.Err = nil
+	task.Attempt = 0
+	task.cancelRetry()
+	tq.urlManager.ResetAttempts(task.ID)
+	tq.urlManager.UpdateURLState(task.ID, Pending)
+	tq.logger.Infof("Resetting task ID: %d", task.ID)
+}
+
+// configure applies the settings of urlInfo to task, which must not be
+// running.
+func (tq *TaskQueue) configure(task *Task, urlInfo *URLInfo) {
+	task.Priority = urlInfo.Priority
+	task.Timeouts = urlInfo.Timeouts.WithDefaults(tq.timeouts)
+	task.Profile = urlInfo.Profile
+}
+
 func (tq *TaskQueue) StopTask(id int) (*Task, error) {
 	tq.mu.Lock()
 	defer tq.mu.Unlock()
 	if task, exists := tq.tasks[id]; exists {
 		tq.logger.Infof("StopTask - task.Done: %v - task.Stop: %v", task.Done, task.Stop)
+		// a stop also cancels a restart waiting for the run in flight
+		task.restart = nil
 		if !task.Stop {
 			task.Stop = true
+			task.cancelRetry()
+			if task.cancel != nil {
+				task.cancel()
+			}
 			tq.urlManager.UpdateURLState(id, Stopped)
 			tq.logger.Infof("StopTask - Task ID: %d stop signal sent", task.ID)
 		} else {
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -9,17 +10,17 @@ import (
 )
 
 type MockPageAnalyzer struct {
-	AnalyzePageFunc func(url string, task *Task) (*DataInfo, error)
+	AnalyzePageFunc func(ctx context.Context, url string, task *Task) (*DataInfo, error)
 }
 
-func (m *MockPageAnalyzer) AnalyzePage(url string, task *Task) (*DataInfo, error) {
-	return m.AnalyzePageFunc(url, task)
+func (m *MockPageAnalyzer) AnalyzePage(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+	return m.AnalyzePageFunc(ctx, url, task)
 }
 
 func TestAddTask(t *testing.T) {
 	logger := logrus.New()
 	mockURLManager := &MockURLManager{
-		AddURLFunc: func(url string) *URLInfo {
+		AddURLFunc: func(url string, opts URLOptions) *URLInfo {
 			return &URLInfo{ID: 1, URL: url, State: Pending, UploadedAt: time.Now()}
 		},
 		GetURLStateFunc: func(id int) URLState {
@@ -29,7 +30,7 @@ func TestAddTask(t *testing.T) {
 	}
 
 	mockPageAnalyzer := &MockPageAnalyzer{
-		AnalyzePageFunc: func(url string, task *Task) (*DataInfo, error) {
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
 			return &DataInfo{
 				HTMLVersion:       "HTML5",
 				PageTitle:         "Mock Page",
@@ -44,7 +45,7 @@ func TestAddTask(t *testing.T) {
 
 	tq := NewTaskQueue(2, mockURLManager, mockPageAnalyzer, logger)
 
-	urlInfo := mockURLManager.AddURL("http://example.com")
+	urlInfo := mockURLManager.AddURL("http://example.com", URLOptions{})
 	task, err := tq.AddTask(urlInfo)
 
 	assert.NoError(t, err)
@@ -55,7 +56,7 @@ func TestAddTask(t *testing.T) {
 func TestStopTask(t *testing.T) {
 	logger := logrus.New()
 	mockURLManager := &MockURLManager{
-		AddURLFunc: func(url string) *URLInfo {
+		AddURLFunc: func(url string, opts URLOptions) *URLInfo {
 			return &URLInfo{ID: 1, URL: url, State: Pending, UploadedAt: time.Now()}
 		},
 		GetURLStateFunc: func(id int) URLState {
@@ -65,7 +66,7 @@ func TestStopTask(t *testing.T) {
 	}
 
 	mockPageAnalyzer := &MockPageAnalyzer{
-		AnalyzePageFunc: func(url string, task *Task) (*DataInfo, error) {
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
 			return &DataInfo{
 				HTMLVersion:       "HTML5",
 				PageTitle:         "Mock Page",
@@ -80,7 +81,7 @@ func TestStopTask(t *testing.T) {
 
 	tq := NewTaskQueue(2, mockURLManager, mockPageAnalyzer, logger)
 
-	urlInfo := mockURLManager.AddURL("http://example.com")
+	urlInfo := mockURLManager.AddURL("http://example.com", URLOptions{})
 	task, err := tq.AddTask(urlInfo)
 	assert.NoError(t, err)
 
@@ -89,3 +90,468 @@ func TestStopTask(t *testing.T) {
 	assert.NotNil(t, stoppedTask)
 	assert.True(t, stoppedTask.Stop)
 }
+
+func TestFairSchedulingAcrossUsers(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			started <- url
+			<-release
+			return &DataInfo{}, nil
+		},
+	}
+
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger)
+
+	// alice's first URL keeps the only worker busy while the rest is queued
+	_, err := tq.AddTask(urlManager.AddURL("http://a1", URLOptions{Owner: "alice"}))
+	assert.NoError(t, err)
+	order := []string{<-started}
+
+	for _, u := range []string{"http://a2", "http://a3"} {
+		_, err := tq.AddTask(urlManager.AddURL(u, URLOptions{Owner: "alice"}))
+		assert.NoError(t, err)
+	}
+	_, err = tq.AddTask(urlManager.AddURL("http://b1", URLOptions{Owner: "bob"}))
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+		order = append(order, <-started)
+	}
+	close(release)
+
+	assert.Equal(t, []string{"http://a1", "http://b1", "http://a2", "http://a3"}, order)
+}
+
+func TestMaxTasksPerUser(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			started <- task.User
+			<-release
+			return &DataInfo{}, nil
+		},
+	}
+
+	tq := NewTaskQueue(3, urlManager, mockPageAnalyzer, logger, WithMaxTasksPerUser(1))
+
+	for i := 0; i < 3; i++ {
+		_, err := tq.AddTask(urlManager.AddURL("http://alice.example.com", URLOptions{Owner: "alice"}))
+		assert.NoError(t, err)
+	}
+	_, err := tq.AddTask(urlManager.AddURL("http://bob.example.com", URLOptions{Owner: "bob"}))
+	assert.NoError(t, err)
+
+	users := []string{<-started, <-started}
+	assert.ElementsMatch(t, []string{"alice", "bob"}, users)
+
+	select {
+	case user := <-started:
+		t.Fatalf("a third task of %s started although alice is capped at one", user)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+}
+
+func TestPriorityOrdering(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			started <- url
+			<-release
+			return &DataInfo{}, nil
+		},
+	}
+
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger)
+
+	_, err := tq.AddTask(urlManager.AddURL("http://first", URLOptions{Owner: "alice"}))
+	assert.NoError(t, err)
+	order := []string{<-started}
+
+	queued := []struct {
+		url      string
+		owner    string
+		priority int
+	}{
+		{"http://a-low", "alice", 0},
+		{"http://b-low", "bob", 0},
+		{"http://a-high", "alice", 5},
+		{"http://b-urgent", "bob", 9},
+	}
+	for _, q := range queued {
+		_, err := tq.AddTask(urlManager.AddURL(q.url, URLOptions{Owner: q.owner, Priority: q.priority}))
+		assert.NoError(t, err)
+	}
+
+	positions := tq.QueuePositions()
+	assert.Len(t, positions, 4)
+	assert.Equal(t, 1, positions[5].Position)
+	assert.Equal(t, 2, positions[4].Position)
+	assert.Nil(t, positions[5].EstimatedStart, "no estimate before any task finished")
+
+	for i := 0; i < len(queued); i++ {
+		release <- struct{}{}
+		order = append(order, <-started)
+
+		if i == 0 {
+			positions = tq.QueuePositions()
+			assert.Len(t, positions, 3)
+			assert.Equal(t, 1, positions[4].Position)
+			assert.NotNil(t, positions[4].EstimatedStart)
+		}
+	}
+	close(release)
+
+	assert.Equal(t, []string{"http://first", "http://b-urgent", "http://a-high", "http://b-low", "http://a-low"}, order)
+}
+
+func TestPriorityDoesNotStarveOtherUsers(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			started <- url
+			<-release
+			return &DataInfo{}, nil
+		},
+	}
+
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger)
+
+	_, err := tq.AddTask(urlManager.AddURL("http://first", URLOptions{Owner: "carol"}))
+	assert.NoError(t, err)
+	order := []string{<-started}
+
+	_, err = tq.AddTask(urlManager.AddURL("http://a-low", URLOptions{Owner: "alice"}))
+	assert.NoError(t, err)
+	for _, url := range []string{"http://b-1", "http://b-2", "http://b-3"} {
+		_, err := tq.AddTask(urlManager.AddURL(url, URLOptions{Owner: "bob", Priority: MaxPriority}))
+		assert.NoError(t, err)
+	}
+
+	for i := 0; i < 4; i++ {
+		release <- struct{}{}
+		order = append(order, <-started)
+	}
+	close(release)
+
+	assert.Equal(t, []string{"http://first", "http://a-low", "http://b-1", "http://b-2", "http://b-3"}, order)
+}
+
+func TestRetryFailedTask(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	attempts := 0
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			attempts++
+			if url == "http://missing" {
+				return nil, &StatusError{StatusCode: 404, Status: "404 Not Found"}
+			}
+			if attempts < 3 {
+				return nil, &StatusError{StatusCode: 503, Status: "503 Service Unavailable"}
+			}
+			return &DataInfo{}, nil
+		},
+	}
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger, WithRetryPolicy(policy))
+
+	urlInfo := urlManager.AddURL("http://flaky", URLOptions{})
+	_, err := tq.AddTask(urlInfo)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return urlManager.GetURLState(urlInfo.ID) == Completed
+	}, time.Second, 5*time.Millisecond)
+
+	got := urlManager.GetURLInfo(urlInfo.ID)
+	assert.Equal(t, 3, got.Attempts)
+	assert.Len(t, got.AttemptErrors, 2)
+	assert.Equal(t, "failed to fetch URL: 503 Service Unavailable", got.AttemptErrors[0].Message)
+	assert.Equal(t, ReasonHTTPStatus, got.AttemptErrors[0].Reason)
+	assert.Equal(t, 503, got.AttemptErrors[0].StatusCode)
+	assert.Equal(t, 2, got.AttemptErrors[1].Attempt)
+	assert.Nil(t, got.NextAttemptAt)
+
+	// not retryable
+	attempts = 0
+	missing := urlManager.AddURL("http://missing", URLOptions{})
+	_, err = tq.AddTask(missing)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return urlManager.GetURLState(missing.ID) == Failed
+	}, time.Second, 5*time.Millisecond)
+	got = urlManager.GetURLInfo(missing.ID)
+	assert.Equal(t, 1, got.Attempts)
+	if assert.NotNil(t, got.Failure) {
+		assert.Equal(t, ReasonHTTPStatus, got.Failure.Reason)
+		assert.Equal(t, 404, got.Failure.StatusCode)
+	}
+}
+
+func TestTaskDeadline(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			<-ctx.Done()
+			return nil, &TimeoutError{Phase: PhaseTotal, Budget: task.Timeouts.Total}
+		},
+	}
+
+	// running out of time is not retried
+	retries := WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger, WithTimeouts(Timeouts{Total: time.Hour, Fetch: time.Second}), retries)
+
+	urlInfo := urlManager.AddURL("http://slow", URLOptions{Timeouts: Timeouts{Total: 20 * time.Millisecond}})
+	task, err := tq.AddTask(urlInfo)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return urlManager.GetURLState(urlInfo.ID) == TimedOut
+	}, time.Second, 5*time.Millisecond)
+
+	tq.mu.Lock()
+	assert.Equal(t, Timeouts{Total: 20 * time.Millisecond, Fetch: time.Second}, task.Timeouts)
+	tq.mu.Unlock()
+
+	failure := urlManager.GetURLInfo(urlInfo.ID).Failure
+	if assert.NotNil(t, failure) {
+		assert.Equal(t, ReasonTimeout, failure.Reason)
+		assert.Equal(t, PhaseTotal, failure.Phase)
+	}
+	assert.Equal(t, 1, urlManager.GetURLInfo(urlInfo.ID).Attempts)
+}
+
+func TestStopTaskCancelsAnalysis(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	started := make(chan struct{})
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger)
+
+	urlInfo := urlManager.AddURL("http://slow", URLOptions{})
+	_, err := tq.AddTask(urlInfo)
+	assert.NoError(t, err)
+
+	<-started
+	_, err = tq.StopTask(urlInfo.ID)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		task, _ := tq.GetTask(urlInfo.ID)
+		tq.mu.Lock()
+		defer tq.mu.Unlock()
+		return task.Done
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, Stopped, urlManager.GetURLState(urlInfo.ID))
+}
+
+func TestRestartWhileStoppedRunFinishes(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	release := make(chan struct{})
+	runs := make(chan *Task, 2)
+	calls := 0
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			calls++
+			runs <- task
+			if calls == 1 {
+				// the first run ignores its cancellation for a while
+				<-release
+				return nil, ctx.Err()
+			}
+			return &DataInfo{PageTitle: "done"}, nil
+		},
+	}
+
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger)
+
+	urlInfo := urlManager.AddURL("http://slow", URLOptions{})
+	_, err := tq.AddTask(urlInfo)
+	assert.NoError(t, err)
+	<-runs
+
+	_, err = tq.StopTask(urlInfo.ID)
+	assert.NoError(t, err)
+	restarted := *urlInfo
+	restarted.Priority = 3
+	restarted.Timeouts = Timeouts{Total: time.Minute}
+	_, err = tq.AddTask(&restarted)
+	assert.NoError(t, err)
+	assert.Equal(t, Stopped, urlManager.GetURLState(urlInfo.ID), "the restart waits for the run in flight")
+	close(release)
+
+	task := <-runs
+	assert.Eventually(t, func() bool {
+		return urlManager.GetURLState(urlInfo.ID) == Completed
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "done", urlManager.GetURLInfo(urlInfo.ID).ProcessedData.PageTitle)
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	assert.Equal(t, 3, task.Priority)
+	assert.Equal(t, time.Minute, task.Timeouts.Total)
+	assert.Equal(t, 1, task.Attempt)
+}
+
+func TestPauseAndResume(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	runs := make(chan string, 10)
+	// only the first run of the slow URL blocks until it is cancelled
+	block := make(chan struct{}, 1)
+	block <- struct{}{}
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			runs <- url
+			if url == "http://slow" {
+				select {
+				case <-block:
+					<-ctx.Done()
+					return nil, ctx.Err()
+				default:
+				}
+			}
+			return &DataInfo{}, nil
+		},
+	}
+
+	tq := NewTaskQueue(2, urlManager, mockPageAnalyzer, logger)
+
+	slow := urlManager.AddURL("http://slow", URLOptions{})
+	_, err := tq.AddTask(slow)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://slow", <-runs)
+
+	tq.Pause(true)
+
+	queued := urlManager.AddURL("http://queued", URLOptions{})
+	_, err = tq.AddTask(queued)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return tq.Status() == QueueStatus{Paused: true, QueueDepth: 2, ActiveWorkers: 0, Workers: 2}
+	}, time.Second, 5*time.Millisecond, "the cancelled task is queued again")
+
+	select {
+	case url := <-runs:
+		t.Fatalf("%s started while the queue was paused", url)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 0, urlManager.GetURLInfo(slow.ID).Attempts, "an interrupted run is not an attempt")
+
+	tq.Resume()
+	assert.ElementsMatch(t, []string{"http://slow", "http://queued"}, []string{<-runs, <-runs})
+	assert.Eventually(t, func() bool {
+		return urlManager.GetURLState(slow.ID) == Completed && urlManager.GetURLState(queued.ID) == Completed
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestSetWorkerCount(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			started <- url
+			<-release
+			return &DataInfo{}, nil
+		},
+	}
+
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger)
+	for i := 0; i < 4; i++ {
+		_, err := tq.AddTask(urlManager.AddURL("http://example.com", URLOptions{}))
+		assert.NoError(t, err)
+	}
+	<-started
+
+	assert.Error(t, tq.SetWorkerCount(0))
+	assert.NoError(t, tq.SetWorkerCount(3))
+	<-started
+	<-started
+	assert.Equal(t, QueueStatus{QueueDepth: 1, ActiveWorkers: 3, Workers: 3}, tq.Status())
+
+	// shrinking waits for the running tasks instead of dropping them
+	assert.NoError(t, tq.SetWorkerCount(1))
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+	}
+	<-started
+
+	assert.Eventually(t, func() bool {
+		tq.mu.Lock()
+		defer tq.mu.Unlock()
+		return tq.liveWorkers == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, QueueStatus{QueueDepth: 0, ActiveWorkers: 1, Workers: 1}, tq.Status())
+	close(release)
+}
+
+func TestAutoscaling(t *testing.T) {
+	logger := logrus.New()
+	urlManager := NewURLManager()
+
+	release := make(chan struct{})
+	mockPageAnalyzer := &MockPageAnalyzer{
+		AnalyzePageFunc: func(ctx context.Context, url string, task *Task) (*DataInfo, error) {
+			<-release
+			return &DataInfo{}, nil
+		},
+	}
+
+	config := AutoscaleConfig{MinWorkers: 1, MaxWorkers: 3, QueuePerWorker: 1, Interval: 5 * time.Millisecond}
+	tq := NewTaskQueue(1, urlManager, mockPageAnalyzer, logger, WithAutoscaling(config))
+	for i := 0; i < 6; i++ {
+		_, err := tq.AddTask(urlManager.AddURL("http://example.com", URLOptions{}))
+		assert.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return tq.Status().Workers == 3
+	}, time.Second, 5*time.Millisecond, "scales up to max")
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return tq.Status().Workers == 1
+	}, time.Second, 5*time.Millisecond, "scales down to min once idle")
+
+	assert.NoError(t, tq.SetWorkerCount(2))
+	assert.Nil(t, tq.Status().Autoscale, "a manual size turns autoscaling off")
+}
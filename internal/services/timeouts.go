@@ -0,0 +1,93 @@
+package services
+
+import (
+	"fmt"
+	"time"
+)
+
+// Analysis phases with their own time budget.
+const (
+	PhaseTotal      = "total"
+	PhaseFetch      = "fetch"
+	PhaseParse      = "parse"
+	PhaseLinkChecks = "link_checks"
+)
+
+// MaxTimeout bounds every timeout that can be requested.
+const MaxTimeout = 10 * time.Minute
+
+// Timeouts limits how long the analysis of a URL may take: Total for the
+// whole task, the others for a single phase. 0 means no limit.
+type Timeouts struct {
+	Total      time.Duration
+	Fetch      time.Duration
+	Parse      time.Duration
+	LinkChecks time.Duration
+}
+
+// WithDefaults fills the timeouts that are not set from defaults.
+func (t Timeouts) WithDefaults(defaults Timeouts) Timeouts {
+	if t.Total == 0 {
+		t.Total = defaults.Total
+	}
+	if t.Fetch == 0 {
+		t.Fetch = defaults.Fetch
+	}
+	if t.Parse == 0 {
+		t.Parse = defaults.Parse
+	}
+	if t.LinkChecks == 0 {
+		t.LinkChecks = defaults.LinkChecks
+	}
+	return t
+}
+
+// Budget returns the timeout of phase.
+func (t Timeouts) Budget(phase string) time.Duration {
+	switch phase {
+	case PhaseTotal:
+		return t.Total
+	case PhaseFetch:
+		return t.Fetch
+	case PhaseParse:
+		return t.Parse
+	case PhaseLinkChecks:
+		return t.LinkChecks
+	}
+	return 0
+}
+
+func (t Timeouts) Validate() error {
+	phases := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{PhaseTotal, t.Total},
+		{PhaseFetch, t.Fetch},
+		{PhaseParse, t.Parse},
+		{PhaseLinkChecks, t.LinkChecks},
+	}
+	for _, phase := range phases {
+		if phase.timeout < 0 || phase.timeout > MaxTimeout {
+			return fmt.Errorf("%s timeout must be between 0 and %s", phase.name, MaxTimeout)
+		}
+	}
+	return nil
+}
+
+// TimeoutError is returned when the analysis runs out of time in a phase.
+type TimeoutError struct {
+	Phase  string
+	Budget time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Phase == PhaseTotal {
+		return fmt.Sprintf("task exceeded its %s deadline", e.Budget)
+	}
+	return fmt.Sprintf("%s phase exceeded its %s budget", e.Phase, e.Budget)
+}
+
+// Timeout and Temporary make TimeoutError a net.Error.
+func (e *TimeoutError) Timeout() bool   { return true }
+func (e *TimeoutError) Temporary() bool { return false }
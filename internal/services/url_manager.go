@@ -13,30 +13,101 @@ const (
 	Stopped    URLState = "stopped"
 	Completed  URLState = "completed"
 	Failed     URLState = "failed"
+	TimedOut   URLState = "timed_out"
+)
+
+// Terminal reports whether processing of a URL in state s has ended.
+func (s URLState) Terminal() bool {
+	return s == Completed || s == Stopped || s == Failed || s == TimedOut
+}
+
+// Task priorities: higher values are processed first.
+const (
+	MinPriority     = 0
+	MaxPriority     = 10
+	DefaultPriority = MinPriority
 )
 
 type URLInfo struct {
-	ID            int       `json:"id"`
-	URL           string    `json:"url"`
-	State         URLState  `json:"state"`
-	ProcessedData *DataInfo `json:"processed_data,omitempty"`
-	UploadedAt    time.Time `json:"uploaded_at"`
+	ID            int           `json:"id"`
+	URL           string        `json:"url"`
+	Owner         string        `json:"owner,omitempty"`
+	Priority      int           `json:"priority"`
+	State         URLState      `json:"state"`
+	ProcessedData *DataInfo     `json:"processed_data,omitempty"`
+	Failure       *FailureInfo  `json:"failure,omitempty"`
+	UploadedAt    time.Time     `json:"uploaded_at"`
+	Timeouts      Timeouts      `json:"-"`
+	Profile       *FetchProfile `json:"-"`
+
+	Attempts      int            `json:"attempts"`
+	AttemptErrors []AttemptError `json:"attempt_errors,omitempty"`
+	NextAttemptAt *time.Time     `json:"next_attempt_at,omitempty"`
+
+	// set while the URL is pending
+	QueuePosition  int        `json:"queue_position,omitempty"`
+	EstimatedStart *time.Time `json:"estimated_start,omitempty"`
+}
+
+// AttemptError records why one analysis attempt of a URL failed.
+type AttemptError struct {
+	Attempt int `json:"attempt"`
+	FailureInfo
 }
 
+// DataInfo is the result of analyzing a page. Charset is the encoding the
+// page was decoded from; Truncated is set when only the first part of a large
+// page was analyzed. FinalURL is where the redirects of the page ended, and
+// RedirectChain lists every response on the way there, the last being the
+// page itself; InsecureRedirect is set when one of them went from https to
+// http. Response describes the response the page was analyzed from, and
+// Security grades its security headers, cookies, mixed content and TLS.
+// Content describes its readable text, and Resources what it loads.
+// SnapshotID is set when the page was analyzed again from a stored snapshot
+// rather than fetched.
 type DataInfo struct {
-	HTMLVersion        string         `json:"html_version"`
-	PageTitle          string         `json:"page_title"`
-	HeadingTagsCount   map[string]int `json:"heading_tags_count"`
-	InternalLinks      int            `json:"internal_links"`
-	ExternalLinks      int            `json:"external_links"`
-	InaccessibleLinks  int            `json:"inaccessible_links"`
-	HasLoginForm       bool           `json:"has_login_form"`
-	ProcessingFinished time.Time      `json:"processing_finished"`
+	HTMLVersion        string             `json:"html_version"`
+	PageTitle          string             `json:"page_title"`
+	HeadingTagsCount   map[string]int     `json:"heading_tags_count"`
+	InternalLinks      int                `json:"internal_links"`
+	ExternalLinks      int                `json:"external_links"`
+	InaccessibleLinks  int                `json:"inaccessible_links"`
+	BlockedLinks       int                `json:"blocked_links"`
+	RobotsBlockedLinks int                `json:"robots_blocked_links"`
+	HasLoginForm       bool               `json:"has_login_form"`
+	Charset            string             `json:"charset"`
+	Truncated          bool               `json:"truncated"`
+	FinalURL           string             `json:"final_url"`
+	RedirectChain      []RedirectHop      `json:"redirect_chain"`
+	InsecureRedirect   bool               `json:"insecure_redirect"`
+	Response           *ResponseInfo      `json:"response"`
+	Security           *SecurityReport    `json:"security"`
+	Content            *ContentInfo       `json:"content"`
+	Resources          *ResourceInventory `json:"resources"`
+	SnapshotID         string             `json:"snapshot_id,omitempty"`
+	ProcessingFinished time.Time          `json:"processing_finished"`
+
+	// Links holds the absolute http(s) URLs the page links to, for crawling.
+	Links []string `json:"-"`
+}
+
+// URLOptions carries the submission details of a URL.
+type URLOptions struct {
+	Owner    string
+	Priority int
+	// Timeouts overrides the task queue defaults where set.
+	Timeouts Timeouts
+	// Profile customizes the requests made for the URL, may be nil.
+	Profile *FetchProfile
 }
 
 type URLManagerInterface interface {
-	AddURL(url string) *URLInfo
+	AddURL(url string, opts URLOptions) *URLInfo
 	UpdateURLState(id int, state URLState)
+	UpdateURLPriority(id int, priority int)
+	RecordAttempt(id int, err error, nextAttemptAt *time.Time)
+	ResetAttempts(id int)
+	MarkFailed(id int, failure *FailureInfo)
 	UpdateProcessedData(id int, data *DataInfo)
 	GetURLInfo(id int) *URLInfo
 	GetAllURLs() []*URLInfo
@@ -47,6 +118,7 @@ type URLManagerInterface interface {
 type URLManager struct {
 	mu           sync.RWMutex
 	urls         map[int]*URLInfo
+	listeners    []func(id int, state URLState)
 	idCounter    int
 	counterMutex sync.Mutex
 }
@@ -64,7 +136,7 @@ func (manager *URLManager) nextID() int {
 	return manager.idCounter
 }
 
-func (manager *URLManager) AddURL(url string) *URLInfo {
+func (manager *URLManager) AddURL(url string, opts URLOptions) *URLInfo {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 
@@ -73,6 +145,10 @@ func (manager *URLManager) AddURL(url string) *URLInfo {
 	urlInfo := &URLInfo{
 		ID:         id,
 		URL:        url,
+		Owner:      opts.Owner,
+		Priority:   opts.Priority,
+		Timeouts:   opts.Timeouts,
+		Profile:    opts.Profile,
 		State:      Pending,
 		UploadedAt: time.Now(),
 	}
@@ -81,19 +157,102 @@ func (manager *URLManager) AddURL(url string) *URLInfo {
 	return urlInfo
 }
 
+// OnStateChange registers fn to be called after the state of a URL was set.
+// Listeners run synchronously, possibly while the task queue holds its lock,
+// so they must not block or call into the task queue.
+func (manager *URLManager) OnStateChange(fn func(id int, state URLState)) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.listeners = append(manager.listeners, fn)
+}
+
+func (manager *URLManager) notify(id int) {
+	manager.mu.RLock()
+	urlInfo, exists := manager.urls[id]
+	if !exists {
+		manager.mu.RUnlock()
+		return
+	}
+	state := urlInfo.State
+	listeners := manager.listeners
+	manager.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn(id, state)
+	}
+}
+
 func (manager *URLManager) UpdateURLState(id int, state URLState) {
+	defer manager.notify(id)
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 	if urlInfo, exists := manager.urls[id]; exists {
 		urlInfo.State = state
+		if state != Pending {
+			urlInfo.NextAttemptAt = nil
+		}
+	}
+}
+
+// RecordAttempt counts a finished analysis attempt, keeping err if it failed.
+// nextAttemptAt is set when a retry is scheduled.
+func (manager *URLManager) RecordAttempt(id int, err error, nextAttemptAt *time.Time) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if urlInfo, exists := manager.urls[id]; exists {
+		urlInfo.Attempts++
+		if err != nil {
+			urlInfo.AttemptErrors = append(urlInfo.AttemptErrors, AttemptError{
+				Attempt:     urlInfo.Attempts,
+				FailureInfo: *ClassifyError(err),
+			})
+		}
+		urlInfo.NextAttemptAt = nextAttemptAt
+	}
+}
+
+func (manager *URLManager) ResetAttempts(id int) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if urlInfo, exists := manager.urls[id]; exists {
+		urlInfo.Attempts = 0
+		urlInfo.AttemptErrors = nil
+		urlInfo.NextAttemptAt = nil
+		urlInfo.Failure = nil
+	}
+}
+
+// MarkFailed moves the URL to the failed state, or timed_out if it ran out of
+// time, keeping why it failed.
+func (manager *URLManager) MarkFailed(id int, failure *FailureInfo) {
+	defer manager.notify(id)
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if urlInfo, exists := manager.urls[id]; exists {
+		urlInfo.State = Failed
+		if failure.Reason == ReasonTimeout {
+			urlInfo.State = TimedOut
+		}
+		urlInfo.Failure = failure
+		urlInfo.NextAttemptAt = nil
+	}
+}
+
+func (manager *URLManager) UpdateURLPriority(id int, priority int) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if urlInfo, exists := manager.urls[id]; exists {
+		urlInfo.Priority = priority
 	}
 }
 
 func (manager *URLManager) UpdateProcessedData(id int, data *DataInfo) {
+	defer manager.notify(id)
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
 	if urlInfo, exists := manager.urls[id]; exists {
 		urlInfo.State = Completed
+		urlInfo.Failure = nil
 		urlInfo.ProcessedData = data
 		urlInfo.ProcessedData.ProcessingFinished = time.Now()
 	}
@@ -8,7 +8,7 @@ func TestAddURL(t *testing.T) {
 	manager := NewURLManager()
 	url := "http://example.com"
 
-	urlInfo := manager.AddURL(url)
+	urlInfo := manager.AddURL(url, URLOptions{})
 
 	if urlInfo.URL != url {
 		t.Errorf("expected URL %s, got %s", url, urlInfo.URL)
@@ -31,7 +31,7 @@ func TestUpdateURLState(t *testing.T) {
 	manager := NewURLManager()
 	url := "http://example.com"
 
-	urlInfo := manager.AddURL(url)
+	urlInfo := manager.AddURL(url, URLOptions{})
 	manager.UpdateURLState(urlInfo.ID, Processing)
 
 	if urlInfo.State != Processing {
@@ -52,7 +52,7 @@ func TestUpdateProcessedData(t *testing.T) {
 		HasLoginForm:      true,
 	}
 
-	urlInfo := manager.AddURL(url)
+	urlInfo := manager.AddURL(url, URLOptions{})
 	manager.UpdateProcessedData(urlInfo.ID, data)
 
 	if urlInfo.State != Completed {
@@ -68,7 +68,7 @@ func TestGetURLInfo(t *testing.T) {
 	manager := NewURLManager()
 	url := "http://example.com"
 
-	addedURL := manager.AddURL(url)
+	addedURL := manager.AddURL(url, URLOptions{})
 	retrievedURL := manager.GetURLInfo(addedURL.ID)
 
 	if retrievedURL == nil {
@@ -85,8 +85,8 @@ func TestGetAllURLs(t *testing.T) {
 	url1 := "http://example1.com"
 	url2 := "http://example2.com"
 
-	manager.AddURL(url1)
-	manager.AddURL(url2)
+	manager.AddURL(url1, URLOptions{})
+	manager.AddURL(url2, URLOptions{})
 
 	urls := manager.GetAllURLs()
 	if len(urls) != 2 {
@@ -98,7 +98,7 @@ func TestGetURLState(t *testing.T) {
 	manager := NewURLManager()
 	url := "http://example.com"
 
-	urlInfo := manager.AddURL(url)
+	urlInfo := manager.AddURL(url, URLOptions{})
 	state := manager.GetURLState(urlInfo.ID)
 
 	if state != Pending {
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+var sensitiveFields = []string{"pass", "password", "secret", "token", "authorization", "cookie", "api_key", "apikey"}
+
+var sensitivePatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)\b(pass(?:word)?|secret|token|api[_-]?key)(\s*[:=]\s*)("[^"]*"|\S+)`), "${1}${2}" + redacted},
+	{regexp.MustCompile(`(?i)\b(bearer|apikey)\s+[A-Za-z0-9._~+/=-]+`), "${1} " + redacted},
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+	{regexp.MustCompile(`\bupk_[A-Za-z0-9_-]+`), redacted},
+}
+
+// RedactHook scrubs credentials from log entries before they are written:
+// fields with sensitive names and credential-looking substrings of the
+// message, such as "pass: ...", bearer tokens, JWTs and API keys.
+type RedactHook struct{}
+
+func (RedactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (RedactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for key, value := range entry.Data {
+		if isSensitiveField(key) {
+			entry.Data[key] = redacted
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = Redact(v)
+		case error:
+			if r := Redact(v.Error()); r != v.Error() {
+				entry.Data[key] = r
+			}
+		}
+	}
+	return nil
+}
+
+func Redact(s string) string {
+	for _, p := range sensitivePatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+func isSensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range sensitiveFields {
+		if key == field || strings.HasSuffix(key, "_"+field) {
+			return true
+		}
+	}
+	return false
+}
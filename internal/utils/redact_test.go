@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"user: admin, pass: hunter2", "user: admin, pass: [REDACTED]"},
+		{`password="correct horse"`, "password=[REDACTED]"},
+		{"Authorization: Bearer abc.def.ghi", "Authorization: Bearer [REDACTED]"},
+		{"key upk_Zm9vYmFy sent", "key [REDACTED] sent"},
+		{"token eyJhbGciOi.eyJ1c2VyIjoi.c2lnbmF0dXJl", "token [REDACTED]"},
+		{"Adding URL: http://example.com", "Adding URL: http://example.com"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Redact(tt.in))
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(RedactHook{})
+
+	logger.WithFields(logrus.Fields{
+		"user":     "admin",
+		"password": "hunter2",
+		"api_key":  "upk_secret",
+	}).WithError(errors.New("bad token=abc")).Info("login with pass: hunter2")
+
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.NotContains(t, out.String(), "upk_secret")
+	assert.NotContains(t, out.String(), "abc")
+	assert.Contains(t, out.String(), `"user":"admin"`)
+}
@@ -43,6 +43,15 @@ func GracefulShutdown(srv *http.Server, logger *logrus.Logger) {
 	logger.Println("Server exiting")
 }
 
+// OnSignal calls fn every time sig is received. It blocks forever.
+func OnSignal(sig os.Signal, fn func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	for range ch {
+		fn()
+	}
+}
+
 func GetEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value